@@ -0,0 +1,32 @@
+package wsp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// ChallengeHeader is the upgrade response header carrying the nonce the Client must answer
+const ChallengeHeader = "X-PROXY-CHALLENGE"
+
+// NewChallenge returns a random hex encoded nonce
+func NewChallenge() (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// ChallengeResponse returns the hex encoded HMAC-SHA256 of the nonce keyed by the shared secret
+func ChallengeResponse(secretKey string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChallengeResponse checks in constant time that the response matches the nonce and the shared secret
+func VerifyChallengeResponse(secretKey string, nonce string, response string) bool {
+	return hmac.Equal([]byte(ChallengeResponse(secretKey, nonce)), []byte(response))
+}
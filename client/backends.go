@@ -0,0 +1,89 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// Backend selection strategies of Config.BackendStrategy
+const (
+	// BackendRoundRobin sends the requests to the backends in turn
+	BackendRoundRobin = "round-robin"
+	// BackendLeastConn sends a request to the backend with the fewest requests in flight
+	BackendLeastConn = "least-conn"
+)
+
+// A client fronting several instances of its upstream distributes the requests to its BaseURL
+// across Config.Backends. The selection happens in the client rather than in the Server,
+// as only the client sees the requests in flight to each backend.
+
+// backend is an upstream instance fronted by the client
+type backend struct {
+	url      *url.URL
+	inFlight int64 // atomic
+}
+
+// backends distributes the requests to the base URL across the backends
+type backends struct {
+	base      *url.URL
+	list      []*backend
+	leastConn bool
+	next      uint64 // atomic
+}
+
+// newBackends parses Config.Backends, it returns nil if the client has no backends
+func newBackends(config *Config) (b *backends, err error) {
+	if len(config.Backends) == 0 {
+		return nil, nil
+	}
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("backends require a base URL")
+	}
+
+	b = new(backends)
+	b.base, err = url.Parse(config.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %q : %w", config.BaseURL, err)
+	}
+	switch config.BackendStrategy {
+	case "", BackendRoundRobin:
+	case BackendLeastConn:
+		b.leastConn = true
+	default:
+		return nil, fmt.Errorf("unknown backend strategy %q", config.BackendStrategy)
+	}
+
+	for _, raw := range config.Backends {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q", raw)
+		}
+		b.list = append(b.list, &backend{url: u})
+	}
+	return
+}
+
+// route sends the request to a backend if its destination is the base URL.
+// It returns the backend serving the request ( empty if none ) and a function to call once the request is done.
+func (b *backends) route(req *http.Request) (string, func()) {
+	if b == nil || req.URL.Scheme != b.base.Scheme || req.URL.Host != b.base.Host {
+		return "", func() {}
+	}
+
+	chosen := b.list[atomic.AddUint64(&b.next, 1)%uint64(len(b.list))]
+	if b.leastConn {
+		for _, backend := range b.list {
+			if atomic.LoadInt64(&backend.inFlight) < atomic.LoadInt64(&chosen.inFlight) {
+				chosen = backend
+			}
+		}
+	}
+
+	atomic.AddInt64(&chosen.inFlight, 1)
+	req.URL.Scheme = chosen.url.Scheme
+	req.URL.Host = chosen.url.Host
+	req.Host = ""
+	return chosen.url.Host, func() { atomic.AddInt64(&chosen.inFlight, -1) }
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+// message is a websocket message read by a cancelWatch
+type message struct {
+	data []byte
+	err  error
+}
+
+// cancelWatch listens for the cancel control message of the Server while a request is executed.
+// It starts reading once the request body has been consumed, as the websocket has a single reader,
+// or right away for a chunked body which it reads itself, and hands the next message over to the serve loop.
+type cancelWatch struct {
+	ws     *websocket.Conn
+	cancel context.CancelFunc
+
+	started  bool
+	stopped  bool
+	canceled bool
+	next     chan message
+	lock     sync.Mutex
+}
+
+// newCancelWatch creates a new cancelWatch calling cancel when the Server cancels the request
+func newCancelWatch(ws *websocket.Conn, cancel context.CancelFunc) (watch *cancelWatch) {
+	watch = new(cancelWatch)
+	watch.ws = ws
+	watch.cancel = cancel
+	watch.next = make(chan message, 1)
+	return
+}
+
+// start reads the websocket until a message other than a cancel is received, unless the watch is stopped
+func (watch *cancelWatch) start() {
+	watch.lock.Lock()
+	defer watch.lock.Unlock()
+
+	if watch.started || watch.stopped {
+		return
+	}
+	watch.started = true
+	go watch.read(nil)
+}
+
+// startChunked reads the chunks of the request body into the body writer, then the websocket
+// until a message other than a cancel is received
+func (watch *cancelWatch) startChunked(body *io.PipeWriter) {
+	watch.lock.Lock()
+	defer watch.lock.Unlock()
+
+	watch.started = true
+	go watch.read(body)
+}
+
+// read reads the chunks of the request body into the body writer if not nil and handles the cancel messages
+// until another message is received, which is handed over to the serve loop
+func (watch *cancelWatch) read(body *io.PipeWriter) {
+	for {
+		messageType, data, err := watch.ws.ReadMessage()
+		if err != nil {
+			if body != nil {
+				body.CloseWithError(err)
+			}
+			watch.next <- message{data, err}
+			return
+		}
+
+		if msg, ok := wsp.ParseControlMessage(data); ok && messageType == websocket.TextMessage && msg.Type == wsp.ControlCancel {
+			// A cancel received once the request is done is stale
+			watch.lock.Lock()
+			if !watch.stopped {
+				watch.canceled = true
+				watch.cancel()
+			}
+			watch.lock.Unlock()
+			if body != nil {
+				body.CloseWithError(context.Canceled)
+			}
+			continue
+		}
+
+		if body != nil && messageType == websocket.BinaryMessage {
+			if len(data) == 0 {
+				// End of the request body
+				body.Close()
+				body = nil
+				continue
+			}
+			// The chunks are dropped once the upstream stopped reading the body
+			body.Write(data)
+			continue
+		}
+
+		watch.next <- message{data, err}
+		return
+	}
+}
+
+// stop ends the watch once the request is done, it returns true if a message is being read
+// and must be received from next rather than from the websocket
+func (watch *cancelWatch) stop() bool {
+	watch.lock.Lock()
+	defer watch.lock.Unlock()
+
+	watch.stopped = true
+	return watch.started
+}
+
+// isCanceled returns true if the Server canceled the request
+func (watch *cancelWatch) isCanceled() bool {
+	watch.lock.Lock()
+	defer watch.lock.Unlock()
+
+	return watch.canceled
+}
+
+// eofReader calls onEOF once the reader is exhausted
+type eofReader struct {
+	reader io.Reader
+	onEOF  func()
+}
+
+// Read reads from the underlying reader
+func (reader *eofReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	if err == io.EOF {
+		reader.onEOF()
+	}
+	return
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -15,15 +16,32 @@ type Client struct {
 	client *http.Client
 	dialer *websocket.Dialer
 	pools  map[string]*Pool
+
+	// Slots of the connections being established ( nil if unlimited )
+	connectSlots chan struct{}
+
+	// Upstream instances the requests to the base URL are distributed to ( nil if none )
+	backends *backends
 }
 
 // NewClient creates a new Client.
 func NewClient(config *Config) (c *Client) {
 	c = new(Client)
 	c.Config = config
-	c.client = &http.Client{}
-	c.dialer = &websocket.Dialer{}
+	c.client = &http.Client{Transport: config.Transport}
+	if c.client.Transport == nil {
+		c.client.Transport = newUpstreamTransport(config)
+	}
+	c.dialer = &websocket.Dialer{EnableCompression: config.EnableCompression}
 	c.pools = make(map[string]*Pool)
+	if config.ConnectConcurrency > 0 {
+		c.connectSlots = make(chan struct{}, config.ConnectConcurrency)
+	}
+	backends, err := newBackends(config)
+	if err != nil {
+		log.Printf("Ignoring backends : %s", err)
+	}
+	c.backends = backends
 	return
 }
 
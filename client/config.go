@@ -1,10 +1,15 @@
 package client
 
 import (
+	"fmt"
+	"net/http"
 	"os"
+	"time"
 
 	uuid "github.com/nu7hatch/gouuid"
 	"gopkg.in/yaml.v2"
+
+	"github.com/root-gg/wsp"
 )
 
 // Config configures an Proxy
@@ -14,6 +19,87 @@ type Config struct {
 	PoolIdleSize int
 	PoolMaxSize  int
 	SecretKey    string
+
+	// Connections the server accepts into the pool of this client at most, whatever the client opens
+	// or re-registers (0 means unlimited). It is not sent with protocol version 1.
+	PoolMaxConnections int
+
+	// Protocol version of the greeting, 1 sends the legacy greeting to servers older than the JSON greeting
+	ProtocolVersion int
+
+	// Version advertised to the server to roll out upgrades, the build version if empty
+	Version string
+
+	// Request the permessage-deflate compression of the websocket messages,
+	// the connections are uncompressed if the server doesn't accept it
+	EnableCompression bool
+
+	// Maximum number of connections being established at the same time across all targets
+	// so that the connections ramp up without overwhelming the servers (0 means unlimited)
+	ConnectConcurrency int
+
+	// IDs of other WSP clients the WSP server can move this client connections to
+	EligiblePools []string
+
+	// Base URL of the upstream of this client, callers can then send only the path of the destination
+	BaseURL string
+
+	// Relative capacity of this client, the Server sends proportionally more requests to clients with a higher weight
+	// ( 0 to advertise none, servers older than the weight support reject the greeting of clients with a weight )
+	Weight int
+
+	// Upstream instances behind BaseURL ( scheme://host:port ), the requests to BaseURL are distributed
+	// across them with the round-robin or least-conn BackendStrategy
+	Backends        []string
+	BackendStrategy string
+
+	// Labels describing this client ( e.g. tenant or region ) the WSP server can add to its metrics
+	Labels map[string]string
+
+	// Retry policy of the GET, HEAD and OPTIONS upstream requests without a body : number of retries,
+	// base backoff increased linearly at each retry (milliseconds) and the status codes to retry
+	UpstreamRetries          int
+	UpstreamRetryBackoff     int
+	UpstreamRetryStatusCodes []int
+	// Also retry the PUT and DELETE requests without a body, the upstream must apply them idempotently
+	UpstreamRetryIdempotentWrites bool
+
+	// Keep the number of idle connections suggested by the Server if it is higher than PoolIdleSize
+	FollowIdleHints bool
+
+	// Idle keep-alive connections kept per upstream host by the default transport (0 means PoolMaxSize)
+	// and time before closing them (milliseconds)
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleConnTimeout     int
+
+	// Time to connect to an upstream and to wait for its response headers (milliseconds, 0 for no limit),
+	// the Server might request a lower upstream timeout. Both are ignored by a custom Transport.
+	UpstreamConnectTimeout int
+	UpstreamTimeout        int
+
+	// Transport used to reach the upstreams, to customize connection pooling, timeouts, proxy or TLS.
+	// It defaults to a transport keeping up to UpstreamMaxIdleConnsPerHost idle connections per upstream.
+	Transport http.RoundTripper `yaml:"-"`
+}
+
+// GetUpstreamRetryBackoff returns the time.Duration converted to millisecond
+func (c Config) GetUpstreamRetryBackoff() time.Duration {
+	return time.Duration(c.UpstreamRetryBackoff) * time.Millisecond
+}
+
+// GetUpstreamConnectTimeout returns the time.Duration converted to millisecond
+func (c Config) GetUpstreamConnectTimeout() time.Duration {
+	return time.Duration(c.UpstreamConnectTimeout) * time.Millisecond
+}
+
+// GetUpstreamTimeout returns the time.Duration converted to millisecond
+func (c Config) GetUpstreamTimeout() time.Duration {
+	return time.Duration(c.UpstreamTimeout) * time.Millisecond
+}
+
+// GetUpstreamIdleConnTimeout returns the time.Duration converted to millisecond
+func (c Config) GetUpstreamIdleConnTimeout() time.Duration {
+	return time.Duration(c.UpstreamIdleConnTimeout) * time.Millisecond
 }
 
 // NewConfig creates a new ProxyConfig
@@ -28,11 +114,25 @@ func NewConfig() (config *Config) {
 
 	config.Targets = []string{"ws://127.0.0.1:8080/register"}
 	config.PoolIdleSize = 10
+	config.ProtocolVersion = wsp.MaxProtocolVersion
 	config.PoolMaxSize = 100
+	config.ConnectConcurrency = 4
+	config.UpstreamIdleConnTimeout = 90000
+	config.UpstreamConnectTimeout = 30000
+	config.UpstreamRetryBackoff = 100
+	config.UpstreamRetryStatusCodes = []int{502, 503, 504}
 
 	return
 }
 
+// GetVersion returns the version advertised to the server
+func (c Config) GetVersion() string {
+	if c.Version != "" {
+		return c.Version
+	}
+	return wsp.Version
+}
+
 // LoadConfiguration loads configuration from a YAML file
 func LoadConfiguration(path string) (config *Config, err error) {
 	config = NewConfig()
@@ -47,5 +147,15 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		return
 	}
 
+	if _, err = newBackends(config); err != nil {
+		return
+	}
+
+	if config.ProtocolVersion < wsp.MinProtocolVersion || config.ProtocolVersion > wsp.MaxProtocolVersion {
+		err = fmt.Errorf("unsupported protocol version %d, supported versions are %d to %d",
+			config.ProtocolVersion, wsp.MinProtocolVersion, wsp.MaxProtocolVersion)
+		return
+	}
+
 	return
 }
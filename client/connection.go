@@ -3,10 +3,13 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -36,30 +39,74 @@ func NewConnection(pool *Pool) *Connection {
 	return c
 }
 
+// formatLabels formats the labels as the sorted comma separated key=value list of the LabelsHeader
+func formatLabels(labels map[string]string) string {
+	list := make([]string, 0, len(labels))
+	for key, value := range labels {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
 // Connect to the IsolatorServer using a HTTP websocket
 func (connection *Connection) Connect(ctx context.Context) (err error) {
 	log.Printf("Connecting to %s", connection.pool.target)
 
 	// Create a new TCP(/TLS) connection ( no use of net.http )
-	connection.ws, _, err = connection.pool.client.dialer.DialContext(
+	header := http.Header{"X-SECRET-KEY": {connection.pool.secretKey}}
+	if len(connection.pool.client.Config.EligiblePools) > 0 {
+		header.Set(wsp.EligiblePoolsHeader, strings.Join(connection.pool.client.Config.EligiblePools, ","))
+	}
+	if connection.pool.client.Config.BaseURL != "" {
+		header.Set(wsp.BaseURLHeader, connection.pool.client.Config.BaseURL)
+	}
+	if len(connection.pool.client.Config.Labels) > 0 {
+		header.Set(wsp.LabelsHeader, formatLabels(connection.pool.client.Config.Labels))
+	}
+
+	ws, resp, err := connection.pool.client.dialer.DialContext(
 		ctx,
 		connection.pool.target,
-		http.Header{"X-SECRET-KEY": {connection.pool.secretKey}},
+		header,
 	)
 
 	if err != nil {
 		return err
 	}
 
+	// Pool.Shutdown closes the connections under the pool lock, it might have run during the dial
+	connection.pool.lock.Lock()
+	select {
+	case <-connection.pool.done:
+		connection.pool.lock.Unlock()
+		ws.Close()
+		return errors.New("pool is shut down")
+	default:
+	}
+	connection.ws = ws
+	connection.pool.lock.Unlock()
+
 	log.Printf("Connected to %s", connection.pool.target)
 
+	// Answer the challenge if the Server sent one
+	if challenge := resp.Header.Get(wsp.ChallengeHeader); challenge != "" {
+		response := wsp.ChallengeResponse(connection.pool.secretKey, challenge)
+		if err := connection.ws.WriteMessage(websocket.TextMessage, []byte(response)); err != nil {
+			log.Println("challenge error :", err)
+			connection.Close()
+			return err
+		}
+	}
+
 	// Send the greeting message with proxy id and wanted pool size.
-	greeting := fmt.Sprintf(
-		"%s_%d",
-		connection.pool.client.Config.ID,
-		connection.pool.client.Config.PoolIdleSize,
-	)
-	if err := connection.ws.WriteMessage(websocket.TextMessage, []byte(greeting)); err != nil {
+	greeting, err := connection.greeting()
+	if err != nil {
+		log.Println("greeting error :", err)
+		connection.Close()
+		return err
+	}
+	if err := connection.ws.WriteMessage(websocket.TextMessage, greeting); err != nil {
 		log.Println("greeting error :", err)
 		connection.Close()
 		return err
@@ -91,16 +138,41 @@ func (connection *Connection) serve(ctx context.Context) {
 		}
 	}()
 
+	// Watches the cancellation of the current request
+	var watch *cancelWatch
+
 	for {
-		// Read request
-		connection.status = IDLE
-		_, jsonRequest, err := connection.ws.ReadMessage()
+		// Read request, the watch of the previous request might already be reading it
+		connection.setStatus(IDLE)
+		var jsonRequest []byte
+		var err error
+		if watch != nil && watch.stop() {
+			msg := <-watch.next
+			jsonRequest, err = msg.data, msg.err
+		} else {
+			_, jsonRequest, err = connection.ws.ReadMessage()
+		}
+		watch = nil
 		if err != nil {
-			log.Println("Unable to read request", err)
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == wsp.CloseInvalidGreeting {
+				log.Printf("Handshake rejected by server, check the configuration : %s", closeErr.Text)
+			} else if ok && closeErr.Code == wsp.CloseLimitExceeded {
+				log.Printf("Connection rejected by server : %s", closeErr.Text)
+			} else if ok {
+				log.Printf("Connection closed by server : %d %s", closeErr.Code, closeErr.Text)
+			} else {
+				log.Println("Unable to read request", err)
+			}
 			break
 		}
 
-		connection.status = RUNNING
+		// Control messages are sent by the Server to idle connections only
+		if msg, ok := wsp.ParseControlMessage(jsonRequest); ok {
+			connection.pool.handleControlMessage(ctx, msg)
+			continue
+		}
+
+		connection.setStatus(RUNNING)
 
 		// Trigger a pool refresh to open new connections if needed
 		go connection.pool.connector(ctx)
@@ -121,18 +193,64 @@ func (connection *Connection) serve(ctx context.Context) {
 
 		log.Printf("[%s] %s", req.Method, req.URL.String())
 
-		// Pipe request body
-		_, bodyReader, err := connection.ws.NextReader()
-		if err != nil {
-			log.Printf("Unable to get response body reader : %v", err)
-			break
+		removeHopByHopHeaders(req.Header)
+
+		// The Server cancels the request when its caller goes away,
+		// its cancel message can only be read once the request body has been read
+		// or between the chunks of a chunked body
+		ctx, cancelRequest := context.WithCancel(context.Background())
+		watch = newCancelWatch(connection.ws, cancelRequest)
+		if httpRequest.ChunkedBody {
+			body, bodyWriter := io.Pipe()
+			req.Body = body
+			watch.startChunked(bodyWriter)
+		} else {
+			// Pipe request body
+			_, bodyReader, err := connection.ws.NextReader()
+			if err != nil {
+				cancelRequest()
+				log.Printf("Unable to get response body reader : %v", err)
+				break
+			}
+			if req.ContentLength == 0 {
+				io.Copy(io.Discard, bodyReader)
+				req.Body = http.NoBody
+				watch.start()
+			} else {
+				req.Body = io.NopCloser(&eofReader{reader: bodyReader, onEOF: watch.start})
+			}
+		}
+
+		// Never forward an ambiguous request to the upstream
+		if err := validateFraming(req); err != nil {
+			cancelRequest()
+			req.Body.Close()
+			err = connection.errorStatus(http.StatusBadRequest, fmt.Sprintf("Invalid request framing : %s\n", err))
+			if err != nil {
+				break
+			}
+			continue
 		}
-		req.Body = io.NopCloser(bodyReader)
 
 		// Execute request
-		resp, err := connection.pool.client.client.Do(req)
+		backend, release := connection.pool.client.backends.route(req)
+		timeout := connection.pool.client.upstreamTimeout(httpRequest.UpstreamTimeout)
+		resp, cancel, err := connection.pool.client.doUpstream(ctx, req, timeout)
+		done := func() {
+			cancel()
+			cancelRequest()
+			// Unblock the reader of a chunked body the upstream did not read entirely
+			req.Body.Close()
+			release()
+		}
 		if err != nil {
-			err = connection.error(fmt.Sprintf("Unable to execute request : %v\n", err))
+			done()
+			if errors.Is(err, errUpstreamTimeout) {
+				// The Server answers a clean 504 rather than a proxy error
+				err = connection.errorStatus(wsp.UpstreamTimeoutStatus, fmt.Sprintf("Unable to execute request : %v\n", err))
+			} else {
+				err = connection.error(fmt.Sprintf("Unable to execute request : %v\n", err))
+			}
 			if err != nil {
 				break
 			}
@@ -140,8 +258,13 @@ func (connection *Connection) serve(ctx context.Context) {
 		}
 
 		// Serialize response
-		jsonResponse, err := json.Marshal(wsp.SerializeHTTPResponse(resp))
+		httpResponse := wsp.SerializeHTTPResponse(resp)
+		httpResponse.Backend = backend
+		httpResponse.Trailers = httpRequest.Trailers
+		jsonResponse, err := json.Marshal(httpResponse)
 		if err != nil {
+			resp.Body.Close()
+			done()
 			err = connection.error(fmt.Sprintf("Unable to serialize response : %v\n", err))
 			if err != nil {
 				break
@@ -152,6 +275,8 @@ func (connection *Connection) serve(ctx context.Context) {
 		// Write response
 		err = connection.ws.WriteMessage(websocket.TextMessage, jsonResponse)
 		if err != nil {
+			resp.Body.Close()
+			done()
 			log.Printf("Unable to write response : %v", err)
 			break
 		}
@@ -159,21 +284,66 @@ func (connection *Connection) serve(ctx context.Context) {
 		// Pipe response body
 		bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
 		if err != nil {
+			resp.Body.Close()
+			done()
 			log.Printf("Unable to get response body writer : %v", err)
 			break
 		}
 		_, err = io.Copy(bodyWriter, resp.Body)
+		// The body must be fully read and closed for the upstream connection to be reused
+		resp.Body.Close()
+		done()
+		if err != nil && watch.isCanceled() {
+			// The Server does not need the rest of the body, the connection stays usable
+			log.Printf("Request canceled by server : %v", err)
+			if err = bodyWriter.Close(); err != nil {
+				break
+			}
+			// The Server still expects the trailers, the ones of an interrupted body are incomplete
+			if httpResponse.Trailers && connection.writeTrailer(nil) != nil {
+				break
+			}
+			continue
+		}
 		if err != nil {
 			log.Printf("Unable to get pipe response body : %v", err)
 			break
 		}
 		bodyWriter.Close()
+
+		// The trailers are only known once the body has been read
+		if httpResponse.Trailers {
+			if err := connection.writeTrailer(resp.Trailer); err != nil {
+				break
+			}
+		}
 	}
 }
 
+// writeTrailer sends the trailers of the upstream response to the Server after the response body
+func (connection *Connection) writeTrailer(trailer http.Header) (err error) {
+	if trailer == nil {
+		trailer = make(http.Header)
+	}
+	jsonTrailer, err := json.Marshal(trailer)
+	if err != nil {
+		log.Printf("Unable to serialize response trailer : %v", err)
+		return
+	}
+	if err = connection.ws.WriteMessage(websocket.TextMessage, jsonTrailer); err != nil {
+		log.Printf("Unable to write response trailer : %v", err)
+	}
+	return
+}
+
 func (connection *Connection) error(msg string) (err error) {
+	return connection.errorStatus(527, msg)
+}
+
+// errorStatus sends a response with the given status code and the message as body to the Server
+func (connection *Connection) errorStatus(status int, msg string) (err error) {
 	resp := wsp.NewHTTPResponse()
-	resp.StatusCode = 527
+	resp.StatusCode = status
 
 	log.Println(msg)
 
@@ -209,5 +379,15 @@ func (connection *Connection) Close() {
 	defer connection.pool.lock.Unlock()
 
 	connection.pool.remove(connection)
-	connection.ws.Close()
+	if connection.ws != nil {
+		connection.ws.Close()
+	}
+}
+
+// setStatus sets the status of the connection, it is read by Pool.Size under the pool lock
+func (connection *Connection) setStatus(status int) {
+	connection.pool.lock.Lock()
+	defer connection.pool.lock.Unlock()
+
+	connection.status = status
 }
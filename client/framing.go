@@ -0,0 +1,28 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// validateFraming rejects the requests sent by the Server whose body length could be understood differently
+// by the upstream : the Server sends the length in ContentLength and never forwards a Transfer-Encoding
+func validateFraming(req *http.Request) error {
+	if len(req.Header.Values("Transfer-Encoding")) > 0 {
+		return fmt.Errorf("unexpected Transfer-Encoding header")
+	}
+
+	contentLengths := req.Header.Values("Content-Length")
+	if len(contentLengths) > 1 {
+		return fmt.Errorf("multiple Content-Length headers")
+	}
+	if len(contentLengths) == 1 {
+		// ParseInt would accept a sign the upstream might not
+		length, err := strconv.ParseUint(contentLengths[0], 10, 63)
+		if err != nil || int64(length) != req.ContentLength {
+			return fmt.Errorf("Content-Length %q does not match the body length %d", contentLengths[0], req.ContentLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateFraming(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		contentLength    []string
+		transferEncoding []string
+		valid            bool
+	}{
+		{name: "no body", valid: true},
+		{name: "matching content length", body: "hello", contentLength: []string{"5"}, valid: true},
+		{name: "body without content length", body: "hello", valid: true},
+		{name: "mismatching content length", body: "hello", contentLength: []string{"6"}},
+		{name: "multiple content lengths", body: "hello", contentLength: []string{"5", "5"}},
+		{name: "invalid content length", body: "hello", contentLength: []string{"+5"}},
+		{name: "transfer encoding", body: "hello", transferEncoding: []string{"chunked"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://upstream/", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header["Content-Length"] = test.contentLength
+			req.Header["Transfer-Encoding"] = test.transferEncoding
+
+			err = validateFraming(req)
+			if test.valid && err != nil {
+				t.Errorf("got error %q for a valid request", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("got no error for an ambiguous request")
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/root-gg/wsp"
+)
+
+// greeting returns the greeting message with the client id, wanted pool size and weight.
+// Protocol version 1 sends the legacy underscore delimited greeting understood by older servers.
+func (connection *Connection) greeting() ([]byte, error) {
+	config := connection.pool.client.Config
+	if config.ProtocolVersion == 1 {
+		greeting := fmt.Sprintf("%s_%d", config.ID, config.PoolIdleSize)
+		if config.Weight > 0 {
+			greeting += fmt.Sprintf(":%d", config.Weight)
+		}
+		return []byte(greeting), nil
+	}
+
+	return json.Marshal(wsp.GreetingMessage{
+		ProtocolVersion: config.ProtocolVersion,
+		ID:              config.ID,
+		Size:            config.PoolIdleSize,
+		Weight:          config.Weight,
+		Version:         config.GetVersion(),
+		MaxConnections:  config.PoolMaxConnections,
+	})
+}
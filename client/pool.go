@@ -6,6 +6,8 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/root-gg/wsp"
 )
 
 // Pool manage a pool of connection to a remote Server
@@ -17,6 +19,13 @@ type Pool struct {
 	connections []*Connection
 	lock        sync.RWMutex
 
+	// Latest pool state reported by the Server
+	serverStats *wsp.PoolStats
+	// Latest number of idle connections suggested by the Server
+	idleHint int
+	// Number of connections the Server asked to open, until the next connector run
+	openRequested int
+
 	done chan struct{}
 }
 
@@ -58,16 +67,31 @@ func (pool *Pool) connector(ctx context.Context) {
 	poolSize := pool.Size()
 
 	// Create enough connection to fill the pool
-	toCreate := pool.client.Config.PoolIdleSize - poolSize.idle
+	idleSize := pool.client.Config.PoolIdleSize
+	if pool.client.Config.FollowIdleHints && pool.idleHint > idleSize {
+		idleSize = pool.idleHint
+	}
+	// Connections waiting for a connect slot will be idle soon
+	toCreate := idleSize - poolSize.idle - poolSize.connecting
+
+	// The server asked for more connections as it runs low on idle ones
+	if pool.openRequested > toCreate {
+		toCreate = pool.openRequested
+	}
+	pool.openRequested = 0
 
 	// Create only one connection if the pool is empty
 	if poolSize.total == 0 {
 		toCreate = 1
 	}
 
-	// Ensure to open at most PoolMaxSize connections
-	if poolSize.total+toCreate > pool.client.Config.PoolMaxSize {
-		toCreate = pool.client.Config.PoolMaxSize - poolSize.total
+	// Ensure to open at most PoolMaxSize connections, the server refuses the ones beyond PoolMaxConnections
+	maxSize := pool.client.Config.PoolMaxSize
+	if max := pool.client.Config.PoolMaxConnections; max > 0 && max < maxSize {
+		maxSize = max
+	}
+	if poolSize.total+toCreate > maxSize {
+		toCreate = maxSize - poolSize.total
 	}
 
 	// Try to reach ideal pool size
@@ -76,7 +100,14 @@ func (pool *Pool) connector(ctx context.Context) {
 		pool.connections = append(pool.connections, conn)
 
 		go func() {
+			if !pool.acquireConnectSlot(ctx) {
+				pool.lock.Lock()
+				defer pool.lock.Unlock()
+				pool.remove(conn)
+				return
+			}
 			err := conn.Connect(ctx)
+			pool.releaseConnectSlot()
 			if err != nil {
 				log.Printf("Unable to connect to %s : %s", pool.target, err)
 
@@ -88,6 +119,30 @@ func (pool *Pool) connector(ctx context.Context) {
 	}
 }
 
+// acquireConnectSlot waits until a connection can be established according to Config.ConnectConcurrency.
+// It returns false if the pool is shut down meanwhile.
+func (pool *Pool) acquireConnectSlot(ctx context.Context) bool {
+	if pool.client.connectSlots == nil {
+		return true
+	}
+
+	select {
+	case pool.client.connectSlots <- struct{}{}:
+		return true
+	case <-pool.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseConnectSlot frees the slot taken by acquireConnectSlot
+func (pool *Pool) releaseConnectSlot() {
+	if pool.client.connectSlots != nil {
+		<-pool.client.connectSlots
+	}
+}
+
 // Add a connection to the pool
 func (pool *Pool) add(conn *Connection) {
 	pool.connections = append(pool.connections, conn)
@@ -110,11 +165,55 @@ func (pool *Pool) remove(conn *Connection) {
 // Shutdown close all connection in the pool
 func (pool *Pool) Shutdown() {
 	close(pool.done)
-	for _, conn := range pool.connections {
+
+	// Close removes the connection from the pool under the pool lock
+	pool.lock.RLock()
+	connections := make([]*Connection, len(pool.connections))
+	copy(connections, pool.connections)
+	pool.lock.RUnlock()
+
+	for _, conn := range connections {
 		conn.Close()
 	}
 }
 
+// handleControlMessage processes a control message received from the Server.
+// Unknown message types are ignored to stay compatible with newer servers.
+func (pool *Pool) handleControlMessage(ctx context.Context, msg *wsp.ControlMessage) {
+	switch msg.Type {
+	case wsp.ControlPoolStats:
+		if msg.PoolStats == nil {
+			return
+		}
+		pool.lock.Lock()
+		pool.serverStats = msg.PoolStats
+		pool.lock.Unlock()
+	case wsp.ControlIdleHint:
+		if msg.IdleHint == nil {
+			return
+		}
+		pool.lock.Lock()
+		pool.idleHint = msg.IdleHint.TargetIdle
+		pool.lock.Unlock()
+	case wsp.ControlOpenConnections:
+		if msg.OpenConnections == nil || msg.OpenConnections.Count <= 0 {
+			return
+		}
+		pool.lock.Lock()
+		pool.openRequested = msg.OpenConnections.Count
+		pool.lock.Unlock()
+		go pool.connector(ctx)
+	}
+}
+
+// ServerStats returns the latest pool state reported by the Server or nil if none has been received yet
+func (pool *Pool) ServerStats() *wsp.PoolStats {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.serverStats
+}
+
 // PoolSize represent the number of open connections per status
 type PoolSize struct {
 	connecting int
@@ -128,6 +227,7 @@ func (poolSize *PoolSize) String() string {
 }
 
 // Size return the current state of the pool
+// This MUST be surrounded by pool.lock.Lock()
 func (pool *Pool) Size() (poolSize *PoolSize) {
 	poolSize = new(PoolSize)
 	poolSize.total = len(pool.connections)
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// isRetryable returns true if the request can be sent again to the upstream.
+// The request body is streamed from the websocket and can't be replayed, so only requests without a body are retried.
+// A retried request may have been applied by the upstream already, so only idempotent methods are retried :
+// GET, HEAD and OPTIONS, and PUT and DELETE if Config.UpstreamRetryIdempotentWrites is set.
+func (c *Client) isRetryable(req *http.Request) bool {
+	if req.ContentLength != 0 {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return c.Config.UpstreamRetryIdempotentWrites
+	}
+	return false
+}
+
+// do executes the request against the upstream and retries it
+// on transport errors and retryable status codes according to the Config retry policy.
+func (c *Client) do(req *http.Request) (resp *http.Response, err error) {
+	retries := c.Config.UpstreamRetries
+	if !c.isRetryable(req) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			req.Body = http.NoBody
+		}
+
+		resp, err = c.client.Do(req)
+		if attempt >= retries {
+			return
+		}
+		if err == nil && !c.isRetryableStatus(resp.StatusCode) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Retrying request to %s after error : %s", req.URL.String(), err)
+		} else {
+			log.Printf("Retrying request to %s after status %d", req.URL.String(), resp.StatusCode)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(c.Config.GetUpstreamRetryBackoff() * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// isRetryableStatus returns true if the upstream status code is in Config.UpstreamRetryStatusCodes
+func (c *Client) isRetryableStatus(status int) bool {
+	for _, code := range c.Config.UpstreamRetryStatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryIdempotentRequestsOnly(t *testing.T) {
+	tests := []struct {
+		method                string
+		retryIdempotentWrites bool
+		attempts              int32
+	}{
+		{method: http.MethodGet, attempts: 3},
+		{method: http.MethodHead, attempts: 3},
+		{method: http.MethodPost, attempts: 1},
+		{method: http.MethodPatch, attempts: 1},
+		{method: http.MethodPut, attempts: 1},
+		{method: http.MethodPut, retryIdempotentWrites: true, attempts: 3},
+		{method: http.MethodDelete, retryIdempotentWrites: true, attempts: 3},
+		{method: http.MethodPost, retryIdempotentWrites: true, attempts: 1},
+	}
+	for _, test := range tests {
+		var attempts int32
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		config := NewConfig()
+		config.UpstreamRetries = 2
+		config.UpstreamRetryBackoff = 0
+		config.UpstreamRetryIdempotentWrites = test.retryIdempotentWrites
+		c := NewClient(config)
+
+		req, err := http.NewRequest(test.method, upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			t.Fatalf("%s : unable to send request : %s", test.method, err)
+		}
+		resp.Body.Close()
+		upstream.Close()
+
+		if got := atomic.LoadInt32(&attempts); got != test.attempts {
+			t.Errorf("%s ( retry idempotent writes %t ) : got %d attempts, want %d", test.method, test.retryIdempotentWrites, got, test.attempts)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errUpstreamTimeout is returned by doUpstream when the upstream did not answer in time
+var errUpstreamTimeout = errors.New("upstream timeout")
+
+// upstreamTimeout returns the time to wait for the upstream response, the lowest of Config.UpstreamTimeout
+// and the timeout requested by the Server ( milliseconds, 0 for no limit )
+func (c *Client) upstreamTimeout(requested int64) time.Duration {
+	timeout := c.Config.GetUpstreamTimeout()
+	if requested > 0 && (timeout == 0 || time.Duration(requested)*time.Millisecond < timeout) {
+		timeout = time.Duration(requested) * time.Millisecond
+	}
+	return timeout
+}
+
+// doUpstream executes the request until ctx is canceled and gives up if the upstream response headers are not received
+// within timeout ( 0 for no limit ). The returned function must be called once the response body has been read.
+func (c *Client) doUpstream(ctx context.Context, req *http.Request, timeout time.Duration) (resp *http.Response, done func(), err error) {
+	if timeout <= 0 {
+		resp, err = c.do(req.WithContext(ctx))
+		return resp, func() {}, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+
+	resp, err = c.do(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		err = fmt.Errorf("%w after %s : %v", errUpstreamTimeout, timeout, err)
+	}
+	return resp, cancel, err
+}
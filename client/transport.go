@@ -0,0 +1,54 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newUpstreamTransport returns the transport used to reach the upstreams when Config.Transport is not set.
+// Unlike http.DefaultTransport it keeps enough idle connections per upstream to serve PoolMaxSize
+// concurrent requests without reconnecting.
+func newUpstreamTransport(config *Config) *http.Transport {
+	maxIdleConnsPerHost := config.UpstreamMaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = config.PoolMaxSize
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.GetUpstreamConnectTimeout(),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       config.GetUpstreamIdleConnTimeout(),
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// hopByHopHeaders are meaningful for a single connection and must not be forwarded to the upstream.
+// A caller sending "Connection: close" to the WSP server must not prevent the upstream connection reuse.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers of the caller connection from the request
+func removeHopByHopHeaders(header http.Header) {
+	// Headers listed in Connection are hop-by-hop too
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,29 @@
+module github.com/root-gg/wsp/cmd/wsp_server
+
+go 1.21
+
+require (
+	github.com/prometheus/client_golang v1.20.5
+	github.com/root-gg/wsp v0.0.0-00010101000000-000000000000
+	github.com/root-gg/wsp/server/prommetrics v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
+
+replace (
+	github.com/root-gg/wsp => ../..
+	github.com/root-gg/wsp/server/prommetrics => ../../server/prommetrics
+)
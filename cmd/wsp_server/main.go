@@ -7,7 +7,11 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/root-gg/wsp/server"
+	"github.com/root-gg/wsp/server/prommetrics"
 )
 
 func main() {
@@ -21,6 +25,16 @@ func main() {
 	}
 
 	server := server.NewServer(config)
+	if config.EnableMetrics {
+		registry := prometheus.NewRegistry()
+		metrics, err := prommetrics.NewMetricsWithDefinitions(registry, config.MetricDefinitions())
+		if err != nil {
+			log.Fatalf("Unable to create metrics : %s", err)
+		}
+		registry.MustRegister(prommetrics.NewCollector(server))
+		server.SetMetrics(metrics)
+		server.SetMetricsHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	}
 	server.Start()
 
 	// Wait signals
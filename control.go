@@ -0,0 +1,71 @@
+package wsp
+
+import (
+	"encoding/json"
+)
+
+// Control message types
+const (
+	// ControlPoolStats reports the state of the pool from the Server point of view
+	ControlPoolStats = "pool_stats"
+	// ControlIdleHint suggests the number of idle connections the Client should keep open
+	ControlIdleHint = "idle_hint"
+	// ControlCancel asks the Client to abort the request in progress on the connection as its caller went away.
+	// It is the only control message sent to a busy connection, once the request body has been sent.
+	ControlCancel = "cancel"
+	// ControlOpenConnections asks the Client to open connections as its pool runs low on idle ones
+	ControlOpenConnections = "open_connections"
+)
+
+// ControlMessage is a message sent by the Server to an idle Client connection
+// outside of the HTTP request/response flow.
+//
+// Type identifies the message and only the matching payload field is set,
+// so new message types can be added without breaking older peers which
+// must ignore the types they don't know about.
+type ControlMessage struct {
+	Type string
+
+	PoolStats       *PoolStats       `json:",omitempty"`
+	IdleHint        *IdleHint        `json:",omitempty"`
+	OpenConnections *OpenConnections `json:",omitempty"`
+}
+
+// PoolStats is the state of a pool reported by the Server to let the Client autoscale its connections
+type PoolStats struct {
+	Idle        int
+	Busy        int
+	RequestRate float64 // requests per second since the previous report
+}
+
+// IdleHint is the number of idle connections the Server expects the Client to need soon,
+// the Client is free to honor or to ignore it
+type IdleHint struct {
+	TargetIdle int
+}
+
+// OpenConnections is the number of connections the Server asks the Client to open on top of its idle ones,
+// the Server never asks for more than the pool size and the Client still opens at most its PoolMaxSize
+type OpenConnections struct {
+	Count int
+}
+
+// NewControlMessage creates a new ControlMessage
+func NewControlMessage(messageType string) (msg *ControlMessage) {
+	msg = new(ControlMessage)
+	msg.Type = messageType
+	return
+}
+
+// ParseControlMessage returns the ControlMessage and true if the data is a control message.
+// HTTP requests serialized as HTTPRequest have no Type field so they are never mistaken for a control message.
+func ParseControlMessage(data []byte) (msg *ControlMessage, ok bool) {
+	msg = new(ControlMessage)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, false
+	}
+	if msg.Type == "" {
+		return nil, false
+	}
+	return msg, true
+}
@@ -0,0 +1,33 @@
+package wsp
+
+// EligiblePoolsHeader is the register request header listing, comma separated,
+// the other pools a Client connection can be migrated to by the Server
+const EligiblePoolsHeader = "X-PROXY-ELIGIBLE-POOLS"
+
+// LabelsHeader is the register request header listing, comma separated, the key=value labels
+// describing a Client ( e.g. tenant or region ) which the Server can add to its metrics
+const LabelsHeader = "X-PROXY-LABELS"
+
+// Close codes sent by the Server when it rejects a handshake ( 4000-4999 are available to applications ).
+// A Client receiving one of them must fix its configuration, retrying the same handshake is pointless.
+const (
+	// CloseInvalidGreeting means the greeting message could not be parsed
+	CloseInvalidGreeting = 4000
+	// CloseLimitExceeded means the Server has reached its maximum number of pools or connections per pool
+	CloseLimitExceeded = 4001
+)
+
+// BaseURLHeader is the register request header advertising the base URL of the upstream of a Client,
+// callers can then send only the path of the destination
+const BaseURLHeader = "X-PROXY-BASE-URL"
+
+// GreetingMessage is the first message sent by a Client on a new connection, marshaled as JSON.
+// Protocol version 1 clients send "<id>_<size>[:<weight>]" instead, which the Server still accepts.
+type GreetingMessage struct {
+	ProtocolVersion int
+	ID              string
+	Size            int    // Number of idle connections the Client keeps
+	Weight          int    `json:",omitempty"` // Relative capacity of the Client, 0 if none
+	Version         string `json:",omitempty"` // Software version of the Client, used to roll out upgrades
+	MaxConnections  int    `json:",omitempty"` // Connections the Server accepts into the pool at most, 0 if unlimited
+}
@@ -13,6 +13,18 @@ type HTTPRequest struct {
 	URL           string
 	Header        map[string][]string
 	ContentLength int64
+
+	// Maximum time for the WSP client to wait for the upstream response (milliseconds, 0 for its own default)
+	UpstreamTimeout int64 `json:",omitempty"`
+
+	// The body follows as binary messages of at most the chunk size ended by an empty binary message
+	// rather than as a single binary message. Text messages between the chunks are control messages
+	// ( a cancel ) so they are never stuck behind a large upload. Only sent to protocol version 3 clients.
+	ChunkedBody bool `json:",omitempty"`
+
+	// The Server relays the trailers of the upstream response ( see HTTPResponse.Trailers ).
+	// Only sent to protocol version 4 clients.
+	Trailers bool `json:",omitempty"`
 }
 
 // SerializeHTTPRequest create a new HTTPRequest from a http.Request
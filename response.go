@@ -6,11 +6,22 @@ import (
 	"net/http"
 )
 
+// UpstreamTimeoutStatus is the status code of the responses of a WSP client whose upstream
+// did not answer in time, the Server answers them with a 504 Gateway Timeout
+const UpstreamTimeoutStatus = 528
+
 // HTTPResponse is a serializable version of http.Response ( with only useful fields )
 type HTTPResponse struct {
 	StatusCode    int
 	Header        http.Header
 	ContentLength int64
+
+	// Upstream instance which served the request when the Client distributes them across several
+	Backend string `json:",omitempty"`
+
+	// The body is followed by a text message holding the trailers of the upstream response as a JSON
+	// http.Header ( empty if it has none ), only set when the request asked for them
+	Trailers bool `json:",omitempty"`
 }
 
 // SerializeHTTPResponse create a new HTTPResponse from a http.Response
@@ -31,8 +42,18 @@ func NewHTTPResponse() (r *HTTPResponse) {
 
 // ProxyError log error and return a HTTP 526 error with the message
 func ProxyError(w http.ResponseWriter, err error) {
+	ProxyErrorStatus(w, 526, err)
+}
+
+// ProxyErrorStatus log error and return a HTTP error with the given status code and the message
+func ProxyErrorStatus(w http.ResponseWriter, status int, err error) {
 	log.Println(err)
-	http.Error(w, err.Error(), 526)
+	http.Error(w, err.Error(), status)
+}
+
+// ProxyErrorStatusf log error and return a HTTP error with the given status code and the message
+func ProxyErrorStatusf(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	ProxyErrorStatus(w, status, fmt.Errorf(format, args...))
 }
 
 // ProxyErrorf log error and return a HTTP 526 error with the message
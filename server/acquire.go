@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errConnectionClosed is returned by NextReader when the connection is closed while waiting for a message
+var errConnectionClosed = errors.New("connection closed")
+
+// AcquireConnection dispatches an idle connection for custom relaying over the pooled websockets.
+// The dispatch gives up after Config.Timeout or the context deadline, whichever comes first.
+//
+// The connection is taken until the returned release function is called, the caller must call it
+// exactly once and must not use the connection afterwards. The peer must speak the custom protocol,
+// the wsp Client only understands proxied HTTP requests. A broken connection must be closed
+// with Close before being released.
+func (s *Server) AcquireConnection(ctx context.Context) (connection *Connection, release func(), err error) {
+	timeout := s.Config.GetTimeout()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	connection, err = s.dispatch(timeout, 0, "", "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	release = func() { once.Do(connection.Release) }
+	return connection, release, nil
+}
+
+// Pool returns the id of the pool the connection belongs to
+func (connection *Connection) Pool() PoolID {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.pool.id
+}
+
+// WriteMessage sends a message to the peer of an acquired connection
+func (connection *Connection) WriteMessage(messageType int, data []byte) error {
+	return connection.ws.WriteMessage(messageType, data)
+}
+
+// NextReader waits for the next message of the peer of an acquired connection.
+// The returned function must be called once the message has been read to receive the next one.
+func (connection *Connection) NextReader() (reader io.Reader, done func(), err error) {
+	// The read() goroutine owns the websocket reader, ask it for the next message
+	// the same way proxyRequest does
+	channel := make(chan io.Reader)
+	reader = connection.nextReader(channel)
+	if reader == nil {
+		return nil, nil, errConnectionClosed
+	}
+
+	var once sync.Once
+	return reader, func() { once.Do(func() { close(channel) }) }, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// recordActivity counts a request completed through the pool and the response body bytes relayed
+func (pool *Pool) recordActivity(success bool, bytesRelayed int64) {
+	if !success {
+		atomic.AddInt64(&pool.errors, 1)
+	}
+	atomic.AddInt64(&pool.bytesRelayed, bytesRelayed)
+	atomic.StoreInt64(&pool.lastActivity, time.Now().UnixNano())
+}
+
+// LastActivity returns the time of the last request completed through the pool, the registration time until then
+func (pool *Pool) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&pool.lastActivity))
+}
+
+// inactiveFor returns for how long the pool has not completed any request
+// if it exceeds Config.InactivePoolTimeout, 0 otherwise
+func (s *Server) inactiveFor(pool *Pool, now time.Time) time.Duration {
+	timeout := s.Config.GetInactivePoolTimeout()
+	if timeout <= 0 {
+		return 0
+	}
+	if inactive := now.Sub(pool.LastActivity()); inactive > timeout {
+		return inactive
+	}
+	return 0
+}
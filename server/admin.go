@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// AdminTokenHeader is the request header carrying Config.AdminToken
+const AdminTokenHeader = "X-ADMIN-TOKEN"
+
+// admin protects an admin endpoint with Config.AdminToken.
+// The admin API is disabled when no token is configured.
+func (s *Server) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Config.AdminToken == "" {
+			wsp.ProxyErrorStatusf(w, http.StatusForbidden, "Admin API is disabled")
+			return
+		}
+		token := r.Header.Get(AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) != 1 {
+			wsp.ProxyErrorStatusf(w, http.StatusUnauthorized, "Invalid %s", AdminTokenHeader)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// statusAuth protects an endpoint exposing the topology with Config.StatusAuthToken,
+// sent as a bearer token or as the password of a basic authentication. The endpoint is public without token.
+func (s *Server) statusAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Config.StatusAuthToken == "" {
+			handler(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, _ = r.BasicAuth()
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.StatusAuthToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wsp"`)
+			wsp.ProxyErrorStatusf(w, http.StatusUnauthorized, "Invalid status token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeJSON writes the value as a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// adminConfig returns the effective configuration with its credentials redacted
+func (s *Server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, s.Config.Redacted())
+}
+
+// adminRequests lists the in-flight requests ( GET ) or cancels one of them by id ( DELETE ?id= )
+func (s *Server) adminRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.InFlightRequests())
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !s.CancelRequest(id) {
+			wsp.ProxyErrorStatusf(w, http.StatusNotFound, "No in-flight request %q", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// adminTimeouts overrides the proxy and dispatch timeouts of a pool
+// ( POST ?pool=&proxy=&dispatch= with Go durations, 0 to remove an override )
+func (s *Server) adminTimeouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	if !query.Has("proxy") && !query.Has("dispatch") {
+		wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Missing proxy or dispatch timeout")
+		return
+	}
+	timeouts := make(map[string]time.Duration)
+	for _, name := range []string{"proxy", "dispatch"} {
+		if !query.Has(name) {
+			continue
+		}
+		timeout, err := time.ParseDuration(query.Get(name))
+		if err != nil || timeout < 0 {
+			wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Invalid %s timeout %q", name, query.Get(name))
+			return
+		}
+		timeouts[name] = timeout
+	}
+
+	pool := s.getPool(PoolID(query.Get("pool")))
+	if pool == nil {
+		wsp.ProxyErrorStatusf(w, http.StatusNotFound, "No pool %q", query.Get("pool"))
+		return
+	}
+
+	if timeout, ok := timeouts["proxy"]; ok {
+		pool.SetProxyTimeout(timeout)
+	}
+	if timeout, ok := timeouts["dispatch"]; ok {
+		pool.SetDispatchTimeout(timeout)
+	}
+	writeJSON(w, pool.Status())
+}
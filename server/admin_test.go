@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminTimeouts(t *testing.T) {
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+	id := s.Pools()[0].ID
+
+	tests := []struct {
+		query    string
+		status   int
+		proxy    time.Duration
+		dispatch time.Duration
+	}{
+		{query: "pool=" + string(id) + "&proxy=5s", status: http.StatusOK, proxy: 5 * time.Second},
+		{query: "pool=" + string(id) + "&dispatch=50ms", status: http.StatusOK, proxy: 5 * time.Second, dispatch: 50 * time.Millisecond},
+		{query: "pool=" + string(id) + "&proxy=0", status: http.StatusOK, dispatch: 50 * time.Millisecond},
+		{query: "pool=" + string(id), status: http.StatusBadRequest, dispatch: 50 * time.Millisecond},
+		{query: "pool=" + string(id) + "&proxy=-1s", status: http.StatusBadRequest, dispatch: 50 * time.Millisecond},
+		{query: "pool=" + string(id) + "&dispatch=soon", status: http.StatusBadRequest, dispatch: 50 * time.Millisecond},
+		{query: "pool=unknown&proxy=1s", status: http.StatusNotFound, dispatch: 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.adminTimeouts(w, httptest.NewRequest(http.MethodPost, "/admin/timeouts?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s : got status %d, want %d", test.query, w.Code, test.status)
+		}
+
+		pool := s.getPool(id)
+		if timeout := pool.GetProxyTimeout(); timeout != test.proxy {
+			t.Errorf("%s : got proxy timeout %s, want %s", test.query, timeout, test.proxy)
+		}
+		if timeout := pool.GetDispatchTimeout(); timeout != test.dispatch {
+			t.Errorf("%s : got dispatch timeout %s, want %s", test.query, timeout, test.dispatch)
+		}
+	}
+
+	// The requests addressed to the pool give up waiting for a connection after its dispatch timeout
+	setStatus(s.getPool(id), Busy)
+	r := httptest.NewRequest(http.MethodGet, "/request", nil)
+	r.Header.Set("X-PROXY-DESTINATION", "http://upstream/")
+	r.Header.Set(PoolHeader, string(id))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	s.Request(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed >= s.Config.GetTimeout() {
+		t.Errorf("the request waited %s, want the dispatch timeout of the pool", elapsed)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+// Connection affinity routes the requests to a destination host through the connection of the pool
+// which last served it, so the client can reuse its keep-alive connection to the upstream.
+// The dispatcher still chooses the pool, affinity only swaps the connection within this pool.
+
+// preferAffinity returns an idle connection of the pool which last served the host in place of the taken connection,
+// which is then offered again. It returns the taken connection if affinity is disabled or no such connection is idle.
+func (s *Server) preferAffinity(connection *Connection, pool *Pool, host string) *Connection {
+	if !s.Config.ConnectionAffinity || host == "" {
+		return connection
+	}
+	if connection.servedHost(host) {
+		s.metrics.IncCounter(MetricAffinityHits, s.poolLabels(pool))
+		return connection
+	}
+
+	var preferred *Connection
+	pool.lock.RLock()
+	for _, c := range pool.connections {
+		if c != connection && c.takeIfServed(pool, host) {
+			preferred = c
+			break
+		}
+	}
+	pool.lock.RUnlock()
+
+	if preferred == nil {
+		s.metrics.IncCounter(MetricAffinityMisses, s.poolLabels(pool))
+		return connection
+	}
+
+	// The pending offer of the preferred connection has been withdrawn when taking it
+	connection.offerAgain()
+	s.metrics.IncCounter(MetricAffinityHits, s.poolLabels(pool))
+	return preferred
+}
+
+// servedHost returns true if the last request proxied through the connection was to the host
+func (connection *Connection) servedHost(host string) bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.lastHost == host
+}
+
+// takeIfServed takes the connection if it is idle in the pool and the last request it proxied was to the host
+func (connection *Connection) takeIfServed(pool *Pool, host string) bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.pool != pool || connection.status != Idle || connection.lastHost != host {
+		return false
+	}
+	connection.status = Busy
+	connection.takes++
+	connection.withdrawOffer()
+	return true
+}
+
+// offerAgain gives back a connection taken but not used, unlike Release it keeps the time it is idle since
+func (connection *Connection) offerAgain() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.status != Busy {
+		return
+	}
+	connection.status = Idle
+	connection.offer()
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/root-gg/wsp"
+)
+
+// Authenticator validates the register requests of the WSP clients.
+// Implementations must be safe for concurrent use.
+type Authenticator interface {
+	// Authenticate returns an error if the request is not allowed to register, otherwise the pool
+	// its connection joins ( e.g. derived from the authenticated identity ), empty for the ID of the client greeting
+	Authenticate(r *http.Request) (PoolID, error)
+}
+
+// errInvalidSecretKey is returned when the X-SECRET-KEY header matches none of the secret keys
+var errInvalidSecretKey = errors.New("Invalid X-SECRET-KEY")
+
+// defaultSecretKeyID names the SecretKey among the accepted secret keys
+const defaultSecretKeyID = "default"
+
+// SecretKeyAuthenticator is the default Authenticator, it accepts the requests carrying the shared secret
+// or one of the named secret keys in the X-SECRET-KEY header and leaves the pool to the client greeting
+type SecretKeyAuthenticator struct {
+	SecretKey string
+	// Named secret keys also accepted, so that the clients can move to a new key while the old one is still valid.
+	// With named keys only, an empty SecretKey is not accepted.
+	SecretKeys map[string]string
+}
+
+// Authenticate returns an error if the X-SECRET-KEY header is none of the secret keys
+func (authenticator SecretKeyAuthenticator) Authenticate(r *http.Request) (PoolID, error) {
+	if _, ok := authenticator.Match(r.Header.Get("X-SECRET-KEY")); !ok {
+		return "", errInvalidSecretKey
+	}
+	return "", nil
+}
+
+// Match returns the name of the secret key equal to key, "default" for the SecretKey.
+// Every key is compared in constant time so that the time taken does not tell which key is close to the one presented.
+func (authenticator SecretKeyAuthenticator) Match(key string) (id string, ok bool) {
+	for name, secret := range authenticator.keys() {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1 && !ok {
+			id, ok = name, true
+		}
+	}
+	return
+}
+
+// keys returns the accepted secret keys by name
+func (authenticator SecretKeyAuthenticator) keys() map[string]string {
+	keys := make(map[string]string, len(authenticator.SecretKeys)+1)
+	for name, key := range authenticator.SecretKeys {
+		keys[name] = key
+	}
+	if authenticator.SecretKey != "" || len(authenticator.SecretKeys) == 0 {
+		keys[defaultSecretKeyID] = authenticator.SecretKey
+	}
+	return keys
+}
+
+// secretKeyAuthenticator returns the SecretKeyAuthenticator of Config.SecretKey and Config.SecretKeys
+func (s *Server) secretKeyAuthenticator() SecretKeyAuthenticator {
+	return SecretKeyAuthenticator{SecretKey: s.Config.SecretKey, SecretKeys: s.Config.SecretKeys}
+}
+
+// verifyChallengeResponse returns true if the response to the challenge is signed with one of the secret keys,
+// all of them are checked so that the time taken does not tell which one matched
+func (s *Server) verifyChallengeResponse(challenge string, response string) bool {
+	valid := false
+	for _, key := range s.secretKeyAuthenticator().keys() {
+		if wsp.VerifyChallengeResponse(key, challenge, response) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// SetAuthenticator sets the Authenticator of the register requests, nil restores the Config.SecretKey check.
+// It must be called before Start.
+func (s *Server) SetAuthenticator(authenticator Authenticator) {
+	s.authenticator = authenticator
+}
+
+// authenticate validates the register request with the Authenticator, or against Config.SecretKey
+// and Config.SecretKeys if none is set. The name of the key used is logged to follow a rotation.
+func (s *Server) authenticate(r *http.Request) (PoolID, error) {
+	if s.authenticator == nil {
+		id, ok := s.secretKeyAuthenticator().Match(r.Header.Get("X-SECRET-KEY"))
+		if !ok {
+			return "", errInvalidSecretKey
+		}
+		if len(s.Config.SecretKeys) > 0 {
+			s.logger.Info("Register request authenticated", "key_id", id, "source_ip", sourceIP(r))
+		}
+		return "", nil
+	}
+	return s.authenticator.Authenticate(r)
+}
+
+// authFailed records a register request rejected by the Authenticator.
+// Only a short hash of the presented X-SECRET-KEY is logged so the logs never leak a key close to the secret.
+func (s *Server) authFailed(r *http.Request, err error) {
+	s.metrics.IncCounter(MetricAuthFailures, nil)
+	ip := sourceIP(r)
+	if s.Config.LogAuthFailures {
+		hash := keyHash(r.Header.Get("X-SECRET-KEY"))
+		s.logEvent(Event{Event: EventAuthFailure, SourceIP: ip, KeyHash: hash, Error: err.Error()}, "Authentication failure")
+	}
+
+	if s.bans != nil && s.bans.fail(ip) {
+		s.metrics.IncCounter(MetricAuthBans, nil)
+		s.logger.Warn("Banning source IP after repeated authentication failures", "source_ip", ip, "duration", s.Config.GetAuthFailureBanDuration(), "failures", s.Config.AuthFailureBanThreshold)
+	}
+}
+
+// keyHash returns the 8 first hex digits of the SHA-256 of the key, or "none" for an empty key
+func keyHash(key string) string {
+	if key == "" {
+		return "none"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:8]
+}
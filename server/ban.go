@@ -0,0 +1,177 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// BannedIP is a source IP banned after repeated authentication failures
+type BannedIP struct {
+	IP       string
+	Failures int
+	Until    time.Time
+}
+
+// authFailures are the recent authentication failures of a source IP
+type authFailures struct {
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// expired returns true if the failures are out of the window and the IP is not banned anymore
+func (failures *authFailures) expired(now time.Time, window time.Duration) bool {
+	return now.Sub(failures.windowStart) >= window && !now.Before(failures.bannedUntil)
+}
+
+// ipBans is the bounded set of the source IPs having recently failed to authenticate
+type ipBans struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	max       int
+	ips       map[string]*authFailures
+	lock      sync.Mutex
+}
+
+// newIPBans creates a new ipBans banning the IPs for duration after threshold failures within window,
+// it tracks at most max IPs
+func newIPBans(threshold int, window time.Duration, duration time.Duration, max int) (bans *ipBans) {
+	bans = new(ipBans)
+	bans.threshold = threshold
+	bans.window = window
+	bans.duration = duration
+	bans.max = max
+	bans.ips = make(map[string]*authFailures)
+	return
+}
+
+// banned returns true if the IP is banned
+func (bans *ipBans) banned(ip string) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	failures, ok := bans.ips[ip]
+	return ok && time.Now().Before(failures.bannedUntil)
+}
+
+// fail records an authentication failure of the IP, it returns true if the IP just got banned
+func (bans *ipBans) fail(ip string) (banned bool) {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	now := time.Now()
+	failures, ok := bans.ips[ip]
+	if !ok {
+		if !bans.makeRoom(now) {
+			return false
+		}
+		failures = new(authFailures)
+		bans.ips[ip] = failures
+	}
+
+	// Count again from zero after the window or once a ban is over
+	ended := !failures.bannedUntil.IsZero() && !now.Before(failures.bannedUntil)
+	if now.Sub(failures.windowStart) >= bans.window || ended {
+		failures.count = 0
+		failures.windowStart = now
+		failures.bannedUntil = time.Time{}
+	}
+	failures.count++
+
+	if failures.count >= bans.threshold && failures.bannedUntil.IsZero() {
+		failures.bannedUntil = now.Add(bans.duration)
+		return true
+	}
+	return false
+}
+
+// makeRoom evicts the expired IPs, then an IP which is not banned if there are still max of them.
+// It returns false if every tracked IP is banned.
+// This MUST be surrounded by bans.lock.Lock()
+func (bans *ipBans) makeRoom(now time.Time) bool {
+	if bans.max <= 0 || len(bans.ips) < bans.max {
+		return true
+	}
+
+	for ip, failures := range bans.ips {
+		if failures.expired(now, bans.window) {
+			delete(bans.ips, ip)
+		}
+	}
+	if len(bans.ips) < bans.max {
+		return true
+	}
+
+	for ip, failures := range bans.ips {
+		if !now.Before(failures.bannedUntil) {
+			delete(bans.ips, ip)
+			return true
+		}
+	}
+	return false
+}
+
+// unban lifts the ban of the IP and forgets its failures, it returns false if the IP is unknown
+func (bans *ipBans) unban(ip string) bool {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	if _, ok := bans.ips[ip]; !ok {
+		return false
+	}
+	delete(bans.ips, ip)
+	return true
+}
+
+// list returns the banned IPs sorted by IP
+func (bans *ipBans) list() (banned []BannedIP) {
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+
+	now := time.Now()
+	banned = make([]BannedIP, 0)
+	for ip, failures := range bans.ips {
+		if now.Before(failures.bannedUntil) {
+			banned = append(banned, BannedIP{IP: ip, Failures: failures.count, Until: failures.bannedUntil})
+		}
+	}
+	sort.Slice(banned, func(i, j int) bool { return banned[i].IP < banned[j].IP })
+	return
+}
+
+// isBanned returns true if the source IP is banned after repeated authentication failures
+func (s *Server) isBanned(ip string) bool {
+	return s.bans != nil && s.bans.banned(ip)
+}
+
+// BannedIPs returns the source IPs currently banned after repeated authentication failures
+func (s *Server) BannedIPs() []BannedIP {
+	if s.bans == nil {
+		return []BannedIP{}
+	}
+	return s.bans.list()
+}
+
+// adminBans lists the banned source IPs ( GET ) or lifts the ban of one ( DELETE ?ip= )
+func (s *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if s.bans == nil || !s.bans.unban(ip) {
+			wsp.ProxyErrorStatusf(w, http.StatusNotFound, "Unknown source IP %q", ip)
+			return
+		}
+		s.logger.Info("Ban lifted", "source_ip", ip)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, s.BannedIPs())
+}
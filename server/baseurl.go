@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+)
+
+// PathHeader is the request header holding the destination path to append to the base URL of a pool,
+// used instead of X-PROXY-DESTINATION
+const PathHeader = "X-PROXY-PATH"
+
+// ServiceHeader is the request header choosing, with PathHeader, the pools having this value as ServiceLabel
+const ServiceHeader = "X-PROXY-SERVICE"
+
+// ServiceLabel is the client label matched by ServiceHeader
+const ServiceLabel = "service"
+
+// baseURLFilter returns the filter of the pools advertising a base URL, having the service label if not empty
+func baseURLFilter(service string) func(pool *Pool) bool {
+	return func(pool *Pool) bool {
+		if pool.BaseURL() == nil {
+			return false
+		}
+		return service == "" || pool.Labels()[ServiceLabel] == service
+	}
+}
+
+// BaseURL returns the base URL of the upstream advertised by the client or nil
+func (pool *Pool) BaseURL() *url.URL {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.baseURL
+}
+
+// setBaseURL updates the base URL of the upstream advertised by the client
+func (pool *Pool) setBaseURL(baseURL *url.URL) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.baseURL = baseURL
+}
+
+// destination returns the URL of the path below the base URL of the pool
+func (pool *Pool) destination(path *url.URL) *url.URL {
+	destination := *pool.BaseURL()
+	destination.Path = strings.TrimSuffix(destination.Path, "/") + "/" + strings.TrimPrefix(path.Path, "/")
+	destination.RawPath = ""
+	destination.RawQuery = path.RawQuery
+	return &destination
+}
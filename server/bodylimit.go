@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+// errRequestBodyTooLarge is returned by the reads of a request body exceeding Config.MaxRequestBodyBytes
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// errRequestBodyCanceled is returned by proxyRequest when the request body exceeded Config.MaxRequestBodyBytes
+// while it was sent in chunks, the peer has been asked to cancel and the connection has been released
+var errRequestBodyCanceled = errors.New("request body too large, canceled")
+
+// bodyLimiter fails the reads of a request body of unknown length beyond its limit,
+// so that it is never relayed entirely to the peer nor buffered
+type bodyLimiter struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+// newBodyLimiter wraps the body to fail with errRequestBodyTooLarge after max bytes
+func newBodyLimiter(body io.ReadCloser, max int64) *bodyLimiter {
+	return &bodyLimiter{body: body, remaining: max}
+}
+
+// Read reads from the body until more than the limit has been read
+func (limiter *bodyLimiter) Read(p []byte) (n int, err error) {
+	if limiter.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	// Read one more byte to tell a body of exactly the limit from a larger one
+	if int64(len(p)) > limiter.remaining+1 {
+		p = p[:limiter.remaining+1]
+	}
+	n, err = limiter.body.Read(p)
+	if int64(n) > limiter.remaining {
+		n = int(limiter.remaining)
+		limiter.remaining = -1
+		return n, errRequestBodyTooLarge
+	}
+	limiter.remaining -= int64(n)
+	return n, err
+}
+
+// Close closes the body
+func (limiter *bodyLimiter) Close() error {
+	return limiter.body.Close()
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// callerIdentity returns the identity of the caller of a request : the value of Config.CallerHeader
+// when the request comes from one of the Config.TrustedProxies, the source IP otherwise.
+// Any other caller could pick a new header value for each request to escape Config.MaxRequestsPerCaller.
+func (s *Server) callerIdentity(r *http.Request) string {
+	ip := sourceIP(r)
+	if s.Config.CallerHeader != "" && s.isTrustedProxy(ip) {
+		if caller := r.Header.Get(s.Config.CallerHeader); caller != "" {
+			return caller
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy returns true if the source IP belongs to one of the Config.TrustedProxies
+func (s *Server) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses the IPs and CIDR ranges of Config.TrustedProxies
+func parseTrustedProxies(proxies []string) (networks []*net.IPNet, err error) {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q : %s", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// acquireCaller reserves an in-flight request for the caller.
+// It returns false if the caller already reached Config.MaxRequestsPerCaller.
+func (s *Server) acquireCaller(caller string) bool {
+	s.callersLock.Lock()
+	defer s.callersLock.Unlock()
+
+	limit := s.Config.MaxRequestsPerCaller
+	if limit > 0 && s.callers[caller] >= limit {
+		return false
+	}
+	s.callers[caller]++
+	return true
+}
+
+// releaseCaller releases an in-flight request reserved by acquireCaller
+func (s *Server) releaseCaller(caller string) {
+	s.callersLock.Lock()
+	defer s.callersLock.Unlock()
+
+	s.callers[caller]--
+	if s.callers[caller] <= 0 {
+		delete(s.callers, caller)
+	}
+}
+
+// callersInFlight returns the number of in-flight requests of each caller.
+// The callers are identified by a hash of their identity which may be a token or an IP.
+func (s *Server) callersInFlight() (callers map[string]int) {
+	s.callersLock.Lock()
+	defer s.callersLock.Unlock()
+
+	if len(s.callers) == 0 {
+		return nil
+	}
+	callers = make(map[string]int, len(s.callers))
+	for caller, count := range s.callers {
+		callers[keyHash(caller)] += count
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCallerIdentity(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		remoteAddr     string
+		header         string
+		caller         string
+	}{
+		{name: "no trusted proxy", remoteAddr: "10.0.0.1:1234", header: "alice", caller: "10.0.0.1"},
+		{name: "trusted proxy ip", trustedProxies: []string{"10.0.0.1"}, remoteAddr: "10.0.0.1:1234", header: "alice", caller: "alice"},
+		{name: "trusted proxy range", trustedProxies: []string{"10.0.0.0/8"}, remoteAddr: "10.1.2.3:1234", header: "alice", caller: "alice"},
+		{name: "untrusted source", trustedProxies: []string{"10.0.0.0/8"}, remoteAddr: "192.168.0.1:1234", header: "alice", caller: "192.168.0.1"},
+		{name: "trusted proxy without header", trustedProxies: []string{"10.0.0.1"}, remoteAddr: "10.0.0.1:1234", caller: "10.0.0.1"},
+		{name: "trusted ipv6 proxy", trustedProxies: []string{"::1"}, remoteAddr: "[::1]:1234", header: "alice", caller: "alice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			config.CallerHeader = "X-Caller-Id"
+			config.TrustedProxies = test.trustedProxies
+			s := NewServer(config)
+
+			r := httptest.NewRequest(http.MethodGet, "/request", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.header != "" {
+				r.Header.Set("X-Caller-Id", test.header)
+			}
+			if got := s.callerIdentity(r); got != test.caller {
+				t.Errorf("got caller %q, want %q", got, test.caller)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		err     bool
+	}{
+		{name: "ips and ranges", proxies: []string{"10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"}},
+		{name: "invalid ip", proxies: []string{"10.0.0"}, err: true},
+		{name: "invalid range", proxies: []string{"10.0.0.0/33"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			networks, err := parseTrustedProxies(test.proxies)
+			if test.err {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(networks) != len(test.proxies) {
+				t.Errorf("got %d networks, want %d", len(networks), len(test.proxies))
+			}
+		})
+	}
+}
+
+func TestCallersInFlightHidesIdentities(t *testing.T) {
+	s := NewServer(NewConfig())
+	s.acquireCaller("secret-token")
+	s.acquireCaller("secret-token")
+
+	callers := s.callersInFlight()
+	if _, ok := callers["secret-token"]; ok {
+		t.Fatal("the caller identity is exposed in the status")
+	}
+	if got := callers[keyHash("secret-token")]; got != 2 {
+		t.Errorf("got %d in-flight requests for the caller, want 2", got)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+// errCallerGone is returned by proxyRequest when the request body could not be read from the caller
+// but the peer has been asked to cancel and has answered, the connection has been released
+var errCallerGone = errors.New("caller went away")
+
+// sendCancel asks the peer to abort the request of the take in progress as its caller went away.
+// It returns false if the request can't be canceled yet, the relay of its body fails instead,
+// or if the connection has been released since.
+// The connection lock is held during the write so that the connection can't be released and taken meanwhile,
+// this ensures the cancel never reaches the peer after the next request.
+func (connection *Connection) sendCancel(take uint64) bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if !connection.servesTake(take) || !connection.cancelable {
+		return false
+	}
+	if connection.cancelSent {
+		return true
+	}
+
+	jsonMsg, err := json.Marshal(wsp.NewControlMessage(wsp.ControlCancel))
+	if err != nil {
+		connection.pool.server.logger.Error("Unable to serialize control message", "error", err)
+		return false
+	}
+
+	connection.writeLock.Lock()
+	defer connection.writeLock.Unlock()
+
+	connection.ws.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	defer connection.ws.SetWriteDeadline(time.Time{})
+
+	if err := connection.ws.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
+		connection.pool.server.logger.Warn("Unable to write cancel", "pool_id", connection.pool.id, "error", err)
+		connection.close(websocket.CloseNormalClosure, "")
+		return false
+	}
+
+	connection.cancelSent = true
+	return true
+}
+
+// setCancelable records that the peer can be asked to cancel the request in progress
+func (connection *Connection) setCancelable() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	connection.cancelable = true
+}
+
+// isCancelSent returns true if the peer has been asked to cancel the request in progress
+func (connection *Connection) isCancelSent() bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.cancelSent
+}
+
+// writeChunkedBody sends the request body as binary messages of at most chunkSize bytes ended by an empty one.
+// A cancel can be sent between the chunks, the body is then cut short. If the body can't be read
+// from the caller the peer is asked to cancel and aborted is the read error ( errCallerGone for a cancel
+// sent between the chunks ), the response must still be read.
+func (connection *Connection) writeChunkedBody(body io.Reader, chunkSize int) (aborted error, err error) {
+	connection.setCancelable()
+	take := connection.currentTake()
+
+	chunk := make([]byte, chunkSize)
+	for !connection.isCancelSent() {
+		n, readErr := body.Read(chunk)
+		if n > 0 {
+			connection.writeLock.Lock()
+			connection.setWriteDeadline()
+			err = connection.ws.WriteMessage(websocket.BinaryMessage, chunk[:n])
+			connection.writeLock.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("unable to write request body chunk : %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if !connection.sendCancel(take) {
+				return nil, fmt.Errorf("unable to read request body : %w", readErr)
+			}
+			aborted = readErr
+			break
+		}
+	}
+	if aborted == nil && connection.isCancelSent() {
+		aborted = errCallerGone
+	}
+
+	connection.writeLock.Lock()
+	defer connection.writeLock.Unlock()
+	connection.setWriteDeadline()
+	if err := connection.ws.WriteMessage(websocket.BinaryMessage, nil); err != nil {
+		return nil, fmt.Errorf("unable to write request body end : %w", err)
+	}
+	return aborted, nil
+}
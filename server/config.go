@@ -1,8 +1,10 @@
 package server
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -15,6 +17,285 @@ type Config struct {
 	Timeout     int
 	IdleTimeout int
 	SecretKey   string
+
+	// Address ( host:port ) of a separate listener serving only /register and /status, e.g. on a private interface
+	// so that only trusted clients can connect while /request stays public. Empty serves /register on Host:Port.
+	RegisterAddr string
+
+	// Named secret keys accepted besides SecretKey, so that a key can be rotated without restarting every client :
+	// add the new key, move the clients to it then remove the old one. The name of the key used is logged.
+	SecretKeys map[string]string
+
+	// Time the WSP client has to answer a request canceled by its caller before its connection is closed (milliseconds)
+	CancelTimeout int
+
+	// Request bodies are sent to protocol version 3 WSP clients in chunks of at most this size (bytes)
+	// so that a cancel can reach them during a large upload, 0 sends every body as a single message
+	RequestBodyChunkSize int
+
+	// Time to wait for the pong of an idle connection pinged after IdleTimeout before closing it (milliseconds, 0 to disable)
+	PingTimeout int
+
+	// Idle connections are pinged at this interval rather than after IdleTimeout (milliseconds, 0 to ping after IdleTimeout),
+	// it is also the pace at which the pools are checked for connections without pong
+	PingInterval int
+
+	// Time the WSP clients wait for the upstream response (milliseconds, 0 for their own default),
+	// a slow upstream is answered with a 504 even if the dispatch was immediate
+	UpstreamTimeout int
+
+	// Time a relay waits for the peer to read ( WriteTimeout ) or to send ( ReadTimeout ) the next data of a request,
+	// the connection is then thrown away (milliseconds, 0 means unlimited). Unlike Timeout it does not bound
+	// the wait for a connection, ReadTimeout includes the time the upstream takes to answer.
+	WriteTimeout int
+	ReadTimeout  int
+
+	// Certificate and key files to serve https and wss ( plain http if unset )
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Timeout overrides per HTTP method matched case-insensitively (milliseconds), Timeout applies to the unlisted methods
+	MethodTimeouts map[string]int
+
+	// Maximum time to wait for a connection requested by a caller with the X-PROXY-TIMEOUT header
+	// (milliseconds, 0 ignores the header)
+	MaxDispatchTimeout int
+
+	// Callers left without a connection get a 503 with a Retry-After of this base, stretched up to twice
+	// as long as the share of busy connections grows (milliseconds, 0 answers a 502 or 504 without it)
+	RetryAfterBase int
+
+	// Version reported by /version instead of the one set at build time
+	Version string
+
+	// Time a pool must stay without connection before being removed (milliseconds),
+	// so that clients reconnecting don't make their pool flip between removed and created
+	EmptyPoolGracePeriod int
+
+	// Time after which a pool having connections but not completing any request is removed and its connections
+	// closed, so that the client opens fresh ones (milliseconds, 0 keeps the pools however long they are inactive)
+	InactivePoolTimeout int
+
+	// Time a pool being removed or the server shutting down waits for the requests in flight,
+	// idle connections are closed right away and busy ones once released (milliseconds, 0 closes them all right away)
+	PoolShutdownTimeout int
+
+	// Number of pools with idle connections required for /health to report the server ready
+	MinReadyPools int
+
+	// Accept the permessage-deflate compression of the websocket messages when the clients request it,
+	// connections of clients not requesting it or when disabled are uncompressed
+	EnableCompression bool
+
+	// TCP options of the accepted connections, socket buffer sizes in bytes (0 to keep the system default)
+	TCPNoDelay          bool
+	SocketSendBuffer    int
+	SocketReceiveBuffer int
+
+	// Token required in the X-ADMIN-TOKEN header of the /admin endpoints ( the admin API is disabled if empty )
+	AdminToken string
+
+	// Token required to read /status, /pools and /metrics as a bearer token or as the password
+	// of a basic authentication ( they are public if empty )
+	StatusAuthToken string
+
+	// Require clients to sign a random nonce with the secret key within ChallengeTimeout (milliseconds)
+	RequireChallenge bool
+	ChallengeTimeout int
+
+	// Maximum time for the whole register handshake, upgrade, challenge and greeting (milliseconds, 0 means unlimited)
+	RegisterHandshakeTimeout int
+
+	// Header holding the priority of a request ( an integer, higher first, 0 by default, disabled if empty )
+	// and priorities of the pools by id ( 0 by default )
+	RequestPriorityHeader string
+	PoolPriorities        map[string]int
+
+	// Dispatch strategy used to choose a pool ( random, success-rate, ordered )
+	Strategy string
+	// Keep the pools sorted by id for a stable /status output and ordered selection
+	SortPools bool
+	// Prefer the healthier connections of the chosen pool and retire the connections failing
+	// MaxConnectionFailures consecutive requests (0 never retires them)
+	PreferHealthyConnections bool
+	MaxConnectionFailures    int
+	// Prefer the connection of the chosen pool which last served the destination host to reuse its upstream connection
+	ConnectionAffinity bool
+	// Header holding the session key of a request, the requests with the same key are dispatched to the same pool
+	// while it has an idle connection ( disabled if empty )
+	SessionKeyHeader string
+	// Time for the weight of a request outcome to halve in the success rate (milliseconds)
+	SuccessRateHalfLife int
+
+	// Backoff of the dispatcher after MaxTakeFailures consecutive connections could not be taken
+	// (milliseconds, 0 MaxTakeFailures to never back off)
+	MaxTakeFailures    int
+	TakeFailureBackoff int
+
+	// Long-lived requests are the ones flagged as streaming by the caller
+	// or running for more than LongLivedThreshold (milliseconds)
+	LongLivedThreshold          int
+	MaxLongLivedRequests        int
+	MaxLongLivedRequestsPerPool int
+
+	// Send the GET, HEAD and OPTIONS requests without a body again through another connection up to MaxStatusRetries
+	// times when the response status is in RetryStatusCodes, the retried responses are not written to the caller.
+	// RetryIdempotentWrites retries the PUT and DELETE requests too, the upstream must handle them idempotently.
+	MaxStatusRetries      int
+	RetryStatusCodes      []int
+	RetryIdempotentWrites bool
+
+	// Maximum size of the serialized HTTP response headers sent by the peer (bytes, 0 means unlimited)
+	MaxResponseHeaderBytes int
+
+	// Maximum size of the request bodies, larger ones are answered with a 413 (bytes, 0 means unlimited)
+	MaxRequestBodyBytes int
+
+	// Maximum number of in-flight requests of a single caller (0 means unlimited), callers are identified
+	// by the CallerHeader request header ( set by an authenticating front proxy ) or by their source IP.
+	// The header is only trusted from the TrustedProxies source IPs or CIDR ranges.
+	MaxRequestsPerCaller int
+	CallerHeader         string
+	TrustedProxies       []string
+
+	// Warn when a pool declaring a size of at least DiversityCheckSize has connections
+	// from less than MinSourceIPs distinct source IPs (0 DiversityCheckSize to disable the check)
+	DiversityCheckSize int
+	MinSourceIPs       int
+
+	// Dispatch wait SLO : DispatchWaitSLOTarget percent of the dispatches over DispatchWaitSLOWindow (milliseconds)
+	// must wait less than DispatchWaitSLOThreshold (milliseconds, 0 disables the SLO).
+	// OnDispatchWaitSLOViolation is called with the compliance percentage when the SLO gets violated.
+	DispatchWaitSLOThreshold   int
+	DispatchWaitSLOTarget      float64
+	DispatchWaitSLOWindow      int
+	OnDispatchWaitSLOViolation func(compliance float64) `yaml:"-" json:"-"`
+
+	// Pool lifecycle hooks, e.g. to keep an external service registry in sync : OnPoolRegister is called when
+	// the first connection of a client creates its pool, OnPoolEmpty when a clean finds the pool without connection
+	// and OnPoolRemove when the pool is removed. They are called in order from a separate goroutine,
+	// the ones of the pools removed by Server.Shutdown before it returns.
+	OnPoolRegister func(id PoolID) `yaml:"-" json:"-"`
+	OnPoolEmpty    func(id PoolID) `yaml:"-" json:"-"`
+	OnPoolRemove   func(id PoolID) `yaml:"-" json:"-"`
+
+	// Action on the requests having the RequestIDHeader, caller, method and URL of a request seen within
+	// DuplicateRequestWindow (milliseconds) : reject, deduplicate or nothing if empty. At most MaxRecentRequestIDs are remembered
+	// and the deduplicated responses larger than MaxDeduplicatedResponseSize (bytes) are not kept.
+	DuplicateRequestAction      string
+	RequestIDHeader             string
+	DuplicateRequestWindow      int
+	MaxRecentRequestIDs         int
+	MaxDeduplicatedResponseSize int
+
+	// Connections are closed once they have served this many requests, the clients open fresh ones (0 means unlimited)
+	MaxRequestsPerConnection int
+
+	// Maximum number of connections registered from a single source IP (0 means unlimited)
+	MaxConnectionsPerSourceIP int
+
+	// Maximum number of pools and of connections in a pool (0 means unlimited),
+	// the size declared by the clients is clamped to MaxConnectionsPerPool
+	MaxPools              int
+	MaxConnectionsPerPool int
+
+	// Allow moving idle connections to the other pools advertised by their client instead of closing them
+	AllowConnectionMigration bool
+
+	// Limits of the response headers written to the caller (0 means unlimited), unlike MaxResponseHeaderBytes
+	// which bounds the serialized headers read from the peer, and action when they are exceeded ( truncate or reject )
+	MaxResponseHeaderCount       int
+	MaxRelayedResponseHeaderSize int
+	ResponseHeaderLimitAction    string
+
+	// Rules to rewrite the path of the destination URL, the first matching rule is applied
+	PathRewrites []*PathRewrite
+
+	// Recurring time ranges during which some pools don't receive requests
+	MaintenanceWindows []*MaintenanceWindow
+
+	// Shadow a sample of the requests to the pools having some labels
+	Mirror *Mirror
+
+	// Webhooks receiving the alerts ( pool down, all pools empty, dispatch timeouts, dispatch wait SLO )
+	// and number of dispatch timeouts between two cleans ( every 5 seconds ) raising an alert (0 to disable)
+	Webhooks                      []*Webhook
+	DispatchTimeoutAlertThreshold int
+
+	// Sign the proxied requests with an HMAC of SigningKey set in the SigningHeader header
+	SigningKey    string
+	SigningHeader string
+
+	// RequestSigner signs the proxied requests ( it takes precedence over SigningKey )
+	RequestSigner RequestSigner `yaml:"-" json:"-"`
+
+	// Optional transforms of the request and response bodies as they stream through the proxy
+	RequestBodyTransform  RequestBodyTransform  `yaml:"-" json:"-"`
+	ResponseBodyTransform ResponseBodyTransform `yaml:"-" json:"-"`
+
+	// Interval between pool stats reports sent to the clients (milliseconds, 0 to disable)
+	StatsInterval int
+
+	// Ask the clients to open connections when their pool has less than MinIdle idle connections,
+	// up to the size the pool declared (0 to disable)
+	MinIdle int
+
+	// Number of stats reports averaged to suggest clients how many idle connections to keep (0 to disable)
+	IdleHintWindow int
+
+	// Add the dispatch wait, the ID of the WSP client and the upstream time to the proxied responses.
+	// They expose internal details, enable it only for trusted callers.
+	ExposeDispatchHeaders bool
+
+	// Serve the Prometheus metrics on /metrics ( used by wsp_server )
+	EnableMetrics bool
+
+	// Labels of the per-pool metrics, pool or the labels advertised by the clients,
+	// and maximum number of distinct values of each label before using "other" (0 means unlimited)
+	MetricLabels         []string
+	MaxMetricLabelValues int
+
+	// Format of the logs ( text, or json for one object per line ) unless Server.SetLogger sets the logger
+	LogFormat string
+
+	// Log the registrations rejected for an invalid secret key with their source IP and a hash of the key
+	LogAuthFailures bool
+
+	// Source IPs failing to authenticate AuthFailureBanThreshold times within AuthFailureBanWindow (milliseconds)
+	// are refused with a 403 for AuthFailureBanDuration (milliseconds), 0 disables the bans.
+	// At most MaxBannedIPs source IPs are tracked (0 means unlimited).
+	AuthFailureBanThreshold int
+	AuthFailureBanWindow    int
+	AuthFailureBanDuration  int
+	MaxBannedIPs            int
+}
+
+// redacted replaces the credentials in the redacted configuration
+const redacted = "***"
+
+// Redacted returns a copy of the configuration with the secret keys, the admin and status tokens, the signing key
+// and the webhook URLs replaced by "***" when set. The code hooks ( signer, transforms, callbacks ) are not serialized to JSON.
+func (c Config) Redacted() *Config {
+	for _, secret := range []*string{&c.SecretKey, &c.AdminToken, &c.StatusAuthToken, &c.SigningKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	if c.SecretKeys != nil {
+		keys := make(map[string]string, len(c.SecretKeys))
+		for name := range c.SecretKeys {
+			keys[name] = redacted
+		}
+		c.SecretKeys = keys
+	}
+	webhooks := make([]*Webhook, 0, len(c.Webhooks))
+	for _, webhook := range c.Webhooks {
+		w := *webhook
+		w.URL = redacted
+		webhooks = append(webhooks, &w)
+	}
+	c.Webhooks = webhooks
+	return &c
 }
 
 // GetAddr returns the address to specify a HTTP server address
@@ -27,13 +308,167 @@ func (c Config) GetTimeout() time.Duration {
 	return time.Duration(c.Timeout) * time.Millisecond
 }
 
+// GetMethodTimeout returns the timeout to dispatch a request of the HTTP method,
+// the methods of MethodTimeouts are matched case-insensitively
+func (c Config) GetMethodTimeout(method string) time.Duration {
+	if timeout, ok := c.MethodTimeouts[method]; ok {
+		return time.Duration(timeout) * time.Millisecond
+	}
+	for m, timeout := range c.MethodTimeouts {
+		if strings.EqualFold(m, method) {
+			return time.Duration(timeout) * time.Millisecond
+		}
+	}
+	return c.GetTimeout()
+}
+
+// GetMaxDispatchTimeout returns the time.Duration converted to millisecond
+func (c Config) GetMaxDispatchTimeout() time.Duration {
+	return time.Duration(c.MaxDispatchTimeout) * time.Millisecond
+}
+
+// GetCancelTimeout returns the time.Duration converted to millisecond
+func (c Config) GetCancelTimeout() time.Duration {
+	return time.Duration(c.CancelTimeout) * time.Millisecond
+}
+
+// GetIdleTimeout returns the time.Duration converted to millisecond
+func (c Config) GetIdleTimeout() time.Duration {
+	return time.Duration(c.IdleTimeout) * time.Millisecond
+}
+
+// GetPingTimeout returns the time.Duration converted to millisecond
+func (c Config) GetPingTimeout() time.Duration {
+	return time.Duration(c.PingTimeout) * time.Millisecond
+}
+
+// GetPingInterval returns the time.Duration converted to millisecond
+func (c Config) GetPingInterval() time.Duration {
+	return time.Duration(c.PingInterval) * time.Millisecond
+}
+
+// GetDispatchWaitSLOThreshold returns the time.Duration converted to millisecond
+func (c Config) GetDispatchWaitSLOThreshold() time.Duration {
+	return time.Duration(c.DispatchWaitSLOThreshold) * time.Millisecond
+}
+
+// GetDispatchWaitSLOWindow returns the time.Duration converted to millisecond
+func (c Config) GetDispatchWaitSLOWindow() time.Duration {
+	return time.Duration(c.DispatchWaitSLOWindow) * time.Millisecond
+}
+
+// GetAuthFailureBanWindow returns the time.Duration converted to millisecond
+func (c Config) GetAuthFailureBanWindow() time.Duration {
+	return time.Duration(c.AuthFailureBanWindow) * time.Millisecond
+}
+
+// GetAuthFailureBanDuration returns the time.Duration converted to millisecond
+func (c Config) GetAuthFailureBanDuration() time.Duration {
+	return time.Duration(c.AuthFailureBanDuration) * time.Millisecond
+}
+
+// GetDuplicateRequestWindow returns the time.Duration converted to millisecond
+func (c Config) GetDuplicateRequestWindow() time.Duration {
+	return time.Duration(c.DuplicateRequestWindow) * time.Millisecond
+}
+
+// GetRetryAfterBase returns the time.Duration converted to millisecond
+func (c Config) GetRetryAfterBase() time.Duration {
+	return time.Duration(c.RetryAfterBase) * time.Millisecond
+}
+
+// GetPoolShutdownTimeout returns the time.Duration converted to millisecond
+func (c Config) GetPoolShutdownTimeout() time.Duration {
+	return time.Duration(c.PoolShutdownTimeout) * time.Millisecond
+}
+
+// GetWriteTimeout returns the time.Duration converted to millisecond
+func (c Config) GetWriteTimeout() time.Duration {
+	return time.Duration(c.WriteTimeout) * time.Millisecond
+}
+
+// GetReadTimeout returns the time.Duration converted to millisecond
+func (c Config) GetReadTimeout() time.Duration {
+	return time.Duration(c.ReadTimeout) * time.Millisecond
+}
+
+// GetInactivePoolTimeout returns the time.Duration converted to millisecond
+func (c Config) GetInactivePoolTimeout() time.Duration {
+	return time.Duration(c.InactivePoolTimeout) * time.Millisecond
+}
+
+// GetEmptyPoolGracePeriod returns the time.Duration converted to millisecond
+func (c Config) GetEmptyPoolGracePeriod() time.Duration {
+	return time.Duration(c.EmptyPoolGracePeriod) * time.Millisecond
+}
+
+// GetRegisterHandshakeTimeout returns the time.Duration converted to millisecond
+func (c Config) GetRegisterHandshakeTimeout() time.Duration {
+	return time.Duration(c.RegisterHandshakeTimeout) * time.Millisecond
+}
+
+// GetChallengeTimeout returns the time.Duration converted to millisecond
+func (c Config) GetChallengeTimeout() time.Duration {
+	return time.Duration(c.ChallengeTimeout) * time.Millisecond
+}
+
+// GetSuccessRateHalfLife returns the time.Duration converted to millisecond
+func (c Config) GetSuccessRateHalfLife() time.Duration {
+	return time.Duration(c.SuccessRateHalfLife) * time.Millisecond
+}
+
+// GetTakeFailureBackoff returns the time.Duration converted to millisecond
+func (c Config) GetTakeFailureBackoff() time.Duration {
+	return time.Duration(c.TakeFailureBackoff) * time.Millisecond
+}
+
+// GetLongLivedThreshold returns the time.Duration converted to millisecond
+func (c Config) GetLongLivedThreshold() time.Duration {
+	return time.Duration(c.LongLivedThreshold) * time.Millisecond
+}
+
+// GetStatsInterval returns the time.Duration converted to millisecond
+func (c Config) GetStatsInterval() time.Duration {
+	return time.Duration(c.StatsInterval) * time.Millisecond
+}
+
 // NewConfig creates a new ProxyConfig
 func NewConfig() (config *Config) {
 	config = new(Config)
 	config.Host = "127.0.0.1"
 	config.Port = 8080
 	config.Timeout = 1000 // millisecond
+	config.MaxDispatchTimeout = 30000
 	config.IdleTimeout = 60000
+	config.PingTimeout = 5000
+	config.CancelTimeout = 5000
+	config.RequestBodyChunkSize = 64 << 10 // 64 KB
+	config.TCPNoDelay = true
+	config.ChallengeTimeout = 5000
+	config.RegisterHandshakeTimeout = 10000
+	config.Strategy = StrategyRandom
+	config.SuccessRateHalfLife = 30000
+	config.MaxTakeFailures = 10
+	config.TakeFailureBackoff = 5
+	config.LongLivedThreshold = 30000
+	config.MaxResponseHeaderBytes = 1 << 20 // 1 MB
+	config.ResponseHeaderLimitAction = HeaderLimitReject
+	config.SigningHeader = "X-Wsp-Signature"
+	config.LogFormat = LogFormatText
+	config.LogAuthFailures = true
+	config.AuthFailureBanWindow = 60000
+	config.AuthFailureBanDuration = 600000
+	config.MaxBannedIPs = 10000
+	config.MinSourceIPs = 2
+	config.DispatchWaitSLOTarget = 95
+	config.DispatchWaitSLOWindow = 60000
+	config.RequestIDHeader = "X-Request-Id"
+	config.DuplicateRequestWindow = 60000
+	config.MaxRecentRequestIDs = 10000
+	config.MaxDeduplicatedResponseSize = 1 << 20 // 1 MB
+	config.DispatchTimeoutAlertThreshold = 10
+	config.RetryStatusCodes = []int{502, 503, 504}
+	config.MetricLabels = []string{PoolLabel}
 	return
 }
 
@@ -51,5 +486,66 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		return
 	}
 
+	if config.ResponseHeaderLimitAction != HeaderLimitTruncate && config.ResponseHeaderLimitAction != HeaderLimitReject {
+		err = fmt.Errorf("invalid response header limit action %q", config.ResponseHeaderLimitAction)
+		return
+	}
+
+	switch config.DuplicateRequestAction {
+	case "", DuplicateRequestReject, DuplicateRequestDeduplicate:
+	default:
+		err = fmt.Errorf("invalid duplicate request action %q", config.DuplicateRequestAction)
+		return
+	}
+
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		err = fmt.Errorf("invalid log format %q", config.LogFormat)
+		return
+	}
+
+	if _, err = newStrategySelector(config.Strategy); err != nil {
+		return
+	}
+
+	// An empty named key would let any client without a key register
+	for name, key := range config.SecretKeys {
+		if key == "" {
+			err = fmt.Errorf("empty secret key %q", name)
+			return
+		}
+	}
+
+	for _, rewrite := range config.PathRewrites {
+		if err = rewrite.Compile(); err != nil {
+			return
+		}
+	}
+
+	for _, window := range config.MaintenanceWindows {
+		if err = window.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.Mirror != nil {
+		if err = config.Mirror.Compile(); err != nil {
+			return
+		}
+	}
+
+	if _, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		return
+	}
+
+	for _, webhook := range config.Webhooks {
+		if err = webhook.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.SigningKey != "" {
+		config.RequestSigner = NewHMACSigner(config.SigningHeader, config.SigningKey)
+	}
+
 	return
 }
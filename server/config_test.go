@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetMethodTimeout(t *testing.T) {
+	config := NewConfig()
+	config.Timeout = 1000
+	config.MethodTimeouts = map[string]int{"get": 2000, "POST": 3000}
+
+	tests := []struct {
+		method  string
+		timeout time.Duration
+	}{
+		{method: "GET", timeout: 2 * time.Second},
+		{method: "get", timeout: 2 * time.Second},
+		{method: "POST", timeout: 3 * time.Second},
+		{method: "post", timeout: 3 * time.Second},
+		{method: "PUT", timeout: time.Second},
+	}
+	for _, test := range tests {
+		if got := config.GetMethodTimeout(test.method); got != test.timeout {
+			t.Errorf("%s : got timeout %s, want %s", test.method, got, test.timeout)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -25,14 +27,61 @@ const (
 	Closed
 )
 
+// errResponseHeaderTooLarge is returned by proxyRequest when the peer sends headers larger than Config.MaxResponseHeaderBytes
+var errResponseHeaderTooLarge = errors.New("http response header too large")
+
+// errUpstreamResponse is returned by proxyRequest when the response of the upstream can't be written to the caller.
+// The connection is not at fault, the rest of the response has been discarded and the connection released.
+var errUpstreamResponse = errors.New("unable to relay the upstream response")
+
+// closeWriteTimeout bounds the time spent sending the close frame to the peer
+const closeWriteTimeout = time.Second
+
 // Connection manages a single websocket connection from the peer.
 // wsp supports multiple connections from a single peer at the same time.
 type Connection struct {
-	pool      *Pool
-	ws        *websocket.Conn
+	// Moving average of the request outcomes as float64 bits ( atomic, keep it first for 64-bit alignment )
+	health uint64
+	// Time of the last pong received from the peer in nanoseconds ( atomic )
+	lastPong int64
+	// Number of consecutive failed requests ( atomic )
+	failures int32
+	// Number of requests served by the connection ( atomic )
+	served int32
+
+	pool     *Pool
+	ws       *websocket.Conn
+	sourceIP string
+
+	// Protocol version and software version advertised in the greeting of the peer
+	protocolVersion int
+	clientVersion   string
+
+	// Pools this connection can be migrated to
+	eligiblePools []PoolID
+
+	// Destination host of the last proxied request for connection affinity
+	lastHost string
+
+	// Time of the ping sent to check that the idle connection is alive, zero if none is pending
+	pingSent time.Time
+
+	// The peer can be asked to cancel the request in progress ( its body is sent or being sent in chunks )
+	// and has been asked to
+	cancelable bool
+	cancelSent bool
+	// Serializes the writes of a chunked request body and of the cancel interleaved with them
+	writeLock sync.Mutex
+
+	// Incremented each time the connection is taken, identifies the request it serves
+	takes uint64
+
 	status    ConnectionStatus
 	idleSince time.Time
+	longLived bool
 	lock      sync.Mutex
+	// withdraw is closed to withdraw the pending offer of the idle connection from its pool
+	withdraw chan struct{}
 	// nextResponse is the channel of channel to wait an HTTP response.
 	//
 	// In advance, the `read` function waits to receive the HTTP response as a separate thread "reader".
@@ -46,18 +95,27 @@ type Connection struct {
 	// it sends the value to the channel (chan io.Reader),
 	// and the "server" thread can proceed to process the rest procedures.
 	nextResponse chan chan io.Reader
+	// closed is closed with the connection to withdraw it from the idle connections offered to the server
+	closed chan struct{}
 }
 
 // NewConnection returns a new Connection.
-func NewConnection(pool *Pool, ws *websocket.Conn) *Connection {
+func NewConnection(pool *Pool, ws *websocket.Conn, sourceIP string, eligiblePools []PoolID, greeting *wsp.GreetingMessage) *Connection {
 	// Initialize a new Connection
 	c := new(Connection)
 	c.pool = pool
 	c.ws = ws
+	c.sourceIP = sourceIP
+	c.eligiblePools = eligiblePools
+	c.protocolVersion = greeting.ProtocolVersion
+	c.clientVersion = greeting.Version
 	c.nextResponse = make(chan chan io.Reader)
+	c.closed = make(chan struct{})
 	c.status = Idle
+	c.health = math.Float64bits(1)
 
 	// Mark that this connection is ready to use for relay
+	c.watchPongs()
 	c.Release()
 
 	// Start to listen to incoming messages over the WebSocket connection
@@ -70,13 +128,13 @@ func NewConnection(pool *Pool, ws *websocket.Conn) *Connection {
 func (connection *Connection) read() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Websocket crash recovered : %s", r)
+			connection.pool.server.logger.Error("Websocket crash recovered", "error", r)
 		}
 		connection.Close()
 	}()
 
 	for {
-		if connection.status == Closed {
+		if connection.getStatus() == Closed {
 			break
 		}
 
@@ -94,7 +152,7 @@ func (connection *Connection) read() {
 			break
 		}
 
-		if connection.status != Busy {
+		if connection.getStatus() != Busy {
 			// We received a wild unexpected message
 			break
 		}
@@ -103,9 +161,13 @@ func (connection *Connection) read() {
 		//
 		// Next, it waits to receive the value from the Connection.proxyRequest function that is invoked in the "server" thread.
 		// https://github.com/hgsgtk/wsp/blob/29cc73bbd67de18f1df295809166a7a5ef52e9fa/server/connection.go#L157
-		c := <-connection.nextResponse
-		if c == nil {
+		var c chan io.Reader
+		select {
+		case c = <-connection.nextResponse:
+		case <-connection.closed:
 			// We have been unlocked by Close()
+		}
+		if c == nil {
 			break
 		}
 
@@ -118,12 +180,24 @@ func (connection *Connection) read() {
 	}
 }
 
-// Proxy a HTTP request through the Proxy over the websocket connection
-func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Request) (err error) {
-	log.Printf("proxy request to %s", connection.pool.id)
+// Proxy a HTTP request through the Proxy over the websocket connection.
+// If retryable returns true for the response status nothing is written to w, the response body is drained
+// and errRetryableStatus is returned so that the request can be sent through another connection.
+func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Request, requestID string, retryable func(status int) bool) (err error) {
+	connection.pool.server.logEvent(Event{Event: EventUpstreamRequest, RequestID: requestID, PoolID: connection.pool.id},
+		"proxy request to %s", connection.pool.id)
+
+	connection.lock.Lock()
+	connection.lastHost = r.URL.Host
+	connection.lock.Unlock()
 
 	// [1]: Serialize HTTP request
-	jsonReq, err := json.Marshal(wsp.SerializeHTTPRequest(r))
+	request, requestBody := connection.pool.server.serializeRequest(r)
+	request.UpstreamTimeout = int64(connection.pool.server.Config.UpstreamTimeout)
+	chunkSize := connection.pool.server.Config.RequestBodyChunkSize
+	request.ChunkedBody = chunkSize > 0 && r.ContentLength != 0 && connection.protocolVersion >= wsp.ChunkedBodyProtocolVersion
+	request.Trailers = connection.protocolVersion >= wsp.TrailersProtocolVersion
+	jsonReq, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("unable to serialize request : %w", err)
 	}
@@ -137,42 +211,57 @@ func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Reques
 
 	// [2]: Send the HTTP request to the peer
 	// Send the serialized HTTP request to the the peer
+	// A peer which stops reading or sending fails the relay after Config.WriteTimeout or Config.ReadTimeout
+	connection.setWriteDeadline()
 	if err := connection.ws.WriteMessage(websocket.TextMessage, jsonReq); err != nil {
 		return fmt.Errorf("unable to write request : %w", err)
 	}
 
 	// Pipe the HTTP request body to the the peer
-	bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		return fmt.Errorf("unable to get request body writer : %w", err)
-	}
-	if _, err := io.Copy(bodyWriter, r.Body); err != nil {
-		return fmt.Errorf("unable to pipe request body : %w", err)
-	}
-	if err := bodyWriter.Close(); err != nil {
-		return fmt.Errorf("unable to pipe request body (close) : %w", err)
+	var aborted error
+	if request.ChunkedBody {
+		if aborted, err = connection.writeChunkedBody(requestBody, chunkSize); err != nil {
+			return err
+		}
+	} else {
+		bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return fmt.Errorf("unable to get request body writer : %w", err)
+		}
+		if _, err := io.Copy(deadlineWriter{bodyWriter, connection}, requestBody); err != nil {
+			return fmt.Errorf("unable to pipe request body : %w", err)
+		}
+		connection.setWriteDeadline()
+		if err := bodyWriter.Close(); err != nil {
+			return fmt.Errorf("unable to pipe request body (close) : %w", err)
+		}
+		connection.setCancelable()
 	}
 
 	// [3]: Wait the HTTP response is ready
 	responseChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseChannel
-	responseReader, ok := <-responseChannel
+	connection.setReadDeadline()
+	responseReader := connection.nextReader(responseChannel)
 	if responseReader == nil {
-		if ok {
-			// The value of ok is false, the channel is closed and empty.
-			// See the Receiver operator in https://go.dev/ref/spec for more information.
-			close(responseChannel)
-		}
-		return fmt.Errorf("unable to get http response reader : %w", err)
+		return fmt.Errorf("unable to get http response reader : %w", errConnectionClosed)
 	}
 
 	// [4]: Read the HTTP response from the peer
 	// Get the serialized HTTP Response from the peer
-	jsonResponse, err := io.ReadAll(responseReader)
+	// Never read more than MaxResponseHeaderBytes to protect the server from pathologically large headers
+	maxHeaderBytes := int64(connection.pool.server.Config.MaxResponseHeaderBytes)
+	if maxHeaderBytes > 0 {
+		responseReader = io.LimitReader(responseReader, maxHeaderBytes+1)
+	}
+	jsonResponse, err := io.ReadAll(deadlineReader{responseReader, connection})
 	if err != nil {
 		close(responseChannel)
 		return fmt.Errorf("unable to read http response : %w", err)
 	}
+	if maxHeaderBytes > 0 && int64(len(jsonResponse)) > maxHeaderBytes {
+		close(responseChannel)
+		return fmt.Errorf("%w : more than %d bytes", errResponseHeaderTooLarge, maxHeaderBytes)
+	}
 
 	// Notify the read() goroutine that we are done reading the response
 	close(responseChannel)
@@ -183,32 +272,73 @@ func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Reques
 		return fmt.Errorf("unable to unserialize http response : %w", err)
 	}
 
-	// Write response headers back to the client
-	for header, values := range httpResponse.Header {
-		for _, value := range values {
-			w.Header().Add(header, value)
+	if httpResponse.Backend != "" {
+		connection.pool.server.metrics.IncCounter(MetricBackendRequests, connection.pool.server.backendLabels(connection.pool, httpResponse.Backend))
+	}
+
+	if httpResponse.StatusCode == wsp.UpstreamTimeoutStatus {
+		httpResponse.StatusCode = http.StatusGatewayTimeout
+	}
+
+	// The status and headers are read before anything is written to the caller
+	// so a retryable response can be thrown away, like the response to a body cut short for its size
+	tooLarge := errors.Is(aborted, errRequestBodyTooLarge)
+	retry := tooLarge || retryable != nil && retryable(httpResponse.StatusCode)
+	writeHeader := func() error {
+		// Protect the caller from header bombs
+		responseHeader, err := connection.pool.server.limitResponseHeader(httpResponse.Header)
+		if err != nil {
+			return err
+		}
+
+		// Write response headers back to the client
+		for header, values := range responseHeader {
+			for _, value := range values {
+				w.Header().Add(header, value)
+			}
+		}
+		w.WriteHeader(httpResponse.StatusCode)
+		return nil
+	}
+
+	// A transform might update the headers, they are written once it got the body.
+	// A response rejected by the header limits is drained like a retried one to keep the connection usable.
+	transform := connection.pool.server.Config.ResponseBodyTransform
+	var responseWriter io.Writer = w
+	var rejected error
+	if retry {
+		responseWriter = io.Discard
+	} else if transform == nil {
+		if rejected = writeHeader(); rejected != nil {
+			responseWriter = io.Discard
 		}
 	}
-	w.WriteHeader(httpResponse.StatusCode)
 
 	// [5]: Wait the HTTP response body is ready
 	// Get the HTTP Response body from the the peer
 	// To do so send a new channel to the read() goroutine
 	// to get the next message reader
 	responseBodyChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseBodyChannel
-	responseBodyReader, ok := <-responseBodyChannel
+	connection.setReadDeadline()
+	responseBodyReader := connection.nextReader(responseBodyChannel)
 	if responseBodyReader == nil {
-		if ok {
-			// If more is false the channel is already closed
-			close(responseChannel)
+		return fmt.Errorf("unable to get http response body reader : %w", errConnectionClosed)
+	}
+
+	responseBodyReader = deadlineReader{responseBodyReader, connection}
+	var responseBody io.Reader = responseBodyReader
+	if !retry && transform != nil {
+		responseBody = transform(r, httpResponse, responseBodyReader)
+		httpResponse.Header.Del("Content-Length")
+		if rejected = writeHeader(); rejected != nil {
+			responseBody = responseBodyReader
+			responseWriter = io.Discard
 		}
-		return fmt.Errorf("unable to get http response body reader : %w", err)
 	}
 
 	// [6]: Read the HTTP response body from the peer
 	// Pipe the HTTP response body right from the remote Proxy to the client
-	if _, err := io.Copy(w, responseBodyReader); err != nil {
+	if _, err := io.Copy(responseWriter, responseBody); err != nil {
 		close(responseBodyChannel)
 		return fmt.Errorf("unable to pipe response body : %w", err)
 	}
@@ -216,16 +346,111 @@ func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Reques
 	// Notify read() that we are done reading the response body
 	close(responseBodyChannel)
 
-	connection.Release()
+	// [7]: Read the HTTP response trailers from the peer
+	if httpResponse.Trailers {
+		trailer, err := connection.readTrailer()
+		if err != nil {
+			return err
+		}
+		if !retry && rejected == nil && len(trailer) > 0 {
+			// Trailers are only sent with a chunked response, flushing before the handler returns
+			// prevents net/http from computing a Content-Length ( a Content-Length from the peer still wins )
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			for name, values := range trailer {
+				for _, value := range values {
+					w.Header().Add(http.TrailerPrefix+name, value)
+				}
+			}
+		}
+	}
 
+	// The deadlines must not outlive the relay, the released connection can serve another request right away
+	connection.clearDeadlines()
+
+	// Retire a connection whose upstream keeps failing, the client opens a fresh one
+	if connection.recordHealth(httpResponse.StatusCode < http.StatusInternalServerError) {
+		connection.pool.server.logger.Info("Retiring unhealthy connection", "pool_id", connection.pool.id, "failures", connection.pool.server.Config.MaxConnectionFailures)
+		connection.CloseWithReason(websocket.CloseGoingAway, "unhealthy connection")
+	} else if max := connection.pool.server.Config.MaxRequestsPerConnection; max > 0 && int(atomic.AddInt32(&connection.served, 1)) >= max {
+		// Rotate the connections so that a scaling event gets rebalanced without restarting the clients
+		connection.pool.server.logger.Info("Retiring connection at its reuse limit", "pool_id", connection.pool.id, "requests", max)
+		connection.CloseWithReason(websocket.CloseNormalClosure, "connection reuse limit")
+	} else {
+		connection.Release()
+	}
+
+	if tooLarge {
+		return fmt.Errorf("%w the request to %s", errRequestBodyCanceled, connection.pool.id)
+	}
+	if aborted != nil {
+		return fmt.Errorf("%w, the request to %s was canceled", errCallerGone, connection.pool.id)
+	}
+	if retry {
+		return fmt.Errorf("%w %d from %s", errRetryableStatus, httpResponse.StatusCode, connection.pool.id)
+	}
+	if rejected != nil {
+		return fmt.Errorf("%w from %s : %w", errUpstreamResponse, connection.pool.id, rejected)
+	}
 	return
 }
 
+// nextReader asks the read() goroutine for the reader of the next message from the peer.
+// The channel must be closed once the message has been read, nil is returned if the connection is closed.
+func (connection *Connection) nextReader(c chan io.Reader) io.Reader {
+	select {
+	case connection.nextResponse <- c:
+	case <-connection.closed:
+		return nil
+	}
+	// read() sends the reader right after receiving the channel
+	return <-c
+}
+
+// readTrailer reads the trailers of the response sent by the peer after the response body,
+// they are bounded by Config.MaxResponseHeaderBytes like the headers
+func (connection *Connection) readTrailer() (trailer http.Header, err error) {
+	trailerChannel := make(chan (io.Reader))
+	connection.setReadDeadline()
+	trailerReader := connection.nextReader(trailerChannel)
+	if trailerReader == nil {
+		return nil, fmt.Errorf("unable to get http response trailer reader : %w", errConnectionClosed)
+	}
+	defer close(trailerChannel)
+
+	maxHeaderBytes := int64(connection.pool.server.Config.MaxResponseHeaderBytes)
+	if maxHeaderBytes > 0 {
+		trailerReader = io.LimitReader(trailerReader, maxHeaderBytes+1)
+	}
+	jsonTrailer, err := io.ReadAll(deadlineReader{trailerReader, connection})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read http response trailer : %w", err)
+	}
+	if maxHeaderBytes > 0 && int64(len(jsonTrailer)) > maxHeaderBytes {
+		return nil, fmt.Errorf("%w : trailer of more than %d bytes", errResponseHeaderTooLarge, maxHeaderBytes)
+	}
+	if err := json.Unmarshal(jsonTrailer, &trailer); err != nil {
+		return nil, fmt.Errorf("unable to unserialize http response trailer : %w", err)
+	}
+	return trailer, nil
+}
+
 // Take notifies that this connection is going to be used
 func (connection *Connection) Take() bool {
+	return connection.takeFrom(nil)
+}
+
+// takeFrom notifies that this connection is going to be used if it still belongs to the pool it was offered by.
+// A connection migrated to another pool might still have a pending offer in its previous pool.
+func (connection *Connection) takeFrom(pool *Pool) bool {
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
 
+	if pool != nil && connection.pool != pool {
+		return false
+	}
+
 	if connection.status == Closed {
 		return false
 	}
@@ -235,9 +460,71 @@ func (connection *Connection) Take() bool {
 	}
 
 	connection.status = Busy
+	connection.takes++
+	connection.withdrawOffer()
 	return true
 }
 
+// getPool returns the pool the connection currently belongs to, a migration might move it to another pool
+func (connection *Connection) getPool() *Pool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.pool
+}
+
+// currentTake returns the take identifying the request the connection serves
+func (connection *Connection) currentTake() uint64 {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.takes
+}
+
+// servesTake returns true if the connection still serves the request of the take, once released it might
+// already serve another request ( without lock )
+func (connection *Connection) servesTake(take uint64) bool {
+	return connection.status == Busy && connection.takes == take
+}
+
+// closeTake closes the connection if it still serves the request of the take, it returns true if it did
+func (connection *Connection) closeTake(take uint64, code int, reason string) bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if !connection.servesTake(take) {
+		return false
+	}
+	connection.close(code, reason)
+	return true
+}
+
+// getStatus returns the status of the connection
+func (connection *Connection) getStatus() ConnectionStatus {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status
+}
+
+// isClosed returns true if the connection is closed
+func (connection *Connection) isClosed() bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status == Closed
+}
+
+// markLongLived notifies that this connection is serving a long-lived request
+func (connection *Connection) markLongLived() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.status == Busy {
+		connection.longLived = true
+	}
+}
+
 // Release notifies that this connection is ready to use again
 func (connection *Connection) Release() {
 	connection.lock.Lock()
@@ -247,34 +534,88 @@ func (connection *Connection) Release() {
 		return
 	}
 
+	// Let the client reconnect to another replica
+	if connection.pool.server.isDraining() {
+		connection.close(websocket.CloseGoingAway, "server draining")
+		return
+	}
+
+	// The pool waited for this request to shut down
+	if code, reason, ok := connection.pool.gracefulShutdown(); ok {
+		connection.close(code, reason)
+		go connection.pool.stopShutdownTimerIfDrained()
+		return
+	}
+
 	connection.idleSince = time.Now()
+	connection.pingSent = time.Time{}
+	connection.cancelable = false
+	connection.cancelSent = false
 	connection.status = Idle
+	connection.longLived = false
+
+	// Deliver the control messages which found no idle connection before the connection is offered again
+	if !connection.sendDeferredControlMessages() {
+		return
+	}
+
+	connection.offer()
+}
 
-	go connection.pool.Offer(connection)
+// offer offers the idle connection to its pool until it is taken, its offer is withdrawn or it is closed ( without lock )
+func (connection *Connection) offer() {
+	connection.withdrawOffer()
+	connection.withdraw = make(chan struct{})
+	go connection.pool.offer(connection, connection.withdraw)
+}
+
+// withdrawOffer withdraws the pending offer of the connection if any, a connection taken without going
+// through the idle channel of its pool must not be handed to a request by this offer later ( without lock )
+func (connection *Connection) withdrawOffer() {
+	if connection.withdraw != nil {
+		close(connection.withdraw)
+		connection.withdraw = nil
+	}
 }
 
 // Close the connection
 func (connection *Connection) Close() {
+	connection.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithReason sends a websocket close frame with the given close code and reason to the peer
+// then closes the connection
+func (connection *Connection) CloseWithReason(code int, reason string) {
 	connection.lock.Lock()
 	defer connection.lock.Unlock()
 
-	connection.close()
+	connection.close(code, reason)
 }
 
 // Close the connection ( without lock )
-func (connection *Connection) close() {
+func (connection *Connection) close(code int, reason string) {
 	if connection.status == Closed {
 		return
 	}
 
-	log.Printf("Closing connection from %s", connection.pool.id)
+	connection.pool.server.logEvent(Event{Event: EventConnectionClosed, PoolID: connection.pool.id},
+		"Closing connection from %s", connection.pool.id)
 
 	// This one will be executed *before* lock.Unlock()
 	defer func() { connection.status = Closed }()
 
-	// Unlock a possible read() wild message
-	close(connection.nextResponse)
+	// Unlock a possible read() wild message, withdraw the connection if it is offered as idle
+	// and unlock a request waiting for the next message
+	close(connection.closed)
+
+	// Let the peer know why the connection is going away so it can reconnect cleanly.
+	// The peer might already be gone, so the error is ignored.
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	connection.ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeWriteTimeout))
 
 	// Close the underlying TCP connection
 	connection.ws.Close()
+
+	// Free the slot of the source IP
+	connection.pool.server.releaseSourceIP(connection.sourceIP)
 }
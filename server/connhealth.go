@@ -0,0 +1,120 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// connectionHealthAlpha is the weight of the last request outcome in the health of a connection
+const connectionHealthAlpha = 0.2
+
+// healthyConnection is the health above which the dispatcher does not look for a healthier connection
+const healthyConnection = 0.99
+
+// ConnectionHealth is a snapshot of the health of a connection reported by /status?verbose=1
+type ConnectionHealth struct {
+	SourceIP string
+	Status   string
+	Health   float64
+	Failures int // consecutive failed requests
+}
+
+// recordHealth updates the moving average of the request outcomes of the connection without locking.
+// It returns true if the connection failed Config.MaxConnectionFailures consecutive times and must be retired.
+func (connection *Connection) recordHealth(success bool) (retire bool) {
+	value := 0.0
+	if success {
+		value = 1.0
+	}
+	for {
+		old := atomic.LoadUint64(&connection.health)
+		health := math.Float64frombits(old)
+		health += connectionHealthAlpha * (value - health)
+		if atomic.CompareAndSwapUint64(&connection.health, old, math.Float64bits(health)) {
+			break
+		}
+	}
+
+	if success {
+		atomic.StoreInt32(&connection.failures, 0)
+		return false
+	}
+	failures := atomic.AddInt32(&connection.failures, 1)
+	max := connection.pool.server.Config.MaxConnectionFailures
+	return max > 0 && int(failures) >= max
+}
+
+// Health returns the recent success rate of the requests proxied through the connection between 0 and 1
+func (connection *Connection) Health() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&connection.health))
+}
+
+// preferHealthy returns an idle connection of the pool chosen at random weighted by health in place of the taken
+// connection if it is unhealthy, which is then offered again. It returns the taken connection otherwise.
+func (s *Server) preferHealthy(connection *Connection, pool *Pool) *Connection {
+	if !s.Config.PreferHealthyConnections || connection.Health() >= healthyConnection {
+		return connection
+	}
+
+	candidates := []*Connection{connection}
+	pool.lock.RLock()
+	for _, c := range pool.connections {
+		if c != connection && c.isIdle() {
+			candidates = append(candidates, c)
+		}
+	}
+	pool.lock.RUnlock()
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, c := range candidates {
+		weights[i] = math.Max(c.Health(), minSuccessRateWeight)
+		total += weights[i]
+	}
+	chosen := connection
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			chosen = candidates[i]
+			break
+		}
+	}
+
+	if chosen == connection || !chosen.takeFrom(pool) {
+		return connection
+	}
+	connection.offerAgain()
+	return chosen
+}
+
+// isIdle returns true if the connection is idle
+func (connection *Connection) isIdle() bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status == Idle
+}
+
+// connectionsHealth returns the health of the connections of the pool
+func (pool *Pool) connectionsHealth() (connections []ConnectionHealth) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	names := map[ConnectionStatus]string{Idle: "idle", Busy: "busy", Closed: "closed"}
+	connections = make([]ConnectionHealth, 0, len(pool.connections))
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		status := connection.status
+		connection.lock.Unlock()
+
+		connections = append(connections, ConnectionHealth{
+			SourceIP: connection.sourceIP,
+			Status:   names[status],
+			Health:   connection.Health(),
+			Failures: int(atomic.LoadInt32(&connection.failures)),
+		})
+	}
+	return
+}
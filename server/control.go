@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+// controlWriteTimeout bounds the time spent sending a control message to the peer
+const controlWriteTimeout = time.Second
+
+// reportPoolStats periodically sends to each pool its current state
+// so that clients can autoscale their connections.
+func (s *Server) reportPoolStats() {
+	interval := s.Config.GetStatsInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.RLock()
+		pools := make([]*Pool, len(s.pools))
+		copy(pools, s.pools)
+		s.lock.RUnlock()
+
+		for _, pool := range pools {
+			pool.reportStats(interval)
+		}
+	}
+}
+
+// reportStats sends the pool state to the peer over one of its idle connections
+func (pool *Pool) reportStats(interval time.Duration) {
+	ps := pool.Size()
+
+	requests := atomic.LoadInt64(&pool.requests)
+	msg := wsp.NewControlMessage(wsp.ControlPoolStats)
+	msg.PoolStats = &wsp.PoolStats{
+		Idle:        ps.Idle,
+		Busy:        ps.Busy + ps.LongLived,
+		RequestRate: float64(requests-pool.reportedRequests) / interval.Seconds(),
+	}
+
+	pool.sendOrDeferControlMessage(msg)
+
+	// Suggest the client to pre-open connections ahead of demand
+	if pool.server.Config.IdleHintWindow > 0 {
+		pool.sendIdleHint(pool.updateIdleHint(interval, requests))
+	}
+
+	pool.reportedRequests = requests
+}
+
+// sendControlMessage sends the control message over the first idle connection of the pool.
+// It returns false if no connection was idle.
+func (pool *Pool) sendControlMessage(msg *wsp.ControlMessage) bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for _, connection := range pool.connections {
+		if connection.sendControlMessage(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendOrDeferControlMessage sends the control message over the first idle connection of the pool,
+// or over the next connection released if none is idle so that a fully busy pool still gets it.
+// It replaces any deferred message of the same type, only the latest one is relevant.
+// The deferred messages lock is taken after the write as Release takes it under the connection lock.
+func (pool *Pool) sendOrDeferControlMessage(msg *wsp.ControlMessage) {
+	sent := pool.sendControlMessage(msg)
+
+	pool.deferredControlLock.Lock()
+	defer pool.deferredControlLock.Unlock()
+
+	if sent {
+		delete(pool.deferredControl, msg.Type)
+		return
+	}
+
+	if pool.deferredControl == nil {
+		pool.deferredControl = make(map[string]*wsp.ControlMessage)
+	}
+	pool.deferredControl[msg.Type] = msg
+	pool.server.logger.Debug("No idle connection for control message, deferring it", "pool_id", pool.id, "type", msg.Type)
+	pool.server.metrics.IncCounter(MetricControlMessagesDeferred, pool.server.poolLabels(pool))
+}
+
+// takeDeferredControlMessages returns and forgets the control messages waiting for a connection of the pool
+func (pool *Pool) takeDeferredControlMessages() (messages []*wsp.ControlMessage) {
+	pool.deferredControlLock.Lock()
+	defer pool.deferredControlLock.Unlock()
+
+	for _, msg := range pool.deferredControl {
+		messages = append(messages, msg)
+	}
+	pool.deferredControl = nil
+	return messages
+}
+
+// sendDeferredControlMessages sends the deferred control messages of the pool over the connection being released.
+// It returns false if the connection got closed ( without lock ).
+func (connection *Connection) sendDeferredControlMessages() bool {
+	for _, msg := range connection.pool.takeDeferredControlMessages() {
+		if !connection.writeControlMessage(msg) && connection.status == Closed {
+			return false
+		}
+	}
+	return true
+}
+
+// sendControlMessage sends a control message to the peer if the connection is idle.
+// The connection lock is held during the write so that the connection can't be taken meanwhile,
+// this ensures the message is never interleaved with a proxied request.
+func (connection *Connection) sendControlMessage(msg *wsp.ControlMessage) bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.status != Idle {
+		return false
+	}
+	return connection.writeControlMessage(msg)
+}
+
+// writeControlMessage writes the control message to the peer, the connection is closed if it fails ( without lock )
+func (connection *Connection) writeControlMessage(msg *wsp.ControlMessage) bool {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		connection.pool.server.logger.Error("Unable to serialize control message", "error", err)
+		return false
+	}
+
+	connection.ws.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	defer connection.ws.SetWriteDeadline(time.Time{})
+
+	if err := connection.ws.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
+		connection.pool.server.logger.Warn("Unable to write control message", "pool_id", connection.pool.id, "error", err)
+		connection.close(websocket.CloseNormalClosure, "")
+		return false
+	}
+
+	return true
+}
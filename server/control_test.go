@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+// setStatus sets the status of every connection of the pool
+func setStatus(pool *Pool, status ConnectionStatus) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		connection.status = status
+		connection.lock.Unlock()
+	}
+}
+
+// readControlMessage returns the next control message read from the websocket
+func readControlMessage(t *testing.T, ws *websocket.Conn) *wsp.ControlMessage {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, raw, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("unable to read control message : %s", err)
+	}
+	msg := new(wsp.ControlMessage)
+	if err := json.Unmarshal(raw, msg); err != nil {
+		t.Fatalf("unable to parse control message %q : %s", raw, err)
+	}
+	return msg
+}
+
+func TestControlMessageDeferredToRelease(t *testing.T) {
+	s, ts := newTestServer(t, NewConfig())
+	ws := dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+	pool := s.getPool("pool")
+
+	// The only connection is busy, the stats wait for it to be released
+	setStatus(pool, Busy)
+	pool.reportStats(time.Second)
+
+	pool.lock.RLock()
+	connection := pool.connections[0]
+	pool.lock.RUnlock()
+	connection.Release()
+
+	msg := readControlMessage(t, ws)
+	if msg.Type != wsp.ControlPoolStats || msg.PoolStats == nil {
+		t.Fatalf("got control message %+v, want the pool stats", msg)
+	}
+	if msg.PoolStats.Busy != 1 || msg.PoolStats.Idle != 0 {
+		t.Errorf("got %d busy and %d idle connections in the stats, want 1 busy", msg.PoolStats.Busy, msg.PoolStats.Idle)
+	}
+	if messages := pool.takeDeferredControlMessages(); len(messages) != 0 {
+		t.Errorf("got %d control messages still deferred after the release, want none", len(messages))
+	}
+}
+
+func TestControlMessageDeferredKeepsLatest(t *testing.T) {
+	s := NewServer(NewConfig())
+	pool := NewPool(s, "pool")
+
+	// Without connection every message is deferred
+	first := wsp.NewControlMessage(wsp.ControlPoolStats)
+	latest := wsp.NewControlMessage(wsp.ControlPoolStats)
+	hint := wsp.NewControlMessage(wsp.ControlIdleHint)
+	for _, msg := range []*wsp.ControlMessage{first, latest, hint} {
+		pool.sendOrDeferControlMessage(msg)
+	}
+
+	messages := pool.takeDeferredControlMessages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d deferred control messages, want one per type", len(messages))
+	}
+	for _, msg := range messages {
+		if msg == first {
+			t.Error("the first pool stats are still deferred, want only the latest ones")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"time"
+)
+
+// setWriteDeadline bounds the next write to the peer by Config.WriteTimeout, if set
+func (connection *Connection) setWriteDeadline() {
+	if timeout := connection.pool.server.Config.GetWriteTimeout(); timeout > 0 {
+		connection.ws.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+// setReadDeadline bounds the wait for the next data from the peer by Config.ReadTimeout, if set
+func (connection *Connection) setReadDeadline() {
+	if timeout := connection.pool.server.Config.GetReadTimeout(); timeout > 0 {
+		connection.ws.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// clearDeadlines removes the deadlines set during a relay, an idle connection waits for the next request forever
+func (connection *Connection) clearDeadlines() {
+	if connection.pool.server.Config.WriteTimeout > 0 {
+		connection.ws.SetWriteDeadline(time.Time{})
+	}
+	if connection.pool.server.Config.ReadTimeout > 0 {
+		connection.ws.SetReadDeadline(time.Time{})
+	}
+}
+
+// deadlineWriter sets the write deadline before each write so that a relay fails once the peer stops reading,
+// however long the whole body takes
+type deadlineWriter struct {
+	io.Writer
+	connection *Connection
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.connection.setWriteDeadline()
+	return w.Writer.Write(p)
+}
+
+// deadlineReader sets the read deadline before each read so that a relay fails once the peer stops sending,
+// however long the whole body takes
+type deadlineReader struct {
+	io.Reader
+	connection *Connection
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.connection.setReadDeadline()
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions on a request having the request id of a recent request
+const (
+	// DuplicateRequestReject answers the duplicates with a 409 Conflict
+	DuplicateRequestReject = "reject"
+	// DuplicateRequestDeduplicate answers the duplicates with the response of the first request
+	DuplicateRequestDeduplicate = "deduplicate"
+)
+
+// recordedResponse is a response kept to answer the duplicates of a request
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// write replays the response to the caller
+func (response *recordedResponse) write(w http.ResponseWriter) {
+	for header, values := range response.header {
+		w.Header()[header] = values
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// recentRequest is a request seen within Config.DuplicateRequestWindow
+type recentRequest struct {
+	key     string
+	expires time.Time
+
+	// Closed once the request is done, response is set if it can be replayed
+	done     chan struct{}
+	response *recordedResponse
+}
+
+// recentRequests is the bounded set of the requests seen within Config.DuplicateRequestWindow
+type recentRequests struct {
+	max      int
+	window   time.Duration
+	requests map[string]*recentRequest
+	order    []*recentRequest // requests from the oldest to the most recent
+	lock     sync.Mutex
+}
+
+// newRecentRequests creates a new recentRequests keeping at most max requests for window
+func newRecentRequests(max int, window time.Duration) (recent *recentRequests) {
+	recent = new(recentRequests)
+	recent.max = max
+	recent.window = window
+	recent.requests = make(map[string]*recentRequest)
+	return
+}
+
+// add registers the request key, it returns the recent request having this key and true if it is a duplicate
+func (recent *recentRequests) add(key string) (request *recentRequest, duplicate bool) {
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+
+	now := time.Now()
+	if request, ok := recent.requests[key]; ok && now.Before(request.expires) {
+		return request, true
+	}
+
+	// Evict the expired requests and the oldest ones over max. A key might have been
+	// registered again since, only the request it currently maps to is removed.
+	for len(recent.order) > 0 {
+		oldest := recent.order[0]
+		if recent.requests[oldest.key] == oldest && now.Before(oldest.expires) && len(recent.order) < recent.max {
+			break
+		}
+		if recent.requests[oldest.key] == oldest {
+			delete(recent.requests, oldest.key)
+		}
+		recent.order = recent.order[1:]
+	}
+
+	request = new(recentRequest)
+	request.key = key
+	request.expires = now.Add(recent.window)
+	request.done = make(chan struct{})
+	recent.requests[key] = request
+	recent.order = append(recent.order, request)
+	return request, false
+}
+
+// complete records the response of the request and notifies the waiting duplicates.
+// Failed or too large responses are not kept so that the caller can retry the request.
+func (recent *recentRequests) complete(request *recentRequest, response *recordedResponse) {
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+
+	if response != nil && response.status < http.StatusInternalServerError {
+		request.response = response
+	} else if recent.requests[request.key] == request {
+		delete(recent.requests, request.key)
+	}
+	close(request.done)
+}
+
+// recordingWriter is a http.ResponseWriter recording the response written to the caller up to max bytes
+type recordingWriter struct {
+	http.ResponseWriter
+	max       int
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+// newRecordingWriter creates a new recordingWriter
+func newRecordingWriter(w http.ResponseWriter, max int) (rw *recordingWriter) {
+	rw = new(recordingWriter)
+	rw.ResponseWriter = w
+	rw.max = max
+	rw.status = http.StatusOK
+	return
+}
+
+// WriteHeader records the status code and headers and writes them
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.header = rw.Header().Clone()
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the data and writes it
+func (rw *recordingWriter) Write(data []byte) (int, error) {
+	if rw.header == nil {
+		rw.header = rw.Header().Clone()
+	}
+	if !rw.truncated && rw.body.Len()+len(data) <= rw.max {
+		rw.body.Write(data)
+	} else {
+		rw.truncated = true
+		rw.body.Reset()
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+// Flush sends any buffered data to the caller if the underlying http.ResponseWriter supports it
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// response returns the recorded response or nil if it was too large
+func (rw *recordingWriter) response() *recordedResponse {
+	if rw.truncated {
+		return nil
+	}
+	return &recordedResponse{status: rw.status, header: rw.header, body: rw.body.Bytes()}
+}
+
+// duplicateKey returns the key identifying the duplicates of a request. A request id is only
+// unique to a caller, so the responses are never replayed to another caller or for another request.
+func (s *Server) duplicateKey(r *http.Request, id string) string {
+	return strings.Join([]string{s.callerIdentity(r), r.Method, r.URL.String(), id}, "\x00")
+}
+
+// checkDuplicate detects the duplicates of a recent request according to Config.DuplicateRequestAction.
+// It returns false if the request has been answered, otherwise the returned writer must be used
+// and the returned function called once the request is done.
+func (s *Server) checkDuplicate(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	noop := func() {}
+	if s.recentRequests == nil {
+		return w, noop, true
+	}
+	id := r.Header.Get(s.Config.RequestIDHeader)
+	if id == "" {
+		return w, noop, true
+	}
+
+	request, duplicate := s.recentRequests.add(s.duplicateKey(r, id))
+	if !duplicate {
+		rw := newRecordingWriter(w, s.Config.MaxDeduplicatedResponseSize)
+		return rw, func() { s.recentRequests.complete(request, rw.response()) }, true
+	}
+
+	if s.Config.DuplicateRequestAction == DuplicateRequestDeduplicate {
+		// Wait for the first request to answer with the same response
+		select {
+		case <-request.done:
+		case <-r.Context().Done():
+			return w, noop, false
+		}
+		if request.response != nil {
+			s.metrics.IncCounter(MetricDuplicateRequestsDeduplicated, nil)
+			request.response.write(w)
+			return w, noop, false
+		}
+	}
+
+	s.metrics.IncCounter(MetricDuplicateRequestsRejected, nil)
+	http.Error(w, "Duplicate request id "+id, http.StatusConflict)
+	return w, noop, false
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestDispatchDoesNotLeak(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+
+	request := func() {
+		r := httptest.NewRequest(http.MethodGet, "/request", nil)
+		r.Header.Set("X-PROXY-DESTINATION", upstream.URL)
+		w := httptest.NewRecorder()
+		s.Request(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		io.Copy(io.Discard, w.Body)
+	}
+
+	// The connections and keep-alive goroutines are up once a few requests went through
+	for i := 0; i < 10; i++ {
+		request()
+	}
+	baseline := runtime.NumGoroutine()
+
+	// Each dispatch releases its context and goroutines once done
+	for i := 0; i < 500; i++ {
+		request()
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= baseline+5 })
+
+	if inFlight := s.InFlightRequests(); len(inFlight) != 0 {
+		t.Errorf("got %d requests in flight once they are all done", len(inFlight))
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DispatchTimeoutHeader is the request header overriding the time to wait for a connection,
+// a Go duration ( e.g. 250ms ) clamped to Config.MaxDispatchTimeout
+const DispatchTimeoutHeader = "X-PROXY-TIMEOUT"
+
+// dispatchTimeout returns the time to wait for a connection to relay the request,
+// the DispatchTimeoutHeader of the caller or Config.Timeout for its method if it has none
+func (s *Server) dispatchTimeout(r *http.Request) (timeout time.Duration, err error) {
+	header := r.Header.Get(DispatchTimeoutHeader)
+	if header == "" || s.Config.MaxDispatchTimeout <= 0 {
+		return s.Config.GetMethodTimeout(r.Method), nil
+	}
+
+	timeout, err = time.ParseDuration(header)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s header %q", DispatchTimeoutHeader, header)
+	}
+	if max := s.Config.GetMaxDispatchTimeout(); timeout > max {
+		timeout = max
+	}
+	return timeout, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+// sourceIPCount returns the number of distinct source IPs of the pool connections
+// This MUST be surrounded by pool.lock.Lock()
+func (pool *Pool) sourceIPCount() int {
+	ips := make(map[string]struct{})
+	for _, connection := range pool.connections {
+		ips[connection.sourceIP] = struct{}{}
+	}
+	return len(ips)
+}
+
+// checkSourceDiversity warns when a pool declares a large size but its connections come from
+// too few hosts, which might be a misconfiguration or an attempt to monopolize the server.
+// The warning is logged once until the pool gets back to normal.
+func (s *Server) checkSourceDiversity(pool *Pool) {
+	if s.Config.DiversityCheckSize <= 0 {
+		return
+	}
+
+	pool.lock.Lock()
+	ips := pool.sourceIPCount()
+	size := pool.size
+	low := size >= s.Config.DiversityCheckSize && len(pool.connections) > 0 && ips < s.Config.MinSourceIPs
+	warn := low && !pool.lowDiversity
+	pool.lowDiversity = low
+	pool.lock.Unlock()
+
+	if warn {
+		s.logger.Warn("Pool connections come from too few source IPs", "pool_id", pool.id, "size", size, "source_ips", ips)
+		s.metrics.IncCounter(MetricLowSourceDiversity, s.poolLabels(pool))
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/root-gg/wsp"
+)
+
+// DrainStatus is the JSON document returned by the /admin/drain endpoint.
+// An orchestrator restarting the replicas one at a time begins the drain of a replica
+// then polls it until SafeToRestart is true.
+type DrainStatus struct {
+	Draining bool
+
+	// Requests being proxied and connections still open
+	InFlight    int
+	Connections int
+
+	// The replica passes its readiness check
+	Ready bool
+
+	// The replica is draining and has nothing left in flight
+	SafeToRestart bool
+}
+
+// isDraining returns true if the server stopped accepting requests and connections
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// BeginDrain stops accepting requests and connections and closes the idle connections so the clients
+// reconnect to another replica, busy connections are closed once their request is done.
+func (s *Server) BeginDrain() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	s.logger.Info("Draining")
+
+	// The connections are closed once the locks are released, closing them might take a while
+	var connections []*Connection
+	s.lock.RLock()
+	for _, pool := range s.pools {
+		pool.lock.RLock()
+		connections = append(connections, pool.connections...)
+		pool.lock.RUnlock()
+	}
+	s.lock.RUnlock()
+
+	closeConnections(connections, true, websocket.CloseGoingAway, "server draining")
+}
+
+// CancelDrain accepts requests and connections again
+func (s *Server) CancelDrain() {
+	if atomic.CompareAndSwapInt32(&s.draining, 1, 0) {
+		s.logger.Info("Drain canceled")
+	}
+}
+
+// DrainStatus returns whether the server is draining and what it still has in flight
+func (s *Server) DrainStatus() (status *DrainStatus) {
+	status = new(DrainStatus)
+	status.Draining = s.isDraining()
+
+	s.inFlight.lock.Lock()
+	status.InFlight = len(s.inFlight.requests)
+	s.inFlight.lock.Unlock()
+
+	s.lock.RLock()
+	for _, pool := range s.pools {
+		ps := pool.Size()
+		status.Connections += ps.Idle + ps.Busy + ps.LongLived
+	}
+	s.lock.RUnlock()
+
+	status.Ready = s.ready()
+	status.SafeToRestart = status.Draining && status.InFlight == 0 && status.Connections == 0
+	return
+}
+
+// adminDrain reports the drain status ( GET ), begins ( POST ) or cancels ( DELETE ) the drain of the server
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.BeginDrain()
+	case http.MethodDelete:
+		s.CancelDrain()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, s.DrainStatus())
+}
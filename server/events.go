@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// Log formats
+const (
+	// LogFormatText logs human readable lines through the standard logger
+	LogFormatText = "text"
+	// LogFormatJSON logs a single JSON object per line, with the fields of the event for the significant ones
+	LogFormatJSON = "json"
+)
+
+// Significant events of the server
+const (
+	EventRegister         = "register"
+	EventPoolCreated      = "pool_created"
+	EventPoolRemoved      = "pool_removed"
+	EventConnectionClosed = "connection_closed"
+	EventRequestStart     = "request_start"
+	EventUpstreamRequest  = "upstream_request"
+	EventRequestEnd       = "request_end"
+	EventRequestError     = "request_error"
+	EventAuthFailure      = "auth_failure"
+)
+
+// Event is a significant event of the server.
+// The events of a request share its RequestID and the events of a pool share its PoolID
+// so they can be joined in the log store.
+type Event struct {
+	Event       string
+	RequestID   string
+	PoolID      PoolID
+	Method      string
+	Destination string
+	Status      int
+	Duration    float64 // milliseconds
+	Error       string
+	SourceIP    string
+	KeyHash     string
+}
+
+// attrs returns the fields of the event as structured log attributes, leaving out the empty ones
+func (event Event) attrs() (attrs []any) {
+	attrs = append(attrs, slog.String("event", event.Event))
+	if event.RequestID != "" {
+		attrs = append(attrs, slog.String("request_id", event.RequestID))
+	}
+	if event.PoolID != "" {
+		attrs = append(attrs, slog.String("pool_id", string(event.PoolID)))
+	}
+	if event.Method != "" {
+		attrs = append(attrs, slog.String("method", event.Method))
+	}
+	if event.Destination != "" {
+		attrs = append(attrs, slog.String("destination", event.Destination))
+	}
+	if event.Status != 0 {
+		attrs = append(attrs, slog.Int("status", event.Status))
+	}
+	if event.Duration != 0 {
+		attrs = append(attrs, slog.Float64("duration_ms", event.Duration))
+	}
+	if event.Error != "" {
+		attrs = append(attrs, slog.String("error", event.Error))
+	}
+	if event.SourceIP != "" {
+		attrs = append(attrs, slog.String("source_ip", event.SourceIP))
+	}
+	if event.KeyHash != "" {
+		attrs = append(attrs, slog.String("key_hash", event.KeyHash))
+	}
+	return
+}
+
+// newLogger returns the default logger for the log format : JSON objects having the fields of the events
+// with the json log format, or human readable lines through the standard logger
+func newLogger(format string) *slog.Logger {
+	if format != LogFormatJSON {
+		return slog.Default()
+	}
+
+	options := new(slog.HandlerOptions)
+	options.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+		if len(groups) == 0 && attr.Key == slog.MessageKey {
+			attr.Key = "message"
+		}
+		return attr
+	}
+	return slog.New(slog.NewJSONHandler(log.Writer(), options))
+}
+
+// SetLogger sets the logger of the Server, nil restores the default one of Config.LogFormat.
+// It must be called before Start.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = newLogger(s.Config.LogFormat)
+	}
+	s.logger = logger
+}
+
+// logEvent logs the formatted message with the fields of the event as attributes,
+// the failures are logged as warnings
+func (s *Server) logEvent(event Event, format string, args ...interface{}) {
+	level := slog.LevelInfo
+	if event.Event == EventRequestError || event.Event == EventAuthFailure {
+		level = slog.LevelWarn
+	}
+	s.logger.Log(context.Background(), level, fmt.Sprintf(format, args...), event.attrs()...)
+}
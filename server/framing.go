@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// validateFraming rejects the requests whose body length could be understood differently
+// by the proxy and the upstream, which would let a caller smuggle a request ( conflicting
+// Content-Length and Transfer-Encoding, multiple Content-Length or unsupported Transfer-Encoding )
+func validateFraming(r *http.Request) error {
+	contentLengths := r.Header.Values("Content-Length")
+	if len(contentLengths) > 1 {
+		return fmt.Errorf("multiple Content-Length headers")
+	}
+	if len(contentLengths) == 1 {
+		if _, err := strconv.ParseUint(contentLengths[0], 10, 63); err != nil {
+			return fmt.Errorf("invalid Content-Length %q", contentLengths[0])
+		}
+	}
+
+	transferEncodings := append(r.Header.Values("Transfer-Encoding"), r.TransferEncoding...)
+	if len(transferEncodings) == 0 {
+		return nil
+	}
+	if len(contentLengths) > 0 {
+		return fmt.Errorf("both Content-Length and Transfer-Encoding headers")
+	}
+	for _, encoding := range transferEncodings {
+		if encoding != "chunked" {
+			return fmt.Errorf("unsupported Transfer-Encoding %q", encoding)
+		}
+	}
+	if len(r.TransferEncoding) > 1 {
+		return fmt.Errorf("multiple Transfer-Encoding")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateFraming(t *testing.T) {
+	tests := []struct {
+		name             string
+		contentLength    []string
+		transferEncoding []string
+		parsedEncodings  []string
+		valid            bool
+	}{
+		{name: "no body", valid: true},
+		{name: "content length", contentLength: []string{"5"}, valid: true},
+		{name: "chunked", parsedEncodings: []string{"chunked"}, valid: true},
+		{name: "multiple content lengths", contentLength: []string{"5", "6"}},
+		{name: "negative content length", contentLength: []string{"-1"}},
+		{name: "invalid content length", contentLength: []string{"5, 6"}},
+		{name: "content length and transfer encoding", contentLength: []string{"5"}, transferEncoding: []string{"chunked"}},
+		{name: "unsupported transfer encoding", transferEncoding: []string{"gzip"}},
+		{name: "obfuscated transfer encoding", transferEncoding: []string{"chunked "}},
+		{name: "multiple transfer encodings", parsedEncodings: []string{"chunked", "chunked"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/request", nil)
+			r.Header["Content-Length"] = test.contentLength
+			r.Header["Transfer-Encoding"] = test.transferEncoding
+			r.TransferEncoding = test.parsedEncodings
+
+			err := validateFraming(r)
+			if test.valid && err != nil {
+				t.Errorf("got error %q for a valid request", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("got no error for an ambiguous request")
+			}
+		})
+	}
+}
+
+func TestSmugglingPayloads(t *testing.T) {
+	// The upstream records the requests reaching it with an ambiguous framing
+	var ambiguous int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Values("Content-Length")) > 1 || (r.Header.Get("Content-Length") != "" && len(r.TransferEncoding) > 0) {
+			atomic.AddInt32(&ambiguous, 1)
+		}
+	}))
+	defer upstream.Close()
+
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+
+	// Known smuggling payloads are rejected by Go's HTTP server or by the proxy,
+	// except CL.TE whose Content-Length Go's HTTP server drops to process the chunked body as the RFC says
+	headers := "POST /request HTTP/1.1\r\nHost: wsp\r\nX-PROXY-DESTINATION: " + upstream.URL + "\r\n"
+	tests := []struct {
+		name     string
+		payload  string
+		rejected bool
+	}{
+		{name: "CL.CL", payload: headers + "Content-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", rejected: true},
+		{name: "CL.TE", payload: headers + "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", rejected: false},
+		{name: "TE.TE", payload: headers + "Transfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n", rejected: true},
+		{name: "TE obfuscated", payload: headers + "Transfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", rejected: true},
+		{name: "TE list", payload: headers + "Transfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", rejected: true},
+		{name: "CL invalid", payload: headers + "Content-Length: +5\r\n\r\nhello", rejected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Write([]byte(test.payload)); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("unable to read the response : %s", err)
+			}
+			resp.Body.Close()
+			if rejected := resp.StatusCode >= 400; rejected != test.rejected {
+				t.Errorf("got status %d, want rejected %v", resp.StatusCode, test.rejected)
+			}
+		})
+	}
+
+	if got := atomic.LoadInt32(&ambiguous); got != 0 {
+		t.Errorf("%d requests reached the upstream with an ambiguous framing", got)
+	}
+}
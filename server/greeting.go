@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// maxGreetingSize bounds the size of the greeting message read from the peer (bytes)
+const maxGreetingSize = 4096
+
+// handshakeDeadline returns the time by which the register handshake started at start must be done,
+// zero if Config.RegisterHandshakeTimeout is 0
+func (s *Server) handshakeDeadline(start time.Time) time.Time {
+	if s.Config.RegisterHandshakeTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(s.Config.GetRegisterHandshakeTimeout())
+}
+
+// isTimeout returns true if the error is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseGreeting parses the wsp.GreetingMessage of the peer, or the legacy greeting of protocol version 1 clients
+// if it is not JSON. The weight is 0 if not advertised.
+func parseGreeting(greeting string) (message *wsp.GreetingMessage, err error) {
+	message = new(wsp.GreetingMessage)
+	if json.Unmarshal([]byte(greeting), message) != nil {
+		id, size, weight, err := parseLegacyGreeting(greeting)
+		if err != nil {
+			return nil, err
+		}
+		return &wsp.GreetingMessage{ProtocolVersion: 1, ID: string(id), Size: size, Weight: weight}, nil
+	}
+
+	if message.ProtocolVersion < wsp.MinProtocolVersion || message.ProtocolVersion > wsp.MaxProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, supported versions are %d to %d",
+			message.ProtocolVersion, wsp.MinProtocolVersion, wsp.MaxProtocolVersion)
+	}
+	if message.ID == "" {
+		return nil, fmt.Errorf("missing pool id in greeting")
+	}
+	if message.Size < 0 {
+		return nil, fmt.Errorf("invalid pool size %d in greeting", message.Size)
+	}
+	if message.Weight < 0 {
+		return nil, fmt.Errorf("invalid pool weight %d in greeting", message.Weight)
+	}
+
+	return message, nil
+}
+
+// parseLegacyGreeting parses the "<id>_<size>[:<weight>]" greeting message of the peer, weight is 0 if not advertised.
+// The size follows the last underscore so that pool ids can contain underscores.
+func parseLegacyGreeting(greeting string) (id PoolID, size int, weight int, err error) {
+	i := strings.LastIndex(greeting, "_")
+	if i < 0 {
+		return "", 0, 0, fmt.Errorf("missing pool size in greeting")
+	}
+	if i == 0 {
+		return "", 0, 0, fmt.Errorf("missing pool id in greeting")
+	}
+
+	sizeAndWeight := greeting[i+1:]
+	if s, w, ok := strings.Cut(sizeAndWeight, ":"); ok {
+		sizeAndWeight = s
+		weight, err = strconv.Atoi(w)
+		if err != nil || weight <= 0 {
+			return "", 0, 0, fmt.Errorf("invalid pool weight %q in greeting", w)
+		}
+	}
+
+	size, err = strconv.Atoi(sizeAndWeight)
+	if err != nil || size < 0 {
+		return "", 0, 0, fmt.Errorf("invalid pool size %q in greeting", sizeAndWeight)
+	}
+
+	return PoolID(greeting[:i]), size, weight, nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestRegisterHandshakeTimeout(t *testing.T) {
+	config := NewConfig()
+	config.RegisterHandshakeTimeout = 200
+	s, ts := newTestServer(t, config)
+
+	// A peer stalling after the upgrade without sending its greeting is dropped once the handshake times out
+	ws, _, err := websocket.DefaultDialer.Dial(registerURL(ts), nil)
+	if err != nil {
+		t.Fatalf("unable to dial the test server : %s", err)
+	}
+	defer ws.Close()
+
+	start := time.Now()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("got a message from the server, want the connection closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the stalled handshake has been dropped after %s, want about 200ms", elapsed)
+	}
+	if got := connectionCount(s, "pool"); got != 0 {
+		t.Errorf("got %d connections registered, want none", got)
+	}
+
+	// A peer greeting in time registers
+	dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+
+	// The deadline only bounds the handshake, the registered connection outlives it
+	time.Sleep(400 * time.Millisecond)
+	if got := connectionCount(s, "pool"); got != 1 {
+		t.Errorf("got %d connections once the handshake deadline passed, want the registered one to stay", got)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Actions when the response headers exceed Config.MaxResponseHeaderCount or Config.MaxRelayedResponseHeaderSize
+const (
+	// HeaderLimitTruncate drops the headers over the limits and logs a warning
+	HeaderLimitTruncate = "truncate"
+	// HeaderLimitReject fails the request with a 502
+	HeaderLimitReject = "reject"
+)
+
+// limitResponseHeader enforces the response header count and size limits before the headers are written to the caller.
+// The size of a header value is len(name) + len(value). Headers are considered in name order so truncation is stable.
+func (s *Server) limitResponseHeader(header http.Header) (http.Header, error) {
+	maxCount := s.Config.MaxResponseHeaderCount
+	maxSize := s.Config.MaxRelayedResponseHeaderSize
+	if maxCount <= 0 && maxSize <= 0 {
+		return header, nil
+	}
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	limited := make(http.Header)
+	count, size, dropped := 0, 0, 0
+	for _, name := range names {
+		for _, value := range header[name] {
+			if (maxCount > 0 && count+1 > maxCount) || (maxSize > 0 && size+len(name)+len(value) > maxSize) {
+				dropped++
+				continue
+			}
+			count++
+			size += len(name) + len(value)
+			limited[name] = append(limited[name], value)
+		}
+	}
+
+	if dropped == 0 {
+		return header, nil
+	}
+	// NewServer replaces an empty or unknown action with HeaderLimitReject
+	if s.responseHeaderLimitAction == HeaderLimitReject {
+		return nil, fmt.Errorf("%w : more than %d headers or %d bytes", errResponseHeaderTooLarge, maxCount, maxSize)
+	}
+
+	s.logger.Warn("Response headers exceed the limits", "dropped", dropped)
+	return limited, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestLimitResponseHeader(t *testing.T) {
+	header := http.Header{"A": {"1"}, "B": {"2"}, "C": {"3"}}
+
+	tests := []struct {
+		name    string
+		action  string
+		count   int
+		size    int
+		headers int
+		err     bool
+	}{
+		{name: "unlimited", action: HeaderLimitReject, headers: 3},
+		{name: "under the limits", action: HeaderLimitReject, count: 3, size: 6, headers: 3},
+		{name: "truncate over the count", action: HeaderLimitTruncate, count: 2, headers: 2},
+		{name: "truncate over the size", action: HeaderLimitTruncate, size: 4, headers: 2},
+		{name: "reject over the count", action: HeaderLimitReject, count: 2, err: true},
+		{name: "empty action rejects", action: "", count: 2, err: true},
+		{name: "unknown action rejects", action: "drop", count: 2, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			config.ResponseHeaderLimitAction = test.action
+			config.MaxResponseHeaderCount = test.count
+			config.MaxRelayedResponseHeaderSize = test.size
+			s := NewServer(config)
+
+			limited, err := s.limitResponseHeader(header)
+			if test.err {
+				if !errors.Is(err, errResponseHeaderTooLarge) {
+					t.Fatalf("got error %v, want %v", err, errResponseHeaderTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(limited) != test.headers {
+				t.Errorf("got %d headers, want %d", len(limited), test.headers)
+			}
+		})
+	}
+}
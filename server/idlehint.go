@@ -0,0 +1,69 @@
+package server
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// idleHintSample is the activity of a pool over one stats report interval
+type idleHintSample struct {
+	requests    int64
+	requestTime time.Duration
+}
+
+// updateIdleHint records the activity of the pool since the previous stats report
+// and computes the number of idle connections the client should keep open.
+//
+// The suggestion applies Little's law to the simple moving average of the activity
+// over the last Config.IdleHintWindow reports : the number of concurrent requests
+// to expect is the request rate multiplied by the mean request duration.
+func (pool *Pool) updateIdleHint(interval time.Duration, requests int64) int {
+	requestTime := time.Duration(atomic.LoadInt64(&pool.requestTime))
+	sample := idleHintSample{
+		requests:    requests - pool.reportedRequests,
+		requestTime: requestTime - pool.reportedRequestTime,
+	}
+	pool.reportedRequestTime = requestTime
+
+	pool.hintSamples = append(pool.hintSamples, sample)
+	if window := pool.server.Config.IdleHintWindow; len(pool.hintSamples) > window {
+		pool.hintSamples = pool.hintSamples[len(pool.hintSamples)-window:]
+	}
+
+	var total idleHintSample
+	for _, s := range pool.hintSamples {
+		total.requests += s.requests
+		total.requestTime += s.requestTime
+	}
+
+	hint := 0
+	if total.requests > 0 {
+		rate := float64(total.requests) / (interval.Seconds() * float64(len(pool.hintSamples)))
+		meanDuration := total.requestTime.Seconds() / float64(total.requests)
+		hint = int(math.Ceil(rate * meanDuration))
+	}
+
+	pool.lock.Lock()
+	pool.idleHint = hint
+	pool.lock.Unlock()
+
+	return hint
+}
+
+// sendIdleHint suggests to the client the number of idle connections to keep open
+func (pool *Pool) sendIdleHint(hint int) {
+	msg := wsp.NewControlMessage(wsp.ControlIdleHint)
+	msg.IdleHint = &wsp.IdleHint{TargetIdle: hint}
+	pool.sendOrDeferControlMessage(msg)
+}
+
+// IdleHint returns the latest number of idle connections suggested to the client
+func (pool *Pool) IdleHint() int {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.idleHint
+}
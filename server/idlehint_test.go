@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestIdleHintDeliveredOnRelease(t *testing.T) {
+	config := NewConfig()
+	config.IdleHintWindow = 3
+	s, ts := newTestServer(t, config)
+	ws := dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+	pool := s.getPool("pool")
+
+	// The saturated pool needs the hint the most
+	setStatus(pool, Busy)
+	pool.reportStats(time.Second)
+
+	pool.lock.RLock()
+	connection := pool.connections[0]
+	pool.lock.RUnlock()
+	connection.Release()
+
+	received := make(map[string]*wsp.ControlMessage)
+	for i := 0; i < 2; i++ {
+		msg := readControlMessage(t, ws)
+		received[msg.Type] = msg
+	}
+	if received[wsp.ControlPoolStats] == nil {
+		t.Error("the pool stats have not been delivered on release")
+	}
+	hint := received[wsp.ControlIdleHint]
+	if hint == nil || hint.IdleHint == nil {
+		t.Fatal("the idle hint has not been delivered on release")
+	}
+	if hint.IdleHint.TargetIdle != pool.IdleHint() {
+		t.Errorf("got an idle hint of %d, want %d", hint.IdleHint.TargetIdle, pool.IdleHint())
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// inFlightRequest is a request being proxied
+type inFlightRequest struct {
+	id          string
+	method      string
+	destination string
+	pool        PoolID
+	start       time.Time
+	cancel      context.CancelFunc
+}
+
+// InFlightRequest describes a request being proxied
+type InFlightRequest struct {
+	ID          string
+	Method      string
+	Destination string
+	Pool        PoolID
+	Elapsed     time.Duration
+}
+
+// inFlightRequests is the registry of the requests being proxied
+type inFlightRequests struct {
+	requests map[string]*inFlightRequest
+	lock     sync.Mutex
+}
+
+// newInFlightRequests creates a new inFlightRequests
+func newInFlightRequests() (registry *inFlightRequests) {
+	registry = new(inFlightRequests)
+	registry.requests = make(map[string]*inFlightRequest)
+	return
+}
+
+// newRequestID returns a unique id to correlate the events of a request
+func newRequestID() string {
+	uid, err := uuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	return uid.String()
+}
+
+// add registers a request and returns a context canceled when the request is canceled.
+// The returned function must be called to remove the request once it is done.
+func (registry *inFlightRequests) add(id string, method string, destination string, pool PoolID) (ctx context.Context, done func()) {
+	request := new(inFlightRequest)
+	request.id = id
+	request.method = method
+	request.destination = destination
+	request.pool = pool
+	request.start = time.Now()
+	ctx, request.cancel = context.WithCancel(context.Background())
+
+	registry.lock.Lock()
+	registry.requests[request.id] = request
+	registry.lock.Unlock()
+
+	done = func() {
+		registry.lock.Lock()
+		delete(registry.requests, request.id)
+		registry.lock.Unlock()
+		request.cancel()
+	}
+
+	return ctx, done
+}
+
+// InFlightRequests returns the requests being proxied, the oldest first
+func (s *Server) InFlightRequests() (requests []InFlightRequest) {
+	s.inFlight.lock.Lock()
+	defer s.inFlight.lock.Unlock()
+
+	now := time.Now()
+	requests = make([]InFlightRequest, 0, len(s.inFlight.requests))
+	for _, request := range s.inFlight.requests {
+		requests = append(requests, InFlightRequest{
+			ID:          request.id,
+			Method:      request.method,
+			Destination: request.destination,
+			Pool:        request.pool,
+			Elapsed:     now.Sub(request.start),
+		})
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Elapsed > requests[j].Elapsed })
+
+	return
+}
+
+// CancelRequest aborts the in-flight request with the given id, it returns false if there is none
+func (s *Server) CancelRequest(id string) bool {
+	s.inFlight.lock.Lock()
+	request, ok := s.inFlight.requests[id]
+	s.inFlight.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+	request.cancel()
+	return true
+}
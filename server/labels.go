@@ -0,0 +1,117 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PoolLabel is the metric label holding the pool id
+const PoolLabel = "pool"
+
+// OtherLabelValue replaces the label values over Config.MaxMetricLabelValues
+const OtherLabelValue = "other"
+
+// parseLabels parses the comma separated key=value labels of the LabelsHeader
+func parseLabels(header string) (labels map[string]string) {
+	for _, label := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(label, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || key == PoolLabel {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = strings.TrimSpace(value)
+	}
+	return
+}
+
+// metricLabelValues tracks the distinct values of each metric label to bound their cardinality
+type metricLabelValues struct {
+	max    int
+	values map[string]map[string]struct{}
+	lock   sync.Mutex
+}
+
+// newMetricLabelValues creates a new metricLabelValues allowing max distinct values per label (0 means unlimited)
+func newMetricLabelValues(max int) (lv *metricLabelValues) {
+	lv = new(metricLabelValues)
+	lv.max = max
+	lv.values = make(map[string]map[string]struct{})
+	return
+}
+
+// value returns the value if it is already known or there is room for it, OtherLabelValue otherwise
+func (lv *metricLabelValues) value(label string, value string) string {
+	if lv.max <= 0 || value == "" {
+		return value
+	}
+
+	lv.lock.Lock()
+	defer lv.lock.Unlock()
+
+	values, ok := lv.values[label]
+	if !ok {
+		values = make(map[string]struct{})
+		lv.values[label] = values
+	}
+	if _, ok := values[value]; ok {
+		return value
+	}
+	if len(values) >= lv.max {
+		return OtherLabelValue
+	}
+	values[value] = struct{}{}
+	return value
+}
+
+// MetricDefinitions returns the MetricDefinitions with the per-pool metrics labeled by MetricLabels
+// in place of PoolLabel, their other labels are kept
+func (c Config) MetricDefinitions() (definitions []MetricDefinition) {
+	for _, definition := range MetricDefinitions {
+		var labels []string
+		for _, label := range definition.Labels {
+			if label == PoolLabel {
+				labels = append(labels, c.MetricLabels...)
+			} else {
+				labels = append(labels, label)
+			}
+		}
+		if labels != nil {
+			sort.Strings(labels)
+		}
+		definition.Labels = labels
+		definitions = append(definitions, definition)
+	}
+	return
+}
+
+// BackendLabel is the label of the metrics reporting the backend of a client which served the request
+const BackendLabel = "backend"
+
+// backendLabels returns the labels of the per-backend metrics of a pool
+func (s *Server) backendLabels(pool *Pool, backend string) (labels Labels) {
+	labels = s.poolLabels(pool)
+	labels[BackendLabel] = s.metricLabelValues.value(BackendLabel, backend)
+	return
+}
+
+// poolLabels returns the labels of the per-pool metrics of a pool ( nil if the request failed before dispatch )
+func (s *Server) poolLabels(pool *Pool) (labels Labels) {
+	var clientLabels map[string]string
+	if pool != nil {
+		clientLabels = pool.Labels()
+	}
+
+	labels = make(Labels, len(s.Config.MetricLabels))
+	for _, label := range s.Config.MetricLabels {
+		value := clientLabels[label]
+		if label == PoolLabel && pool != nil {
+			value = string(pool.id)
+		}
+		labels[label] = s.metricLabelValues.value(label, value)
+	}
+	return
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+)
+
+// tcpListener tunes the TCP options of the accepted connections.
+//
+// Disabling TCP_NODELAY enables Nagle's algorithm which coalesces small writes :
+// better throughput for bulk transfers at the cost of latency for small requests.
+// Larger socket buffers help high bandwidth-delay links at the cost of memory per connection.
+type tcpListener struct {
+	net.Listener
+	config *Config
+	logger *slog.Logger
+}
+
+// newTCPListener wraps the listener to apply the TCP options of the configuration
+func newTCPListener(listener net.Listener, config *Config, logger *slog.Logger) net.Listener {
+	return &tcpListener{Listener: listener, config: config, logger: logger}
+}
+
+// Accept waits for the next connection and tunes it
+func (listener *tcpListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+
+	if err := tcpConn.SetNoDelay(listener.config.TCPNoDelay); err != nil {
+		listener.logger.Warn("Unable to set TCP_NODELAY", "error", err)
+	}
+	if listener.config.SocketSendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(listener.config.SocketSendBuffer); err != nil {
+			listener.logger.Warn("Unable to set SO_SNDBUF", "error", err)
+		}
+	}
+	if listener.config.SocketReceiveBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(listener.config.SocketReceiveBuffer); err != nil {
+			listener.logger.Warn("Unable to set SO_RCVBUF", "error", err)
+		}
+	}
+
+	return tcpConn, nil
+}
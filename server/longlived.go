@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isStreamingRequest returns true if the caller flagged the request as streaming.
+// This is the case for Server-Sent Events, protocol upgrades
+// and requests carrying an explicit X-PROXY-STREAMING header.
+func isStreamingRequest(r *http.Request) bool {
+	if r.Header.Get("X-PROXY-STREAMING") != "" {
+		return true
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	return false
+}
+
+// tryAcquire increments the counter unless it has already reached the limit.
+// A limit lower or equal to zero means unlimited.
+func tryAcquire(counter *int64, limit int) bool {
+	for {
+		current := atomic.LoadInt64(counter)
+		if limit > 0 && current >= int64(limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, current, current+1) {
+			return true
+		}
+	}
+}
+
+// longLivedRequest accounts a proxied request against the long-lived requests limits.
+//
+// A streaming request is accounted as soon as it starts and gets rejected if a limit is reached,
+// any other request is accounted once it has been running for more than Config.LongLivedThreshold.
+// As it is already running at that time it can't be rejected anymore but it still
+// reduces the capacity left for new streaming requests.
+type longLivedRequest struct {
+	server     *Server
+	connection *Connection
+
+	lock    sync.Mutex
+	counted bool
+	done    bool
+	timer   *time.Timer
+}
+
+// admitLongLivedRequest checks the global long-lived requests limit for streaming requests
+// before dispatching them, it returns false if the limit has been reached.
+func (s *Server) admitLongLivedRequest(streaming bool) bool {
+	if !streaming {
+		return true
+	}
+	return tryAcquire(&s.longLived, s.Config.MaxLongLivedRequests)
+}
+
+// newLongLivedRequest starts the long-lived accounting of a request proxied over the connection.
+// The request must have been admitted by admitLongLivedRequest.
+// It returns nil if the per pool long-lived requests limit has been reached.
+func (s *Server) newLongLivedRequest(connection *Connection, streaming bool) (llr *longLivedRequest) {
+	llr = new(longLivedRequest)
+	llr.server = s
+	llr.connection = connection
+
+	if streaming {
+		if !tryAcquire(&connection.pool.longLived, s.Config.MaxLongLivedRequestsPerPool) {
+			atomic.AddInt64(&s.longLived, -1)
+			return nil
+		}
+		llr.counted = true
+		connection.markLongLived()
+		return
+	}
+
+	if threshold := s.Config.GetLongLivedThreshold(); threshold > 0 {
+		llr.timer = time.AfterFunc(threshold, llr.promote)
+	}
+	return
+}
+
+// promote accounts a request that has been running for too long as long-lived
+func (llr *longLivedRequest) promote() {
+	llr.lock.Lock()
+	defer llr.lock.Unlock()
+
+	if llr.done {
+		return
+	}
+
+	atomic.AddInt64(&llr.server.longLived, 1)
+	atomic.AddInt64(&llr.connection.pool.longLived, 1)
+	llr.counted = true
+	llr.connection.markLongLived()
+}
+
+// finish removes the request from the long-lived accounting
+func (llr *longLivedRequest) finish() {
+	llr.lock.Lock()
+	defer llr.lock.Unlock()
+
+	llr.done = true
+	if llr.timer != nil {
+		llr.timer.Stop()
+	}
+	if llr.counted {
+		atomic.AddInt64(&llr.server.longLived, -1)
+		atomic.AddInt64(&llr.connection.pool.longLived, -1)
+		llr.counted = false
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a recurring time range during which the dispatcher stops routing requests to some pools
+// so that the clients can be updated.
+//
+// Start and End are "HH:MM" times in UTC, a window ending before it starts spans over midnight.
+// Days restricts the window to some days of the week ( "monday", "tuesday", ... ), every day if empty.
+// Pools lists the identifiers of the pools in maintenance, every pool if empty.
+type MaintenanceWindow struct {
+	Name  string
+	Pools []PoolID
+	Days  []string
+	Start string
+	End   string
+
+	start time.Duration
+	end   time.Duration
+	days  map[time.Weekday]bool
+}
+
+// Compile parses the window times and days
+func (window *MaintenanceWindow) Compile() (err error) {
+	if window.start, err = parseTimeOfDay(window.Start); err != nil {
+		return fmt.Errorf("invalid maintenance window %q start : %w", window.Name, err)
+	}
+	if window.end, err = parseTimeOfDay(window.End); err != nil {
+		return fmt.Errorf("invalid maintenance window %q end : %w", window.Name, err)
+	}
+
+	window.days = make(map[time.Weekday]bool)
+	for _, day := range window.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid maintenance window %q day : %q", window.Name, day)
+		}
+		window.days[weekday] = true
+	}
+
+	return
+}
+
+// IsActive returns true if the window is active at the given time
+func (window *MaintenanceWindow) IsActive(now time.Time) bool {
+	now = now.UTC()
+	if len(window.days) > 0 && !window.days[now.Weekday()] {
+		return false
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	timeOfDay := now.Sub(midnight)
+	if window.start <= window.end {
+		return timeOfDay >= window.start && timeOfDay < window.end
+	}
+	return timeOfDay >= window.start || timeOfDay < window.end
+}
+
+// Affects returns true if the pool is in the scope of this window
+func (window *MaintenanceWindow) Affects(id PoolID) bool {
+	if len(window.Pools) == 0 {
+		return true
+	}
+	for _, pool := range window.Pools {
+		if pool == id {
+			return true
+		}
+	}
+	return false
+}
+
+// inMaintenance returns true if the pool is in an active maintenance window
+func (s *Server) inMaintenance(id PoolID, now time.Time) bool {
+	for _, window := range s.Config.MaintenanceWindows {
+		if window.Affects(id) && window.IsActive(now) {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseTimeOfDay parses a "HH:MM" time to the duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import "net/http"
+
+// MetricType is the kind of a metric emitted through Metrics
+type MetricType int
+
+const (
+	// Counter is a monotonically increasing value
+	Counter MetricType = iota
+	// Histogram is a distribution of observed values
+	Histogram
+)
+
+// Names of the metrics emitted through Metrics
+const (
+	MetricRequests              = "wsp_requests_total"
+	MetricRequestErrors         = "wsp_request_errors_total"
+	MetricDispatchWait          = "wsp_dispatch_wait_seconds"
+	MetricTakeFailures          = "wsp_take_failures_total"
+	MetricConnectionsRegistered = "wsp_connections_registered_total"
+	MetricPoolsCreated          = "wsp_pools_created_total"
+	MetricPoolsRemoved          = "wsp_pools_removed_total"
+	MetricMirrorRequests        = "wsp_mirror_requests_total"
+	MetricMirrorErrors          = "wsp_mirror_errors_total"
+	MetricMirrorDropped         = "wsp_mirror_requests_dropped_total"
+	MetricLowSourceDiversity    = "wsp_low_source_diversity_total"
+
+	MetricDispatchWaitSLOViolations = "wsp_dispatch_wait_slo_violations_total"
+
+	MetricBackendRequests = "wsp_backend_requests_total"
+
+	MetricAffinityHits   = "wsp_connection_affinity_hits_total"
+	MetricAffinityMisses = "wsp_connection_affinity_misses_total"
+
+	MetricDuplicateRequestsDeduplicated = "wsp_duplicate_requests_deduplicated_total"
+	MetricDuplicateRequestsRejected     = "wsp_duplicate_requests_rejected_total"
+
+	MetricAuthFailures = "wsp_auth_failures_total"
+	MetricAuthBans     = "wsp_auth_bans_total"
+
+	MetricControlMessagesDeferred = "wsp_control_messages_deferred_total"
+)
+
+// Labels are the label values of a metric keyed by label name
+type Labels map[string]string
+
+// MetricDefinition describes a metric emitted through Metrics
+type MetricDefinition struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels []string
+}
+
+// MetricDefinitions lists every metric emitted through Metrics with its label set.
+// Names and labels are part of the Metrics contract, metrics backends can rely on them being stable.
+// The per-pool metrics are labeled by pool unless Config.MetricLabels is set, see Config.MetricDefinitions.
+var MetricDefinitions = []MetricDefinition{
+	{MetricRequests, "Number of requests proxied to a pool.", Counter, []string{PoolLabel}},
+	{MetricRequestErrors, "Number of requests which failed, pool is empty if it failed before dispatch.", Counter, []string{PoolLabel}},
+	{MetricDispatchWait, "Time spent waiting for a connection to be dispatched in seconds.", Histogram, nil},
+	{MetricTakeFailures, "Number of dispatched connections which could not be taken.", Counter, []string{PoolLabel}},
+	{MetricConnectionsRegistered, "Number of connections registered to a pool.", Counter, []string{PoolLabel}},
+	{MetricPoolsCreated, "Number of pools created.", Counter, nil},
+	{MetricPoolsRemoved, "Number of pools removed.", Counter, nil},
+	{MetricMirrorRequests, "Number of requests mirrored successfully to a pool.", Counter, []string{PoolLabel}},
+	{MetricMirrorErrors, "Number of mirrored requests which failed, pool is empty if no mirror connection was available.", Counter, []string{PoolLabel}},
+	{MetricMirrorDropped, "Number of sampled requests not mirrored as too many mirrored requests were in flight.", Counter, nil},
+	{MetricLowSourceDiversity, "Number of times a pool was found with connections from too few source IPs for its size.", Counter, []string{PoolLabel}},
+	{MetricDispatchWaitSLOViolations, "Number of times the dispatch wait SLO got violated.", Counter, nil},
+	{MetricBackendRequests, "Number of requests served by each backend of the clients distributing them across several.", Counter, []string{PoolLabel, BackendLabel}},
+	{MetricAffinityHits, "Number of requests proxied through a connection which last served the same destination host.", Counter, []string{PoolLabel}},
+	{MetricAffinityMisses, "Number of requests for which no idle connection of the pool last served the destination host.", Counter, []string{PoolLabel}},
+	{MetricDuplicateRequestsDeduplicated, "Number of duplicate requests answered with the response of the first request.", Counter, nil},
+	{MetricDuplicateRequestsRejected, "Number of duplicate requests rejected.", Counter, nil},
+	{MetricAuthFailures, "Number of WSP client registrations rejected for an invalid secret key.", Counter, nil},
+	{MetricAuthBans, "Number of source IPs banned after repeated authentication failures.", Counter, nil},
+	{MetricControlMessagesDeferred, "Number of control messages deferred to the next released connection as no connection of the pool was idle.", Counter, []string{PoolLabel}},
+}
+
+// Metrics receives the key events of the Server so they can be exported to any metrics backend.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncCounter increments the counter by one
+	IncCounter(name string, labels Labels)
+	// ObserveHistogram records a value in the histogram
+	ObserveHistogram(name string, labels Labels, value float64)
+}
+
+// NoopMetrics is the default Metrics which discards everything
+type NoopMetrics struct{}
+
+// IncCounter does nothing
+func (NoopMetrics) IncCounter(name string, labels Labels) {}
+
+// ObserveHistogram does nothing
+func (NoopMetrics) ObserveHistogram(name string, labels Labels, value float64) {}
+
+// SetMetrics sets the Metrics backend of the Server, nil restores the default no-op one.
+// It must be called before Start.
+func (s *Server) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	s.metrics = metrics
+}
+
+// SetMetricsHandler serves the handler on /metrics ( e.g. a Prometheus handler ), nil serves nothing.
+// It must be called before Start.
+func (s *Server) SetMetricsHandler(handler http.Handler) {
+	s.metricsHandler = handler
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/root-gg/wsp"
+)
+
+// parseEligiblePools parses the comma separated list of pool ids of the EligiblePoolsHeader
+func parseEligiblePools(header string) (pools []PoolID) {
+	for _, id := range strings.Split(header, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			pools = append(pools, PoolID(id))
+		}
+	}
+	return
+}
+
+// MigrateConnections moves the idle connections of a pool to another pool they are eligible for
+// rather than closing them, this avoids the clients reconnecting when a pool is drained.
+// Each connection moves to its eligible pool having the fewest idle connections.
+// It returns the number of migrated connections.
+func (s *Server) MigrateConnections(id PoolID) (migrated int) {
+	if !s.Config.AllowConnectionMigration {
+		return 0
+	}
+
+	// Migrations lock two pools, serialize them to avoid lock order inversions
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var from *Pool
+	pools := make(map[PoolID]*Pool)
+	for _, pool := range s.pools {
+		pools[pool.id] = pool
+		if pool.id == id {
+			from = pool
+		}
+	}
+	if from == nil {
+		return 0
+	}
+
+	from.lock.RLock()
+	connections := make([]*Connection, len(from.connections))
+	copy(connections, from.connections)
+	from.lock.RUnlock()
+
+	for _, connection := range connections {
+		var to *Pool
+		toIdle := 0
+		for _, eligible := range connection.eligiblePools {
+			pool, ok := pools[eligible]
+			if !ok || pool == from {
+				continue
+			}
+			if idle := pool.Size().Idle; to == nil || idle < toIdle {
+				to, toIdle = pool, idle
+			}
+		}
+		if to == nil {
+			continue
+		}
+
+		if connection.migrate(from, to) {
+			s.logger.Info("Migrated connection", "from", from.id, "to", to.id)
+			migrated++
+		}
+	}
+
+	return
+}
+
+// migrate moves an idle connection from a pool to another one
+func (connection *Connection) migrate(from *Pool, to *Pool) bool {
+	// Take the connection so that it can't be dispatched meanwhile,
+	// this withdraws its pending offer in the previous pool
+	if !connection.takeFrom(from) {
+		return false
+	}
+
+	from.lock.Lock()
+	var connections []*Connection
+	for _, c := range from.connections {
+		if c != connection {
+			connections = append(connections, c)
+		}
+	}
+	from.connections = connections
+	from.lock.Unlock()
+
+	to.lock.Lock()
+	if to.done {
+		to.lock.Unlock()
+		connection.Close()
+		return false
+	}
+	connection.lock.Lock()
+	connection.pool = to
+	connection.lock.Unlock()
+	to.connections = append(to.connections, connection)
+	to.lock.Unlock()
+
+	// Offer the connection in its new pool
+	connection.Release()
+	return true
+}
+
+// adminMigrate migrates the idle connections of a pool ( POST ?pool= )
+func (s *Server) adminMigrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	if !s.Config.AllowConnectionMigration {
+		wsp.ProxyErrorStatusf(w, http.StatusForbidden, "Connection migration is disabled")
+		return
+	}
+
+	migrated := s.MigrateConnections(PoolID(r.URL.Query().Get("pool")))
+	writeJSON(w, map[string]int{"Migrated": migrated})
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// minIdleRequestInterval is the minimum time between two requests to open connections sent to a pool,
+// the client needs a moment to open the connections before the idle count reflects them
+const minIdleRequestInterval = time.Second
+
+// checkMinIdle asks the peer to open connections if the pool has less than Config.MinIdle idle connections.
+// The request never brings the pool above its declared size and needs an idle connection to be sent over.
+func (pool *Pool) checkMinIdle() {
+	minIdle := pool.server.Config.MinIdle
+	if minIdle <= 0 {
+		return
+	}
+
+	pool.lock.Lock()
+	ps := pool.getSize()
+	now := time.Now()
+	target := minIdle
+	if target > pool.size {
+		target = pool.size
+	}
+	count := target - ps.Idle
+	if count <= 0 || now.Sub(pool.openRequested) < minIdleRequestInterval {
+		pool.lock.Unlock()
+		return
+	}
+	pool.openRequested = now
+	pool.lock.Unlock()
+
+	msg := wsp.NewControlMessage(wsp.ControlOpenConnections)
+	msg.OpenConnections = &wsp.OpenConnections{Count: count}
+	pool.sendControlMessage(msg)
+}
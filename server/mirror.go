@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Mirror shadows a sample of the requests to the pools having all the given labels,
+// to test a new client fleet against production traffic. The mirrored responses are discarded
+// and the mirror pools don't serve the primary requests.
+type Mirror struct {
+	Labels     map[string]string
+	SampleRate float64 // Ratio of the requests to mirror, between 0 and 1
+
+	// Requests with a body larger than MaxBodySize are not mirrored (bytes)
+	MaxBodySize int
+
+	// Maximum number of requests mirrored at once, the sampled requests are not mirrored beyond it
+	MaxConcurrent int
+}
+
+// defaultMirrorMaxBodySize is the MaxBodySize of a Mirror not setting it
+const defaultMirrorMaxBodySize = 1 << 20 // 1 MB
+
+// defaultMirrorMaxConcurrent is the MaxConcurrent of a Mirror not setting it
+const defaultMirrorMaxConcurrent = 100
+
+// Compile validates the mirror configuration
+func (mirror *Mirror) Compile() error {
+	if len(mirror.Labels) == 0 {
+		return fmt.Errorf("mirror labels are required")
+	}
+	if mirror.SampleRate < 0 || mirror.SampleRate > 1 {
+		return fmt.Errorf("invalid mirror sample rate %v", mirror.SampleRate)
+	}
+	if mirror.MaxBodySize <= 0 {
+		mirror.MaxBodySize = defaultMirrorMaxBodySize
+	}
+	if mirror.MaxConcurrent <= 0 {
+		mirror.MaxConcurrent = defaultMirrorMaxConcurrent
+	}
+	return nil
+}
+
+// getMaxConcurrent returns the maximum number of requests mirrored at once
+func (mirror *Mirror) getMaxConcurrent() int {
+	if mirror.MaxConcurrent <= 0 {
+		return defaultMirrorMaxConcurrent
+	}
+	return mirror.MaxConcurrent
+}
+
+// Matches returns true if the pool has all the labels of the mirror
+func (mirror *Mirror) Matches(pool *Pool) bool {
+	labels := pool.Labels()
+	for key, value := range mirror.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// isMirrorPool returns true if the pool only receives mirrored requests
+func (s *Server) isMirrorPool(pool *Pool) bool {
+	return s.Config.Mirror != nil && s.Config.Mirror.Matches(pool)
+}
+
+// mirrorRequest returns a copy of a sampled request to send to the mirror pools or nil.
+// The body of a mirrored request is buffered so that it can be sent twice.
+// A mirrored request holds a slot of Mirror.MaxConcurrent until relayMirror is done with it,
+// the sampled requests are dropped while every slot is held.
+func (s *Server) mirrorRequest(r *http.Request) *http.Request {
+	mirror := s.Config.Mirror
+	if mirror == nil || rand.Float64() >= mirror.SampleRate {
+		return nil
+	}
+
+	select {
+	case s.mirrors <- struct{}{}:
+	default:
+		s.metrics.IncCounter(MetricMirrorDropped, nil)
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(mirror.MaxBodySize)+1))
+	if err != nil || len(body) > mirror.MaxBodySize {
+		// Give the primary request back what has already been read
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		<-s.mirrors
+		return nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mirrored := r.Clone(context.Background())
+	mirrored.Body = io.NopCloser(bytes.NewReader(body))
+	return mirrored
+}
+
+// relayMirror sends a mirrored request to a mirror pool and discards the response.
+// It never affects the primary request.
+func (s *Server) relayMirror(r *http.Request, requestID string) {
+	defer func() { <-s.mirrors }()
+
+	connection := s.takeMirrorConnection(s.Config.GetTimeout())
+	if connection == nil {
+		s.metrics.IncCounter(MetricMirrorErrors, s.poolLabels(nil))
+		return
+	}
+
+	labels := s.poolLabels(connection.pool)
+	if !r.URL.IsAbs() && connection.pool.BaseURL() != nil {
+		r.URL = connection.pool.destination(r.URL)
+	}
+	sw := newStatusWriter(newDiscardWriter())
+	if err := connection.proxyRequest(sw, r, requestID, nil); err != nil {
+		s.logger.Warn("Unable to mirror request", "request_id", requestID, "pool_id", connection.pool.id, "error", err)
+		// A rejected response has been drained and the connection released
+		if !errors.Is(err, errUpstreamResponse) {
+			connection.Close()
+		}
+		s.metrics.IncCounter(MetricMirrorErrors, labels)
+		return
+	}
+	if sw.status >= http.StatusInternalServerError {
+		s.metrics.IncCounter(MetricMirrorErrors, labels)
+		return
+	}
+	s.metrics.IncCounter(MetricMirrorRequests, labels)
+}
+
+// takeMirrorConnection takes an idle connection of a mirror pool, it returns nil after timeout
+// or right away if there is no mirror pool
+func (s *Server) takeMirrorConnection(timeout time.Duration) *Connection {
+	s.lock.RLock()
+	var pools []*Pool
+	for _, pool := range s.pools {
+		if s.isMirrorPool(pool) {
+			pools = append(pools, pool)
+		}
+	}
+	s.lock.RUnlock()
+	if len(pools) == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// An idle connection always has a pending offer on the pool idle channel,
+	// wait for the first offer of any mirror pool
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.done)},
+	}
+	for _, pool := range pools {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(pool.idle)})
+	}
+	for {
+		chosen, value, _ := reflect.Select(cases)
+		if chosen < 2 {
+			return nil
+		}
+		connection := value.Interface().(*Connection)
+		if connection.takeFrom(pools[chosen-2]) {
+			return connection
+		}
+	}
+}
+
+// discardWriter is a http.ResponseWriter discarding the mirrored responses
+type discardWriter struct {
+	header http.Header
+}
+
+// newDiscardWriter creates a new discardWriter
+func newDiscardWriter() (w *discardWriter) {
+	w = new(discardWriter)
+	w.header = make(http.Header)
+	return
+}
+
+// Header returns the discarded headers
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+// Write discards the data
+func (w *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+// WriteHeader discards the status code
+func (w *discardWriter) WriteHeader(status int) {}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// newMirrorTestServer returns a test server mirroring every request to a pool with a single connection
+func newMirrorTestServer(t *testing.T, maxConcurrent int) (*Server, *Pool) {
+	t.Helper()
+
+	config := NewConfig()
+	config.Mirror = &Mirror{Labels: map[string]string{"fleet": "canary"}, SampleRate: 1, MaxConcurrent: maxConcurrent}
+	if err := config.Mirror.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestServer(t, config)
+	dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "mirror", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "mirror") == 1 })
+
+	pool := s.getPool("mirror")
+	pool.setLabels(map[string]string{"fleet": "canary"})
+	return s, pool
+}
+
+func TestTakeMirrorConnectionWithoutMirrorPool(t *testing.T) {
+	config := NewConfig()
+	config.Mirror = &Mirror{Labels: map[string]string{"fleet": "canary"}, SampleRate: 1}
+	s := NewServer(config)
+
+	start := time.Now()
+	if connection := s.takeMirrorConnection(5 * time.Second); connection != nil {
+		t.Fatal("got a mirror connection without mirror pool")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s without mirror pool, want to give up right away", elapsed)
+	}
+}
+
+func TestTakeMirrorConnectionWaitsForRelease(t *testing.T) {
+	s, _ := newMirrorTestServer(t, 0)
+
+	first := s.takeMirrorConnection(time.Second)
+	if first == nil {
+		t.Fatal("got no mirror connection from the idle pool")
+	}
+	if connection := s.takeMirrorConnection(50 * time.Millisecond); connection != nil {
+		t.Fatal("got a mirror connection while the only one is busy")
+	}
+
+	taken := make(chan *Connection, 1)
+	go func() { taken <- s.takeMirrorConnection(5 * time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	first.Release()
+
+	select {
+	case connection := <-taken:
+		if connection != first {
+			t.Fatal("got another mirror connection than the released one")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the released connection has not been taken")
+	}
+}
+
+func TestMirrorRequestMaxConcurrent(t *testing.T) {
+	s, _ := newMirrorTestServer(t, 2)
+
+	var mirrored []*http.Request
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest(http.MethodPost, "http://upstream/", strings.NewReader("body"))
+		if m := s.mirrorRequest(r); m != nil {
+			mirrored = append(mirrored, m)
+		}
+	}
+	if len(mirrored) != 2 {
+		t.Fatalf("got %d mirrored requests, want 2 as many as MaxConcurrent", len(mirrored))
+	}
+
+	// A slot is given back once a mirrored request is done
+	<-s.mirrors
+	r, _ := http.NewRequest(http.MethodPost, "http://upstream/", strings.NewReader("body"))
+	if s.mirrorRequest(r) == nil {
+		t.Fatal("got no mirrored request once a slot has been given back")
+	}
+}
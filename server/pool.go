@@ -1,25 +1,91 @@
 package server
 
 import (
-	"log"
+	"fmt"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
 )
 
 // Pool handles all connections from the peer.
 type Pool struct {
+	// Number of long-lived requests in flight ( atomic, keep it first for 64-bit alignment )
+	longLived int64
+	// Number of requests proxied through the pool ( atomic )
+	requests int64
+
+	// Total time spent proxying requests in nanoseconds ( atomic )
+	requestTime int64
+	// Number of failed requests and of response body bytes relayed to the callers ( atomic )
+	errors       int64
+	bytesRelayed int64
+	// Time of the last request completed through the pool in unix nanoseconds,
+	// the registration time until then ( atomic )
+	lastActivity int64
+
+	// Activity at the time of the previous stats report
+	reportedRequests    int64
+	reportedRequestTime time.Duration
+
+	// Recent activity used to compute the idle connections hint
+	hintSamples []idleHintSample
+	idleHint    int
+
+	// Latest control message of each type that found no idle connection, sent over the next released one
+	deferredControl     map[string]*wsp.ControlMessage
+	deferredControlLock sync.Mutex
+
+	// Moving average of the request outcomes
+	successRate       float64
+	successRateUpdate time.Time
+
 	server *Server
 	id     PoolID
 
 	size int
+	// Relative capacity advertised by the client, 0 if none
+	weight int
+	// Maximum number of connections advertised by the client, 0 if unlimited
+	maxConnections int
+	// Only serve requests when no active pool has an idle connection
+	standby bool
+
+	// Labels and upstream base URL advertised by the client
+	labels  map[string]string
+	baseURL *url.URL
+
+	// The connections of the pool come from too few source IPs for its size
+	lowDiversity bool
+
+	// Time of the last request to open connections sent to the peer
+	openRequested time.Time
+
+	// Time since the pool has no connection, zero if it has some ( it MUST be accessed with server.lock )
+	emptySince time.Time
+
+	// Operator override of the maximum time to relay a request (0 for no timeout)
+	proxyTimeout time.Duration
+	// Operator override of the time to wait for a connection of the pool (0 for the default)
+	dispatchTimeout time.Duration
 
 	connections []*Connection
 	idle        chan *Connection
 
 	done bool
 	lock sync.RWMutex
+
+	// The pool shuts down gracefully ( atomic ), its connections are closed with this code and reason once released
+	shuttingDown   int32
+	shutdownCode   int
+	shutdownReason string
+
+	// Timer closing the connections still busy once the graceful shutdown times out ( it MUST be accessed with pool.lock )
+	shutdownTimer *time.Timer
 }
 
 // PoolID represents the identifier of the connected WebSocket client.
@@ -31,30 +97,74 @@ func NewPool(server *Server, id PoolID) *Pool {
 	p.server = server
 	p.id = id
 	p.idle = make(chan *Connection)
+	p.successRate = 1
+	p.lastActivity = time.Now().UnixNano()
 	return p
 }
 
-// Register creates a new Connection and adds it to the pool
-func (pool *Pool) Register(ws *websocket.Conn) {
+// ID returns the identifier of the pool
+func (pool *Pool) ID() PoolID {
+	return pool.id
+}
+
+// Register creates a new Connection from the source IP with the greeting of the peer and adds it to the pool.
+// It returns false and closes the websocket if the pool has been shut down
+// or already has the maximum number of connections advertised by the greeting.
+func (pool *Pool) Register(ws *websocket.Conn, sourceIP string, eligiblePools []PoolID, greeting *wsp.GreetingMessage) bool {
+	registered, rejected := pool.register(ws, sourceIP, eligiblePools, greeting)
+	if rejected != nil {
+		rejectHandshake(ws, rejected.code, rejected.reason)
+	}
+	return registered
+}
+
+// register adds the connection like Register but returns the rejection rather than writing it,
+// so that the close frame is written once the locks are released
+func (pool *Pool) register(ws *websocket.Conn, sourceIP string, eligiblePools []PoolID, greeting *wsp.GreetingMessage) (bool, *handshakeRejection) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
 	// Ensure we never add a connection to a pool we have garbage collected
 	if pool.done {
-		return
+		ws.Close()
+		return false, nil
 	}
 
-	log.Printf("Registering new connection from %s", pool.id)
-	connection := NewConnection(pool, ws)
+	// Protect the client from its own connection leaks, the latest greeting sets the limit
+	pool.maxConnections = greeting.MaxConnections
+	if max := pool.maxConnections; max > 0 {
+		if pool.size > max {
+			pool.size = max
+		}
+		if ps := pool.getSize(); ps.Idle+ps.Busy+ps.LongLived >= max {
+			pool.server.logger.Warn("Rejecting connection : too many connections advertised for the pool",
+				"source_ip", sourceIP, "pool_id", pool.id, "max_connections", max)
+			return false, &handshakeRejection{wsp.CloseLimitExceeded, fmt.Sprintf("too many connections for pool %s ( %d advertised )", pool.id, max)}
+		}
+	}
+
+	pool.server.logEvent(Event{Event: EventRegister, PoolID: pool.id, SourceIP: sourceIP}, "Registering new connection")
+	connection := NewConnection(pool, ws, sourceIP, eligiblePools, greeting)
 	pool.connections = append(pool.connections, connection)
+	return true, nil
 }
 
 // Offer offers an idle connection to the server.
 func (pool *Pool) Offer(connection *Connection) {
+	pool.offer(connection, nil)
+}
+
+// offer offers the connection to the requests until one takes it, withdraw is closed or the connection is closed
+func (pool *Pool) offer(connection *Connection, withdraw chan struct{}) {
 	// The original code of root-gg/wsp was invoking goroutine,
 	// but the callder was also invoking goroutine,
 	// so it was deemed unnecessary and removed.
-	pool.idle <- connection
+	// A connection closed while offered is withdrawn rather than handed to a request.
+	select {
+	case pool.idle <- connection:
+	case <-connection.closed:
+	case <-withdraw:
+	}
 }
 
 // Clean removes dead connection from the pool
@@ -73,12 +183,13 @@ func (pool *Pool) Clean() {
 				// We have enough idle connections in the pool.
 				// Terminate the connection if it is idle since more that IdleTimeout
 				if int(time.Now().Sub(connection.idleSince).Seconds())*1000 > pool.server.Config.IdleTimeout {
-					connection.close()
+					connection.close(websocket.CloseNormalClosure, "idle timeout")
 				}
 			}
 		}
+		closed := connection.status == Closed
 		connection.lock.Unlock()
-		if connection.status == Closed {
+		if closed {
 			continue
 		}
 		connections = append(connections, connection)
@@ -86,6 +197,19 @@ func (pool *Pool) Clean() {
 	pool.connections = connections
 }
 
+// removeConnection removes a closed connection from the pool without waiting for the next clean
+func (pool *Pool) removeConnection(connection *Connection) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for i, c := range pool.connections {
+		if c == connection {
+			pool.connections = append(pool.connections[:i], pool.connections[i+1:]...)
+			return
+		}
+	}
+}
+
 // IsEmpty clean the pool and return true if the pool is empty
 func (pool *Pool) IsEmpty() bool {
 	pool.lock.Lock()
@@ -95,24 +219,66 @@ func (pool *Pool) IsEmpty() bool {
 	return len(pool.connections) == 0
 }
 
+// checkEmpty cleans the pool and returns whether it is empty and for how long it has had no connection.
+// This MUST be surrounded by server.lock.Lock()
+func (pool *Pool) checkEmpty(now time.Time) (empty bool, duration time.Duration) {
+	if !pool.IsEmpty() {
+		pool.emptySince = time.Time{}
+		return false, 0
+	}
+
+	if pool.emptySince.IsZero() {
+		pool.emptySince = now
+	}
+	return true, now.Sub(pool.emptySince)
+}
+
 // Shutdown closes every connections in the pool and cleans it
 func (pool *Pool) Shutdown() {
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	pool.shutdown(websocket.CloseGoingAway, "server shutdown")
+}
 
+// shutdown closes every connections in the pool with the close code and reason and cleans it
+func (pool *Pool) shutdown(code int, reason string) {
+	pool.lock.Lock()
 	pool.done = true
+	connections := make([]*Connection, len(pool.connections))
+	copy(connections, pool.connections)
+	pool.lock.Unlock()
 
-	for _, connection := range pool.connections {
-		connection.Close()
-	}
+	closeConnections(connections, false, code, reason)
+
+	pool.lock.Lock()
 	pool.Clean()
+	pool.lock.Unlock()
+}
+
+// closeConnections closes the connections, or only the idle ones, with the close code and reason.
+// They are closed in parallel so that peers not reading their close frame delay the caller
+// by the close write timeout once rather than once per connection.
+func closeConnections(connections []*Connection, idleOnly bool, code int, reason string) {
+	var wg sync.WaitGroup
+	for _, connection := range connections {
+		wg.Add(1)
+		go func(connection *Connection) {
+			defer wg.Done()
+
+			connection.lock.Lock()
+			defer connection.lock.Unlock()
+			if !idleOnly || connection.status == Idle {
+				connection.close(code, reason)
+			}
+		}(connection)
+	}
+	wg.Wait()
 }
 
 // PoolSize is the number of connection in each state in the pool
 type PoolSize struct {
-	Idle   int
-	Busy   int
-	Closed int
+	Idle      int
+	Busy      int
+	LongLived int // Busy connections serving a long-lived request
+	Closed    int
 }
 
 // Size return the number of connection in each state in the pool
@@ -120,16 +286,151 @@ func (pool *Pool) Size() (ps *PoolSize) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
+	return pool.getSize()
+}
+
+// getSize return the number of connection in each state in the pool
+// This MUST be surrounded by pool.lock.Lock()
+func (pool *Pool) getSize() (ps *PoolSize) {
 	ps = new(PoolSize)
 	for _, connection := range pool.connections {
-		if connection.status == Idle {
+		connection.lock.Lock()
+		status, longLived := connection.status, connection.longLived
+		connection.lock.Unlock()
+
+		if status == Idle {
 			ps.Idle++
-		} else if connection.status == Busy {
-			ps.Busy++
-		} else if connection.status == Closed {
+		} else if status == Busy {
+			if longLived {
+				ps.LongLived++
+			} else {
+				ps.Busy++
+			}
+		} else if status == Closed {
 			ps.Closed++
 		}
 	}
 
 	return
 }
+
+// PoolStatus is a snapshot of the state of a Pool.
+// It only holds plain values so it is safe to expose and stays valid after the pool changes.
+type PoolStatus struct {
+	ID        PoolID
+	Size      int // Number of idle connections declared by the client
+	Idle      int
+	Busy      int
+	LongLived int
+	IdleHint  int
+
+	// Recent success rate used as weight by the success-rate strategy
+	SuccessRate float64
+
+	// Effective maximum time to relay a request (milliseconds, 0 for no timeout)
+	ProxyTimeout int
+	// Time to wait for a connection of the pool overriding the default (milliseconds, 0 if not overridden)
+	DispatchTimeout int `json:",omitempty"`
+
+	// Labels, weight and maximum number of connections advertised by the client
+	Labels         map[string]string `json:",omitempty"`
+	Weight         int               `json:",omitempty"`
+	MaxConnections int               `json:",omitempty"`
+
+	// The pool is warm standby rather than active
+	Standby bool
+
+	// Requests proxied, failed ( errors and 5xx responses ) and response body bytes relayed through the pool
+	Requests     int64
+	Errors       int64
+	BytesRelayed int64
+
+	// Time of the last request completed through the pool, the registration time until then
+	LastActivity time.Time
+
+	// Health of each connection ( verbose status only )
+	Connections []ConnectionHealth `json:",omitempty"`
+}
+
+// Status returns a snapshot of the state of the pool
+func (pool *Pool) Status() (status PoolStatus) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	ps := pool.getSize()
+	status.ID = pool.id
+	status.Size = pool.size
+	status.Idle = ps.Idle
+	status.Busy = ps.Busy
+	status.LongLived = ps.LongLived
+	status.IdleHint = pool.idleHint
+	status.SuccessRate = pool.successRate
+	status.ProxyTimeout = int(pool.proxyTimeout / time.Millisecond)
+	status.DispatchTimeout = int(pool.dispatchTimeout / time.Millisecond)
+	status.Labels = pool.labels
+	status.Weight = pool.weight
+	status.MaxConnections = pool.maxConnections
+	status.Standby = pool.standby
+	status.Requests = atomic.LoadInt64(&pool.requests)
+	status.Errors = atomic.LoadInt64(&pool.errors)
+	status.BytesRelayed = atomic.LoadInt64(&pool.bytesRelayed)
+	status.LastActivity = pool.LastActivity()
+
+	return
+}
+
+// setSize updates the number of idle connections declared by the client
+func (pool *Pool) setSize(size int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.size = size
+}
+
+// SetProxyTimeout overrides the maximum time to relay a request through the pool, 0 removes the timeout
+func (pool *Pool) SetProxyTimeout(timeout time.Duration) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.proxyTimeout = timeout
+}
+
+// GetProxyTimeout returns the maximum time to relay a request through the pool, 0 for no timeout
+func (pool *Pool) GetProxyTimeout() time.Duration {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.proxyTimeout
+}
+
+// SetDispatchTimeout overrides the time the requests addressed to the pool wait for a connection, 0 removes the override
+func (pool *Pool) SetDispatchTimeout(timeout time.Duration) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.dispatchTimeout = timeout
+}
+
+// GetDispatchTimeout returns the time the requests addressed to the pool wait for a connection, 0 if not overridden
+func (pool *Pool) GetDispatchTimeout() time.Duration {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.dispatchTimeout
+}
+
+// Labels returns the labels advertised by the client
+func (pool *Pool) Labels() map[string]string {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.labels
+}
+
+// setLabels updates the labels advertised by the client
+func (pool *Pool) setLabels(labels map[string]string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.labels = labels
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/root-gg/wsp"
+)
+
+func testGreeting(t *testing.T, greeting wsp.GreetingMessage) string {
+	t.Helper()
+
+	greeting.ProtocolVersion = wsp.MaxProtocolVersion
+	raw, err := json.Marshal(greeting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestRegisterMaxConnections(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConnections int
+		connections    int
+		registered     int
+	}{
+		{name: "unlimited", maxConnections: 0, connections: 3, registered: 3},
+		{name: "under the limit", maxConnections: 3, connections: 2, registered: 2},
+		{name: "over the limit", maxConnections: 2, connections: 3, registered: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, ts := newTestServer(t, NewConfig())
+			greeting := testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1, MaxConnections: test.maxConnections})
+
+			for i := 0; i < test.connections; i++ {
+				ws := dialTestServer(t, ts, greeting)
+				if i < test.registered {
+					waitFor(t, func() bool { return connectionCount(s, "pool") == i+1 })
+					continue
+				}
+				if code := closeCode(t, ws); code != wsp.CloseLimitExceeded {
+					t.Fatalf("connection %d : got close code %d, want %d", i, code, wsp.CloseLimitExceeded)
+				}
+			}
+
+			if got := connectionCount(s, "pool"); got != test.registered {
+				t.Fatalf("got %d connections, want %d", got, test.registered)
+			}
+		})
+	}
+}
+
+// connectionCount returns the number of open connections of the pool
+func connectionCount(s *Server, id PoolID) int {
+	pool := s.getPool(id)
+	if pool == nil {
+		return 0
+	}
+	ps := pool.Size()
+	return ps.Idle + ps.Busy + ps.LongLived
+}
@@ -0,0 +1,65 @@
+package server
+
+import "sync"
+
+// poolHooks queues the calls of the pool lifecycle hooks of the Config made under the server lock.
+// They are run in order from a separate goroutine, so that a hook can use the Server without deadlocking
+// and an external registry never sees the removal of a pool before its registration.
+type poolHooks struct {
+	calls  []func()
+	signal chan struct{}
+	lock   sync.Mutex
+
+	// Serializes the runs so that the calls keep their order
+	runLock sync.Mutex
+}
+
+// newPoolHooks creates a new poolHooks
+func newPoolHooks() (hooks *poolHooks) {
+	hooks = new(poolHooks)
+	hooks.signal = make(chan struct{}, 1)
+	return
+}
+
+// add queues the call of the hook with the pool id if the hook is set, it never blocks
+func (hooks *poolHooks) add(hook func(id PoolID), id PoolID) {
+	if hook == nil {
+		return
+	}
+
+	hooks.lock.Lock()
+	hooks.calls = append(hooks.calls, func() { hook(id) })
+	hooks.lock.Unlock()
+
+	select {
+	case hooks.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run calls the queued hooks as they come until done is closed
+func (hooks *poolHooks) run(done chan struct{}) {
+	for {
+		select {
+		case <-hooks.signal:
+			hooks.flush()
+		case <-done:
+			return
+		}
+	}
+}
+
+// flush calls the queued hooks in order
+func (hooks *poolHooks) flush() {
+	hooks.runLock.Lock()
+	defer hooks.runLock.Unlock()
+
+	hooks.lock.Lock()
+	calls := hooks.calls
+	hooks.calls = nil
+	hooks.lock.Unlock()
+
+	for _, call := range calls {
+		call()
+	}
+}
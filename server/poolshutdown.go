@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// poolShutdownPollInterval is the interval at which Server.Shutdown checks whether the requests in flight are done
+const poolShutdownPollInterval = 100 * time.Millisecond
+
+// ShutdownGracefully shuts the pool down without cutting the requests in flight : it stops registering connections
+// and closes the idle ones, the busy connections are closed once their request is done or after timeout.
+// The pool must have been removed from the server first so that no request is dispatched to it anymore,
+// as Server.Shutdown and the clean cycle do.
+func (pool *Pool) ShutdownGracefully(timeout time.Duration) {
+	pool.shutdownGracefully(timeout, websocket.CloseGoingAway, "server shutdown")
+}
+
+// shutdownGracefully shuts the pool down closing its connections with the close code and reason once they are idle
+func (pool *Pool) shutdownGracefully(timeout time.Duration, code int, reason string) {
+	pool.lock.Lock()
+	if pool.done {
+		pool.lock.Unlock()
+		return
+	}
+	pool.done = true
+
+	// The close code and reason are set before the flag so that Release reads them once it sees the flag
+	pool.shutdownCode = code
+	pool.shutdownReason = reason
+	atomic.StoreInt32(&pool.shuttingDown, 1)
+	pool.shutdownTimer = time.AfterFunc(timeout, func() { pool.shutdown(code, reason) })
+
+	connections := make([]*Connection, len(pool.connections))
+	copy(connections, pool.connections)
+	pool.lock.Unlock()
+
+	closeConnections(connections, true, code, reason)
+
+	pool.stopShutdownTimerIfDrained()
+}
+
+// stopShutdownTimerIfDrained stops the timer of the graceful shutdown once the pool has no busy connection left,
+// it is called when a connection is released while the pool shuts down gracefully
+func (pool *Pool) stopShutdownTimerIfDrained() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.Clean()
+	if ps := pool.getSize(); ps.Busy+ps.LongLived > 0 {
+		return
+	}
+	if pool.shutdownTimer != nil {
+		pool.shutdownTimer.Stop()
+		pool.shutdownTimer = nil
+	}
+}
+
+// gracefulShutdown returns the close code and reason of the connections released while the pool shuts down gracefully,
+// ok is false if it does not
+func (pool *Pool) gracefulShutdown() (code int, reason string, ok bool) {
+	if atomic.LoadInt32(&pool.shuttingDown) == 0 {
+		return 0, "", false
+	}
+	return pool.shutdownCode, pool.shutdownReason, true
+}
+
+// shutdownPool shuts down a pool removed from the server, gracefully if Config.PoolShutdownTimeout is set
+func (s *Server) shutdownPool(pool *Pool, code int, reason string) {
+	if timeout := s.Config.GetPoolShutdownTimeout(); timeout > 0 {
+		pool.shutdownGracefully(timeout, code, reason)
+		return
+	}
+	pool.shutdown(code, reason)
+}
+
+// waitPoolsIdle waits until none of the pools has a busy connection left or the timeout elapses
+func waitPoolsIdle(pools []*Pool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		busy := 0
+		for _, pool := range pools {
+			ps := pool.Size()
+			busy += ps.Busy + ps.LongLived
+		}
+		if busy == 0 {
+			return
+		}
+		time.Sleep(poolShutdownPollInterval)
+	}
+}
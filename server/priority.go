@@ -0,0 +1,153 @@
+package server
+
+import (
+	"container/heap"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Priority dispatch
+//
+// Requests are dispatched by priority ( Config.RequestPriorityHeader, higher first ) then arrival order.
+// Pools have a priority too ( Config.PoolPriorities ) and the two interact as follows :
+//
+//   - A request takes a connection of the highest priority pools having an idle connection among its eligible pools
+//   - A pool is eligible if its priority is lower or equal to the request priority,
+//     or if no waiting request has a priority at least as high as the pool priority
+//
+// A request waiting for a connection goes back to the queue as soon as a higher priority one arrives.
+//
+// So a low priority request never grabs a connection of a high priority pool while a high priority request waits,
+// but high priority pools still serve low priority requests when they would otherwise stay idle.
+
+// requestQueue is a priority queue of the requests waiting for the dispatcher ( used by the dispatcher only )
+type requestQueue []*ConnectionRequest
+
+func (queue requestQueue) Len() int { return len(queue) }
+
+func (queue requestQueue) Less(i, j int) bool {
+	if queue[i].priority != queue[j].priority {
+		return queue[i].priority > queue[j].priority
+	}
+	return queue[i].seq < queue[j].seq
+}
+
+func (queue requestQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *requestQueue) Push(x interface{}) { *queue = append(*queue, x.(*ConnectionRequest)) }
+
+func (queue *requestQueue) Pop() interface{} {
+	old := *queue
+	request := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return request
+}
+
+// maxPriority returns the highest priority of the waiting requests
+func (queue requestQueue) maxPriority() int {
+	if len(queue) == 0 {
+		return math.MinInt
+	}
+	return queue[0].priority
+}
+
+// requestPriority returns the priority of the request from Config.RequestPriorityHeader, 0 by default
+func (s *Server) requestPriority(r *http.Request) int {
+	if s.Config.RequestPriorityHeader == "" {
+		return 0
+	}
+	priority, err := strconv.Atoi(r.Header.Get(s.Config.RequestPriorityHeader))
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// poolPriority returns the priority of the pool from Config.PoolPriorities, 0 by default
+func (s *Server) poolPriority(pool *Pool) int {
+	return s.Config.PoolPriorities[string(pool.id)]
+}
+
+// enqueue adds a request to the dispatch queue
+func (s *Server) enqueue(request *ConnectionRequest) {
+	s.requestSeq++
+	request.seq = s.requestSeq
+	heap.Push(&s.queue, request)
+}
+
+// requeue puts a request back in the dispatch queue, it keeps its arrival order
+func (s *Server) requeue(request *ConnectionRequest) {
+	heap.Push(&s.queue, request)
+}
+
+// drainRequests moves the requests sent to the dispatcher channel to the dispatch queue without blocking
+func (s *Server) drainRequests() {
+	for {
+		select {
+		case request := <-s.dispatcher:
+			s.enqueue(request)
+		default:
+			return
+		}
+	}
+}
+
+// nextRequest returns the waiting request to dispatch first, it blocks until there is one
+// and returns nil when the server shutdowns
+func (s *Server) nextRequest() *ConnectionRequest {
+	if len(s.queue) == 0 {
+		select {
+		case <-s.done:
+			return nil
+		case request := <-s.dispatcher:
+			s.enqueue(request)
+		}
+	}
+	s.drainRequests()
+	return heap.Pop(&s.queue).(*ConnectionRequest)
+}
+
+// priorityFilter returns the filter of the pools eligible for the request according to their priority
+func (s *Server) priorityFilter(request *ConnectionRequest) func(pool *Pool) bool {
+	if len(s.Config.PoolPriorities) == 0 {
+		return request.filter
+	}
+
+	return func(pool *Pool) bool {
+		if request.filter != nil && !request.filter(pool) {
+			return false
+		}
+		priority := s.poolPriority(pool)
+		return priority <= request.priority || priority > s.queue.maxPriority()
+	}
+}
+
+// preferPriorityPools returns the pools of the highest priority having an idle connection,
+// or all the pools if none has an idle connection
+// This MUST be surrounded by s.lock.RLock()
+func (s *Server) preferPriorityPools(pools []*Pool) []*Pool {
+	if len(s.Config.PoolPriorities) == 0 {
+		return pools
+	}
+
+	var preferred []*Pool
+	best := math.MinInt
+	for _, pool := range pools {
+		if pool.Size().Idle == 0 {
+			continue
+		}
+		priority := s.poolPriority(pool)
+		if priority > best {
+			best = priority
+			preferred = preferred[:0]
+		}
+		if priority == best {
+			preferred = append(preferred, pool)
+		}
+	}
+	if len(preferred) == 0 {
+		return pools
+	}
+	return preferred
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func newPriorityRequest(priority int) *ConnectionRequest {
+	request := NewConnectionRequest(time.Second)
+	request.priority = priority
+	return request
+}
+
+func TestNextRequestOrder(t *testing.T) {
+	s := NewServer(NewConfig())
+
+	requests := []*ConnectionRequest{
+		newPriorityRequest(0),
+		newPriorityRequest(5),
+		newPriorityRequest(0),
+		newPriorityRequest(10),
+		newPriorityRequest(5),
+	}
+	for _, request := range requests {
+		s.enqueue(request)
+	}
+
+	expected := []*ConnectionRequest{requests[3], requests[1], requests[4], requests[0], requests[2]}
+	for i, want := range expected {
+		if got := s.nextRequest(); got != want {
+			t.Fatalf("request %d : got priority %d seq %d, want priority %d seq %d", i, got.priority, got.seq, want.priority, want.seq)
+		}
+	}
+}
+
+func TestRequeueKeepsArrivalOrder(t *testing.T) {
+	s := NewServer(NewConfig())
+
+	first := newPriorityRequest(1)
+	second := newPriorityRequest(1)
+	s.enqueue(first)
+	s.enqueue(second)
+
+	if got := s.nextRequest(); got != first {
+		t.Fatalf("got seq %d, want the first request", got.seq)
+	}
+	s.requeue(first)
+	if got := s.nextRequest(); got != first {
+		t.Fatalf("got seq %d, want the requeued first request before the second one", got.seq)
+	}
+}
+
+func TestPriorityFilter(t *testing.T) {
+	config := NewConfig()
+	config.PoolPriorities = map[string]int{"high": 10}
+	s := NewServer(config)
+
+	high := NewPool(s, "high")
+	low := NewPool(s, "low")
+
+	tests := []struct {
+		name     string
+		priority int
+		waiting  []int
+		high     bool
+		low      bool
+	}{
+		{name: "low request alone", priority: 0, high: true, low: true},
+		{name: "low request while high waits", priority: 0, waiting: []int{10}, high: false, low: true},
+		{name: "low request while medium waits", priority: 0, waiting: []int{5}, high: true, low: true},
+		{name: "high request while high waits", priority: 10, waiting: []int{10}, high: true, low: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.queue = nil
+			for _, priority := range test.waiting {
+				s.enqueue(newPriorityRequest(priority))
+			}
+
+			filter := s.priorityFilter(newPriorityRequest(test.priority))
+			if got := filter(high); got != test.high {
+				t.Errorf("high pool eligible = %v, want %v", got, test.high)
+			}
+			if got := filter(low); got != test.low {
+				t.Errorf("low pool eligible = %v, want %v", got, test.low)
+			}
+		})
+	}
+}
+
+func TestDispatchRequeuesForHigherPriority(t *testing.T) {
+	s := NewServer(NewConfig())
+
+	low := newPriorityRequest(0)
+	high := newPriorityRequest(10)
+	s.enqueue(high)
+
+	if s.dispatchRequest(low) {
+		t.Fatal("the low priority request has been dispatched while a higher priority one waits")
+	}
+	select {
+	case <-low.connection:
+		t.Fatal("the connection channel of the requeued request has been closed")
+	default:
+	}
+
+	if got := s.nextRequest(); got != high {
+		t.Fatalf("got priority %d, want the high priority request first", got.priority)
+	}
+	if got := s.nextRequest(); got != low {
+		t.Fatalf("got priority %d, want the requeued low priority request", got.priority)
+	}
+}
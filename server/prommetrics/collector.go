@@ -0,0 +1,50 @@
+package prommetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/root-gg/wsp/server"
+)
+
+var (
+	poolsDesc = prometheus.NewDesc("wsp_pools",
+		"Number of connection pools.", nil, nil)
+	connectionsDesc = prometheus.NewDesc("wsp_connections",
+		"Number of connections by state ( idle, busy or long_lived ).", []string{"state"}, nil)
+)
+
+// Collector reports the state of the pools and connections of a server.Server.
+// The gauges are computed from Server.Status when scraped so they are always current.
+type Collector struct {
+	server *server.Server
+}
+
+// NewCollector creates a Collector of the server state, it must be registered
+func NewCollector(s *server.Server) (collector *Collector) {
+	collector = new(Collector)
+	collector.server = s
+	return
+}
+
+// Describe implements prometheus.Collector
+func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolsDesc
+	ch <- connectionsDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
+	status := collector.server.Status()
+
+	idle, busy, longLived := 0, 0, 0
+	for _, pool := range status.Pools {
+		idle += pool.Idle
+		busy += pool.Busy
+		longLived += pool.LongLived
+	}
+
+	ch <- prometheus.MustNewConstMetric(poolsDesc, prometheus.GaugeValue, float64(status.PoolCount))
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(idle), "idle")
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(busy), "busy")
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(longLived), "long_lived")
+}
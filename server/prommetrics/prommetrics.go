@@ -0,0 +1,71 @@
+// Package prommetrics exports the wsp server metrics to Prometheus.
+//
+// It lives in its own module so that users of other metrics backends
+// don't have to depend on the Prometheus client library.
+package prommetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/root-gg/wsp/server"
+)
+
+// Metrics implements server.Metrics with Prometheus collectors
+type Metrics struct {
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors of every server.MetricDefinitions and registers them
+func NewMetrics(registerer prometheus.Registerer) (metrics *Metrics, err error) {
+	return NewMetricsWithDefinitions(registerer, server.MetricDefinitions)
+}
+
+// NewMetricsWithDefinitions creates the collectors of the given definitions and registers them,
+// use server.Config.MetricDefinitions when the server is configured with other metric labels
+func NewMetricsWithDefinitions(registerer prometheus.Registerer, definitions []server.MetricDefinition) (metrics *Metrics, err error) {
+	metrics = new(Metrics)
+	metrics.counters = make(map[string]*prometheus.CounterVec)
+	metrics.histograms = make(map[string]*prometheus.HistogramVec)
+
+	for _, definition := range definitions {
+		var collector prometheus.Collector
+		switch definition.Type {
+		case server.Counter:
+			vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: definition.Name,
+				Help: definition.Help,
+			}, definition.Labels)
+			metrics.counters[definition.Name] = vec
+			collector = vec
+		case server.Histogram:
+			vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    definition.Name,
+				Help:    definition.Help,
+				Buckets: prometheus.DefBuckets,
+			}, definition.Labels)
+			metrics.histograms[definition.Name] = vec
+			collector = vec
+		}
+
+		if err = registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// IncCounter increments the counter by one
+func (metrics *Metrics) IncCounter(name string, labels server.Labels) {
+	if vec, ok := metrics.counters[name]; ok {
+		vec.With(prometheus.Labels(labels)).Inc()
+	}
+}
+
+// ObserveHistogram records a value in the histogram
+func (metrics *Metrics) ObserveHistogram(name string, labels server.Labels, value float64) {
+	if vec, ok := metrics.histograms[name]; ok {
+		vec.With(prometheus.Labels(labels)).Observe(value)
+	}
+}
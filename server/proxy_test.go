@@ -0,0 +1,129 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/root-gg/wsp"
+	"github.com/root-gg/wsp/client"
+)
+
+// poolConnections returns the connections of the pool which are not closed
+func poolConnections(s *Server, id PoolID) (connections []*Connection) {
+	pool := s.getPool(id)
+	if pool == nil {
+		return nil
+	}
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		if connection.status != Closed {
+			connections = append(connections, connection)
+		}
+		connection.lock.Unlock()
+	}
+	return
+}
+
+func TestProxyKeepsConnection(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/headers":
+			w.Header().Set("A", "1")
+			w.Header().Set("B", "2")
+			w.Header().Set("C", "3")
+		}
+		w.Write([]byte("body"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{name: "upstream error", path: "/error", status: http.StatusInternalServerError},
+		{name: "response over the header limits", path: "/headers", status: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			// The upstream sends Date, Content-Length and Content-Type
+			config.MaxResponseHeaderCount = 4
+			config.ResponseHeaderLimitAction = HeaderLimitReject
+			s, ts := newTestServer(t, config)
+			startTestClient(t, s, ts, func(config *client.Config) { config.PoolMaxSize = 1 })
+
+			id := s.Pools()[0].ID
+			before := poolConnections(s, id)
+			if len(before) != 1 {
+				t.Fatalf("got %d connections, want 1", len(before))
+			}
+
+			resp := proxyTestRequest(t, ts, http.MethodGet, upstream.URL+test.path, nil)
+			io.Copy(io.Discard, resp.Body)
+			if resp.StatusCode != test.status {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, test.status)
+			}
+
+			// The same connection serves the next request
+			waitFor(t, func() bool { return s.getPool(id).Size().Idle == 1 })
+			after := poolConnections(s, id)
+			if len(after) != 1 || after[0] != before[0] {
+				t.Fatal("the connection has been replaced, want it kept after an upstream failure")
+			}
+			if resp := proxyTestRequest(t, ts, http.MethodGet, upstream.URL, nil); resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d through the kept connection, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestProxyClosesConnectionOnTransportFailure(t *testing.T) {
+	s, ts := newTestServer(t, NewConfig())
+
+	// The peer goes away once it got the request, before answering
+	ws := dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+	go func() {
+		ws.ReadMessage()
+		ws.Close()
+	}()
+
+	// The proxy errors of wsp are answered with a 526
+	resp := proxyTestRequest(t, ts, http.MethodGet, "http://upstream/", nil)
+	if resp.StatusCode != 526 {
+		t.Errorf("got status %d, want 526", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return len(poolConnections(s, "pool")) == 0 })
+}
+
+func TestProxyRelaysTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "1234")
+	}))
+	defer upstream.Close()
+
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+
+	resp := proxyTestRequest(t, ts, http.MethodGet, upstream.URL, nil)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "body" {
+		t.Errorf("got body %q, want %q", body, "body")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "1234" {
+		t.Errorf("got trailer %q, want %q", got, "1234")
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errRetryableStatus is returned by proxyRequest when the response status is retryable,
+// nothing has been written to the caller and the connection has been released
+var errRetryableStatus = errors.New("retryable response status")
+
+// isReplayable returns true if the request can be sent again through another connection.
+// The request body is streamed to the peer and can't be replayed, so only requests without a body are retried.
+// A retried request may have been applied by the upstream already, so only idempotent methods are retried :
+// GET, HEAD and OPTIONS, and PUT and DELETE if Config.RetryIdempotentWrites is set.
+func (s *Server) isReplayable(r *http.Request) bool {
+	if r.ContentLength != 0 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return s.Config.RetryIdempotentWrites
+	}
+	return false
+}
+
+// isRetryableStatus returns true if the status code is in Config.RetryStatusCodes
+func (s *Server) isRetryableStatus(status int) bool {
+	for _, code := range s.Config.RetryStatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsReplayable(t *testing.T) {
+	tests := []struct {
+		method                string
+		body                  string
+		retryIdempotentWrites bool
+		replayable            bool
+	}{
+		{method: http.MethodGet, replayable: true},
+		{method: http.MethodHead, replayable: true},
+		{method: http.MethodOptions, replayable: true},
+		{method: http.MethodGet, body: "body", replayable: false},
+		{method: http.MethodPost, replayable: false},
+		{method: http.MethodPatch, replayable: false},
+		{method: http.MethodPost, retryIdempotentWrites: true, replayable: false},
+		{method: http.MethodPut, replayable: false},
+		{method: http.MethodDelete, replayable: false},
+		{method: http.MethodPut, retryIdempotentWrites: true, replayable: true},
+		{method: http.MethodDelete, retryIdempotentWrites: true, replayable: true},
+		{method: http.MethodPut, body: "body", retryIdempotentWrites: true, replayable: false},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		config.RetryIdempotentWrites = test.retryIdempotentWrites
+		s := NewServer(config)
+
+		r := httptest.NewRequest(test.method, "/request", strings.NewReader(test.body))
+		if got := s.isReplayable(r); got != test.replayable {
+			t.Errorf("%s with body %q and RetryIdempotentWrites %v : got replayable %v, want %v",
+				test.method, test.body, test.retryIdempotentWrites, got, test.replayable)
+		}
+	}
+}
+
+func TestStatusRetry(t *testing.T) {
+	tests := []struct {
+		method   string
+		status   int
+		attempts int32
+	}{
+		{method: http.MethodGet, status: http.StatusOK, attempts: 2},
+		{method: http.MethodPost, status: http.StatusServiceUnavailable, attempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			// The upstream fails the first attempt only
+			var attempts int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+
+			config := NewConfig()
+			config.MaxStatusRetries = 1
+			s, ts := newTestServer(t, config)
+			startTestClient(t, s, ts, nil)
+
+			resp := proxyTestRequest(t, ts, test.method, upstream.URL, nil)
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, test.status)
+			}
+			if got := atomic.LoadInt32(&attempts); got != test.attempts {
+				t.Errorf("got %d upstream attempts, want %d", got, test.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// retryAfter returns the number of seconds a caller left without a connection should wait before retrying.
+// It is Config.RetryAfterBase stretched up to twice as long as the share of busy connections grows,
+// the longest when no client has a connection.
+func (s *Server) retryAfter() int {
+	idle, busy := 0, 0
+	for _, ps := range s.Pools() {
+		idle += ps.Idle
+		busy += ps.Busy + ps.LongLived
+	}
+
+	base := s.Config.GetRetryAfterBase()
+	delay := 2 * base
+	if total := idle + busy; total > 0 {
+		delay = base + time.Duration(float64(base)*float64(busy)/float64(total))
+	}
+
+	// Retry-After only holds whole seconds
+	seconds := int(math.Ceil(delay.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
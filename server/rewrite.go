@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite rewrites the path of the proxied requests before they are forwarded.
+//
+// With Prefix set, a path starting with Prefix gets it replaced by Replacement.
+// With Regex set, a path matching Regex gets it replaced by Replacement which
+// can reference capture groups using $1, ${name}, ... ( see regexp.Regexp.ReplaceAllString )
+type PathRewrite struct {
+	Prefix      string
+	Regex       string
+	Replacement string
+
+	regex *regexp.Regexp
+}
+
+// NewPathRewrite creates a new PathRewrite
+func NewPathRewrite(prefix string, regex string, replacement string) (rewrite *PathRewrite, err error) {
+	rewrite = new(PathRewrite)
+	rewrite.Prefix = prefix
+	rewrite.Regex = regex
+	rewrite.Replacement = replacement
+	err = rewrite.Compile()
+	return
+}
+
+// Compile the regular expression
+func (rewrite *PathRewrite) Compile() (err error) {
+	if rewrite.Prefix != "" && rewrite.Regex != "" {
+		return fmt.Errorf("path rewrite can't have both a prefix and a regex")
+	}
+	if rewrite.Prefix == "" && rewrite.Regex == "" {
+		return fmt.Errorf("path rewrite must have a prefix or a regex")
+	}
+	if rewrite.Regex != "" {
+		rewrite.regex, err = regexp.Compile(rewrite.Regex)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Rewrite returns the rewritten path and true if the rule matches the path
+func (rewrite *PathRewrite) Rewrite(path string) (string, bool) {
+	if rewrite.regex != nil {
+		if !rewrite.regex.MatchString(path) {
+			return path, false
+		}
+		return rewrite.regex.ReplaceAllString(path, rewrite.Replacement), true
+	}
+
+	if rewrite.Prefix != "" && strings.HasPrefix(path, rewrite.Prefix) {
+		return rewrite.Replacement + strings.TrimPrefix(path, rewrite.Prefix), true
+	}
+
+	return path, false
+}
+
+func (rewrite *PathRewrite) String() string {
+	if rewrite.Regex != "" {
+		return fmt.Sprintf("%s => %s", rewrite.Regex, rewrite.Replacement)
+	}
+	return fmt.Sprintf("%s* => %s*", rewrite.Prefix, rewrite.Replacement)
+}
+
+// rewritePath applies the first matching path rewrite rule
+func (s *Server) rewritePath(path string) string {
+	for _, rewrite := range s.Config.PathRewrites {
+		if rewritten, ok := rewrite.Rewrite(path); ok {
+			return rewritten
+		}
+	}
+	return path
+}
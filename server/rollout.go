@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+// unknownVersion is reported for the connections of clients which did not advertise their version
+const unknownVersion = "unknown"
+
+// RolloutStatus is the JSON document returned by the /admin/rollout endpoint
+type RolloutStatus struct {
+	// Version replacing the others, empty if no rollout is in progress
+	TargetVersion string `json:",omitempty"`
+
+	// Connections open when the rollout began, the connections of the other versions
+	// are only closed while the total stays at least this capacity
+	Capacity int `json:",omitempty"`
+
+	// Connections of the other versions closed so far
+	Drained int `json:",omitempty"`
+
+	// Open connections per advertised client version
+	Versions map[string]int
+}
+
+// rollout replaces the connections of the clients advertising other versions by those of the target version
+type rollout struct {
+	version  string
+	capacity int
+	drained  int
+}
+
+// version returns the client version advertised by the peer
+func (connection *Connection) version() string {
+	if connection.clientVersion == "" {
+		return unknownVersion
+	}
+	return connection.clientVersion
+}
+
+// versions returns the number of open connections of the pool per advertised client version
+func (pool *Pool) versions() (versions map[string]int) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	versions = make(map[string]int)
+	for _, connection := range pool.connections {
+		if connection.getStatus() != Closed {
+			versions[connection.version()]++
+		}
+	}
+	return
+}
+
+// connectionVersions returns the number of open connections per advertised client version.
+// This MUST be surrounded by s.lock.RLock()
+func (s *Server) connectionVersions() (versions map[string]int) {
+	versions = make(map[string]int)
+	for _, pool := range s.pools {
+		for version, count := range pool.versions() {
+			versions[version] += count
+		}
+	}
+	return
+}
+
+// outdatedAllowance returns how many more connections of other versions than the target one can stay open.
+// This MUST be surrounded by s.lock.RLock()
+func (s *Server) outdatedAllowance() int {
+	upgraded, outdated := 0, 0
+	for version, count := range s.connectionVersions() {
+		if version == s.rollout.version {
+			upgraded += count
+		} else {
+			outdated += count
+		}
+	}
+
+	allowed := s.rollout.capacity - upgraded
+	if allowed < 0 {
+		allowed = 0
+	}
+	return allowed - outdated
+}
+
+// acceptsVersion returns false if a connection of the client version must be refused because the rollout
+// already has enough capacity without it.
+// This MUST be surrounded by s.lock.Lock()
+func (s *Server) acceptsVersion(version string) bool {
+	if s.rollout == nil || version == s.rollout.version {
+		return true
+	}
+	return s.outdatedAllowance() > 0
+}
+
+// rolloutStep returns the idle connections of the other versions to close as long as the target version
+// connections keep the capacity of the rollout. They are closed by closeOutdated once the locks are released.
+// This MUST be surrounded by s.lock.Lock()
+func (s *Server) rolloutStep() (outdated []*Connection) {
+	if s.rollout == nil {
+		return nil
+	}
+
+	excess := -s.outdatedAllowance()
+	for _, pool := range s.pools {
+		if excess <= 0 {
+			break
+		}
+		pool.lock.Lock()
+		for _, connection := range pool.connections {
+			if excess <= 0 {
+				break
+			}
+			connection.lock.Lock()
+			if connection.status == Idle && connection.version() != s.rollout.version {
+				outdated = append(outdated, connection)
+				s.rollout.drained++
+				excess--
+			}
+			connection.lock.Unlock()
+		}
+		pool.lock.Unlock()
+	}
+	return outdated
+}
+
+// closeOutdated closes the connections returned by rolloutStep which are still idle
+func closeOutdated(outdated []*Connection) {
+	closeConnections(outdated, true, websocket.CloseGoingAway, "client upgrade")
+}
+
+// StartRollout replaces the connections of the clients advertising another version by those of the version.
+// The capacity is the number of connections open now : the connections of other versions are only closed,
+// and refused, as connections of the version register.
+func (s *Server) StartRollout(version string) {
+	s.lock.Lock()
+	capacity := 0
+	for _, count := range s.connectionVersions() {
+		capacity += count
+	}
+	s.rollout = &rollout{version: version, capacity: capacity}
+	s.logger.Info("Rolling out client version", "version", version, "capacity", capacity)
+	outdated := s.rolloutStep()
+	s.lock.Unlock()
+
+	closeOutdated(outdated)
+}
+
+// StopRollout stops replacing the connections of the other versions
+func (s *Server) StopRollout() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rollout != nil {
+		s.logger.Info("Rollout of client version stopped", "version", s.rollout.version)
+		s.rollout = nil
+	}
+}
+
+// RolloutStatus returns the progress of the rollout and the number of connections per client version
+func (s *Server) RolloutStatus() (status *RolloutStatus) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	status = new(RolloutStatus)
+	status.Versions = s.connectionVersions()
+	if s.rollout != nil {
+		status.TargetVersion = s.rollout.version
+		status.Capacity = s.rollout.capacity
+		status.Drained = s.rollout.drained
+	}
+	return
+}
+
+// adminRollout reports ( GET ), starts ( POST ?version= ) or stops ( DELETE ) the rollout of a client version
+func (s *Server) adminRollout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Missing version")
+			return
+		}
+		s.StartRollout(version)
+	case http.MethodDelete:
+		s.StopRollout()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+	writeJSON(w, s.RolloutStatus())
+}
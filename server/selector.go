@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// selectorRetryInterval is the time the dispatcher waits before asking
+// the Selector again when no pool has an idle connection
+const selectorRetryInterval = time.Millisecond
+
+// Selector chooses the pool the dispatcher takes a connection from.
+//
+// By default the dispatcher picks uniformly at random among the pools having an idle connection
+// through reflect.Select, which can't be controlled. Setting a Selector with Server.SetSelector
+// makes the choice explicit, for example to have reproducible routing in tests.
+type Selector interface {
+	// Select returns the pool to use among the candidates or nil to use none.
+	// Candidates are the pools having at least one idle connection,
+	// in registration order or sorted by id with Config.SortPools.
+	Select(candidates []*Pool) *Pool
+}
+
+// SelectorFunc is an adapter to allow the use of an ordinary function as a Selector
+type SelectorFunc func(candidates []*Pool) *Pool
+
+// Select calls f(candidates)
+func (f SelectorFunc) Select(candidates []*Pool) *Pool {
+	return f(candidates)
+}
+
+// OrderedSelector selects the first candidate, combined with Config.SortPools
+// it always prefers the pool with the lowest id having an idle connection
+type OrderedSelector struct{}
+
+// Select returns the first candidate
+func (OrderedSelector) Select(candidates []*Pool) *Pool {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0]
+}
+
+// RandomSelector selects a pool uniformly at random using the given random source.
+// Using a fixed seed makes the selection deterministic for a fixed pool set.
+type RandomSelector struct {
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+// NewRandomSelector creates a new RandomSelector
+func NewRandomSelector(source rand.Source) (selector *RandomSelector) {
+	selector = new(RandomSelector)
+	selector.random = rand.New(source)
+	return
+}
+
+// Select returns a random pool among the candidates
+func (selector *RandomSelector) Select(candidates []*Pool) *Pool {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// rand.Rand is not safe for concurrent use
+	selector.lock.Lock()
+	defer selector.lock.Unlock()
+
+	return candidates[selector.random.Intn(len(candidates))]
+}
+
+// SetSelector sets the Selector used by the dispatcher, nil restores the default random selection.
+// It replaces the strategy set by name, the strategy is reported as custom.
+func (s *Server) SetSelector(selector Selector) {
+	if selector == nil {
+		s.strategy.Store(&dispatchStrategy{name: StrategyRandom})
+		return
+	}
+	s.strategy.Store(&dispatchStrategy{name: StrategyCustom, selector: selector})
+}
+
+// selectConnection asks the selector which pool to use among the pools accepted by the filter having an idle connection
+// and waits for an idle connection of this pool. It returns nil if no connection has been found.
+func (s *Server) selectConnection(ctx context.Context, selector Selector, filter func(pool *Pool) bool) (*Connection, *Pool) {
+	s.lock.RLock()
+	var candidates []*Pool
+	for _, pool := range filterPools(s.dispatchablePools(), filter) {
+		if pool.Size().Idle > 0 {
+			candidates = append(candidates, pool)
+		}
+	}
+	candidates = s.preferActivePools(candidates)
+	s.lock.RUnlock()
+
+	var pool *Pool
+	if len(candidates) > 0 {
+		pool = selector.Select(candidates)
+	}
+	if pool == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(selectorRetryInterval):
+		}
+		return nil, nil
+	}
+
+	// An idle connection always has a pending offer on the pool idle channel
+	select {
+	case connection := <-pool.idle:
+		return connection, pool
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
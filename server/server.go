@@ -2,14 +2,20 @@ package server
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"reflect"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,6 +26,14 @@ import (
 // This is the Server part, Clients will offer websocket connections,
 // those will be pooled to transfer HTTP Request and response
 type Server struct {
+	// Number of long-lived requests in flight ( atomic, keep it first for 64-bit alignment )
+	longLived int64
+	// Number of dispatch timeouts since the previous clean ( atomic )
+	dispatchTimeouts int64
+
+	// The server stopped accepting requests and connections to be restarted ( atomic )
+	draining int32
+
 	Config *Config
 
 	upgrader websocket.Upgrader
@@ -39,23 +53,118 @@ type Server struct {
 	lock sync.RWMutex
 	done chan struct{}
 
+	shutdownOnce sync.Once
+
 	// Through dispatcher channel it communicates between "server" thread and "dispatcher" thread.
 	// "server" thread sends the value to this channel when accepting requests in the endpoint /requests,
 	// and "dispatcher" thread reads this channel.
 	dispatcher chan *ConnectionRequest
 
+	// Requests waiting for the dispatcher ordered by priority then arrival ( used by the dispatcher only )
+	queue      requestQueue
+	requestSeq uint64
+
+	// Metrics backend, NoopMetrics by default
+	metrics Metrics
+	// Optional handler of the /metrics endpoint
+	metricsHandler http.Handler
+	// Distinct values of the metric labels
+	metricLabelValues *metricLabelValues
+
+	// Number of registered connections per source IP
+	sourceIPs     map[string]int
+	sourceIPsLock sync.Mutex
+
+	// Source IPs having recently failed to authenticate ( nil if banning is disabled )
+	bans *ipBans
+
+	// Number of in-flight requests per caller identity
+	callers     map[string]int
+	callersLock sync.Mutex
+
+	// Source networks of Config.TrustedProxies
+	trustedProxies []*net.IPNet
+
+	// Validated Config.ResponseHeaderLimitAction
+	responseHeaderLimitAction string
+
+	// Requests being proxied
+	inFlight *inFlightRequests
+
+	// Share of the dispatches meeting Config.DispatchWaitSLOThreshold ( nil if disabled )
+	dispatchWaitSLO *dispatchWaitSLO
+
+	// Request ids seen recently to detect duplicates ( nil if disabled )
+	recentRequests *recentRequests
+
+	// Rollout of a client version in progress ( nil if none, it MUST be accessed with s.lock )
+	rollout *rollout
+
+	// Notifiers of the Config.Webhooks and whether a client had a connection at the previous clean
+	// ( it MUST be accessed with s.lock )
+	webhooks     []*webhookNotifier
+	wasConnected bool
+
+	// Calls of the pool lifecycle hooks of the Config
+	poolHooks *poolHooks
+
+	// Slots of the requests being mirrored, bounded by Mirror.MaxConcurrent
+	mirrors chan struct{}
+
+	// Serializes connection migrations between pools
+	migrationLock sync.Mutex
+
+	// Dispatch strategy and its optional Selector to choose the pool to dispatch connections from,
+	// it can be switched while serving
+	strategy atomic.Pointer[dispatchStrategy]
+	// Selector used instead of reflect.Select when the clients advertise weights
+	weightedSelector *WeightedSelector
+	// Number of pools whose client advertised a weight ( atomic, it MUST be updated with s.lock )
+	weightedPools int32
+
+	// Structured logger, set with SetLogger
+	logger *slog.Logger
+
+	// Optional Authenticator of the register requests, Config.SecretKey and Config.SecretKeys are checked if nil
+	authenticator Authenticator
+
+	// Optional TLS configuration set with SetTLSConfig
+	tlsConfig *tls.Config
+
 	server *http.Server
+	// Private listener of /register and /status with Config.RegisterAddr, nil otherwise
+	registerServer *http.Server
 }
 
 // ConnectionRequest is used to request a proxy connection from the dispatcher
 type ConnectionRequest struct {
 	connection chan *Connection
+	timeout    time.Duration
+
+	// Optional filter of the pools the connection can be dispatched from
+	filter func(pool *Pool) bool
+
+	// Destination host of the request for connection affinity ( empty if unknown )
+	host string
+
+	// Session key of the request for sticky sessions ( empty if none )
+	sessionKey string
+
+	// The dispatcher gives up after deadline, requests are dispatched by priority then arrival order
+	deadline time.Time
+	priority int
+	seq      uint64
+
+	// Reason why no connection was dispatched, set before closing the connection channel
+	err error
 }
 
-// NewConnectionRequest creates a new connection request
+// NewConnectionRequest creates a new connection request the dispatcher gives up after timeout
 func NewConnectionRequest(timeout time.Duration) (cr *ConnectionRequest) {
 	cr = new(ConnectionRequest)
 	cr.connection = make(chan *Connection)
+	cr.timeout = timeout
+	cr.deadline = time.Now().Add(timeout)
 	return
 }
 
@@ -65,7 +174,48 @@ func NewServer(config *Config) (server *Server) {
 
 	server = new(Server)
 	server.Config = config
-	server.upgrader = websocket.Upgrader{}
+	server.upgrader = websocket.Upgrader{EnableCompression: config.EnableCompression}
+	server.metrics = NoopMetrics{}
+	server.metricLabelValues = newMetricLabelValues(config.MaxMetricLabelValues)
+	server.sourceIPs = make(map[string]int)
+	server.callers = make(map[string]int)
+	if config.AuthFailureBanThreshold > 0 {
+		server.bans = newIPBans(config.AuthFailureBanThreshold, config.GetAuthFailureBanWindow(), config.GetAuthFailureBanDuration(), config.MaxBannedIPs)
+	}
+	server.inFlight = newInFlightRequests()
+	if config.DispatchWaitSLOThreshold > 0 {
+		server.dispatchWaitSLO = newDispatchWaitSLO(config.GetDispatchWaitSLOThreshold(), config.DispatchWaitSLOTarget, config.GetDispatchWaitSLOWindow())
+	}
+	if config.DuplicateRequestAction != "" {
+		server.recentRequests = newRecentRequests(config.MaxRecentRequestIDs, config.GetDuplicateRequestWindow())
+	}
+	server.logger = newLogger(config.LogFormat)
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		server.logger.Warn(fmt.Sprintf("%s, trusting no proxy", err))
+	}
+	server.trustedProxies = trustedProxies
+	server.responseHeaderLimitAction = config.ResponseHeaderLimitAction
+	if action := config.ResponseHeaderLimitAction; action != HeaderLimitTruncate && action != HeaderLimitReject {
+		server.logger.Warn(fmt.Sprintf("Invalid response header limit action %q, using %s", action, HeaderLimitReject))
+		server.responseHeaderLimitAction = HeaderLimitReject
+	}
+	if config.CallerHeader != "" && len(server.trustedProxies) == 0 {
+		server.logger.Warn("The caller header is ignored without trusted proxies, callers are identified by their source IP", "caller_header", config.CallerHeader)
+	}
+	for _, webhook := range config.Webhooks {
+		server.webhooks = append(server.webhooks, newWebhookNotifier(server, webhook))
+	}
+	server.poolHooks = newPoolHooks()
+	if config.Mirror != nil {
+		server.mirrors = make(chan struct{}, config.Mirror.getMaxConcurrent())
+	}
+
+	if err := server.SetStrategy(config.Strategy); err != nil {
+		server.logger.Warn(fmt.Sprintf("%s, using the %s strategy", err, StrategyRandom))
+		server.SetStrategy(StrategyRandom)
+	}
+	server.weightedSelector = NewWeightedSelector(rand.NewSource(time.Now().UnixNano()))
 
 	server.done = make(chan struct{})
 	server.dispatcher = make(chan *ConnectionRequest)
@@ -86,212 +236,962 @@ func (s *Server) Start() {
 		}
 	}()
 
+	if s.keepaliveInterval() > 0 {
+		go s.keepalive()
+	}
+
+	for _, notifier := range s.webhooks {
+		go notifier.run(s.done)
+	}
+	go s.poolHooks.run(s.done)
+
 	r := http.NewServeMux()
 	// TODO: I want to detach the handler function from the Server struct,
 	// but it is tightly coupled to the internal state of the Server.
-	r.HandleFunc("/register", s.Register)
+	// With a register address the clients connect to a private listener, only callers reach /request
+	if s.Config.RegisterAddr == "" {
+		r.HandleFunc("/register", s.Register)
+	} else {
+		rr := http.NewServeMux()
+		rr.HandleFunc("/register", s.Register)
+		rr.HandleFunc("/status", s.statusAuth(s.status))
+		s.registerServer = &http.Server{
+			Addr:      s.Config.RegisterAddr,
+			Handler:   rr,
+			TLSConfig: s.tlsConfig,
+		}
+	}
 	r.HandleFunc("/request", s.Request)
-	r.HandleFunc("/status", s.status)
+	r.HandleFunc("/status", s.statusAuth(s.status))
+	r.HandleFunc("/pools", s.statusAuth(s.listPools))
+	r.HandleFunc("/health", s.health)
+	r.HandleFunc("/healthz", s.health)
+	r.HandleFunc("/version", s.version)
+	r.HandleFunc("/admin/requests", s.admin(s.adminRequests))
+	r.HandleFunc("/admin/migrate", s.admin(s.adminMigrate))
+	r.HandleFunc("/admin/timeouts", s.admin(s.adminTimeouts))
+	r.HandleFunc("/admin/drain", s.admin(s.adminDrain))
+	r.HandleFunc("/admin/standby", s.admin(s.adminStandby))
+	r.HandleFunc("/admin/bans", s.admin(s.adminBans))
+	r.HandleFunc("/admin/rollout", s.admin(s.adminRollout))
+	r.HandleFunc("/admin/config", s.admin(s.adminConfig))
+	r.HandleFunc("/admin/strategy", s.admin(s.adminStrategy))
+	if s.metricsHandler != nil {
+		r.HandleFunc("/metrics", s.statusAuth(s.metricsHandler.ServeHTTP))
+	}
 
 	// Dispatch connection from available pools to clients requests
 	// in a separate thread from the server thread.
 	go s.dispatchConnections()
 
+	// Report pool state to the clients so they can autoscale their connections
+	if s.Config.StatsInterval > 0 {
+		go s.reportPoolStats()
+	}
+
 	s.server = &http.Server{
-		Addr:    s.Config.GetAddr(),
-		Handler: r,
+		Addr:      s.Config.GetAddr(),
+		Handler:   r,
+		TLSConfig: s.tlsConfig,
+	}
+	s.serve(s.server)
+	if s.registerServer != nil {
+		s.serve(s.registerServer)
 	}
-	go func() { log.Fatal(s.server.ListenAndServe()) }()
+}
+
+// serve listens on the address of the HTTP server and serves it in a separate goroutine until it is closed
+func (s *Server) serve(server *http.Server) {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		s.logger.Error("Unable to listen", "addr", server.Addr, "error", err)
+		os.Exit(1)
+	}
+	listener = newTCPListener(listener, s.Config, s.logger)
+
+	// Every listener serves TLS if configured, the clients then register with wss
+	go func() {
+		var err error
+		if s.tlsConfig != nil || (s.Config.TLSCertFile != "" && s.Config.TLSKeyFile != "") {
+			err = server.ServeTLS(listener, s.Config.TLSCertFile, s.Config.TLSKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Unable to serve", "addr", server.Addr, "error", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// SetTLSConfig serves https and wss with the TLS configuration ( e.g. certificates loaded from memory or client
+// certificate authentication ), TLSCertFile and TLSKeyFile are only loaded if it has no certificate.
+// It must be called before Start.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
 }
 
 // clean removes empty Pools which has no connection.
-// It is invoked every 5 sesconds and at shutdown.
+// It is invoked every 5 sesconds.
 func (s *Server) clean() {
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
 	if len(s.pools) == 0 {
+		s.lock.Unlock()
 		return
 	}
 
 	idle := 0
 	busy := 0
+	longLived := 0
 
+	// Pools are removed only after staying empty for the grace period
+	// so that a client reconnecting all its connections keeps its pool
+	now := time.Now()
+	grace := s.Config.GetEmptyPoolGracePeriod()
+
+	// The removed pools are shut down once the lock is released, closing their connections might take a while
+	var shutdowns []func()
 	var pools []*Pool
 	for _, pool := range s.pools {
-		if pool.IsEmpty() {
-			log.Printf("Removing empty connection pool : %s", pool.id)
-			pool.Shutdown()
+		pool := pool
+		wasEmpty := !pool.emptySince.IsZero()
+		empty, duration := pool.checkEmpty(now)
+		if empty && !wasEmpty {
+			s.poolHooks.add(s.Config.OnPoolEmpty, pool.id)
+		}
+		if empty && duration >= grace {
+			s.logEvent(Event{Event: EventPoolRemoved, PoolID: pool.id}, "Removing empty connection pool")
+			s.alert(AlertPoolDown, pool.id, "Pool %s removed after %s without connection", pool.id, duration.Round(time.Second))
+			shutdowns = append(shutdowns, func() { s.shutdownPool(pool, websocket.CloseGoingAway, "server shutdown") })
+			s.removeWeightedPool(pool)
+			s.metrics.IncCounter(MetricPoolsRemoved, nil)
+			s.poolHooks.add(s.Config.OnPoolRemove, pool.id)
+		} else if inactive := s.inactiveFor(pool, now); inactive > 0 {
+			s.logEvent(Event{Event: EventPoolRemoved, PoolID: pool.id}, "Removing connection pool inactive for %s", inactive.Round(time.Second))
+			shutdowns = append(shutdowns, func() { s.shutdownPool(pool, websocket.CloseNormalClosure, "inactive pool") })
+			s.removeWeightedPool(pool)
+			s.metrics.IncCounter(MetricPoolsRemoved, nil)
+			s.poolHooks.add(s.Config.OnPoolRemove, pool.id)
 		} else {
 			pools = append(pools, pool)
+			s.checkSourceDiversity(pool)
 		}
 
 		ps := pool.Size()
 		idle += ps.Idle
 		busy += ps.Busy
+		longLived += ps.LongLived
 	}
 
-	log.Printf("%d pools, %d idle, %d busy", len(pools), idle, busy)
+	s.logger.Info("Connection pools", "pools", len(pools), "idle", idle, "busy", busy, "long_lived", longLived)
+	s.checkAlerts(idle+busy+longLived > 0)
 
 	s.pools = pools
+	outdated := s.rolloutStep()
+	s.lock.Unlock()
+
+	closeOutdated(outdated)
+	for _, shutdown := range shutdowns {
+		shutdown()
+	}
+}
+
+// getPool returns the pool with the given id or nil
+func (s *Server) getPool(id PoolID) *Pool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, pool := range s.pools {
+		if pool.id == id {
+			return pool
+		}
+	}
+	return nil
+}
+
+// addPool adds a new pool to the server pools.
+// With Config.SortPools the pools are kept sorted by id, inserting at the right place
+// avoids sorting the whole slice, clean() filters the pools without changing their order.
+// This MUST be surrounded by s.lock.Lock()
+func (s *Server) addPool(pool *Pool) {
+	if !s.Config.SortPools {
+		s.pools = append(s.pools, pool)
+		return
+	}
+
+	i := sort.Search(len(s.pools), func(i int) bool { return s.pools[i].id >= pool.id })
+	s.pools = append(s.pools, nil)
+	copy(s.pools[i+1:], s.pools[i:])
+	s.pools[i] = pool
+}
+
+// dispatchablePools returns the pools the dispatcher can take connections from.
+// Pools in an active maintenance window and mirror pools are skipped.
+// This MUST be surrounded by s.lock.RLock()
+func (s *Server) dispatchablePools() (pools []*Pool) {
+	if len(s.Config.MaintenanceWindows) == 0 && s.Config.Mirror == nil {
+		return s.pools
+	}
+
+	now := time.Now()
+	for _, pool := range s.pools {
+		if s.inMaintenance(pool.id, now) || s.isMirrorPool(pool) {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return
+}
+
+// filterPools returns the pools accepted by the filter, all of them if it is nil
+func filterPools(pools []*Pool, filter func(pool *Pool) bool) []*Pool {
+	if filter == nil {
+		return pools
+	}
+
+	var filtered []*Pool
+	for _, pool := range pools {
+		if filter(pool) {
+			filtered = append(filtered, pool)
+		}
+	}
+	return filtered
+}
+
+// takeFailed accounts a connection the dispatcher could not take ( it lost a race or the connection is closed ).
+// A closed connection is removed from its pool right away rather than at the next clean,
+// it returns false if the pools are left with no connection at all so that the dispatch can give up.
+// After Config.MaxTakeFailures consecutive failures it backs off for Config.TakeFailureBackoff
+// to avoid a hot loop when many connections are racing.
+func (s *Server) takeFailed(ctx context.Context, connection *Connection, takeFailures *int) bool {
+	pool := connection.getPool()
+	s.metrics.IncCounter(MetricTakeFailures, s.poolLabels(pool))
+
+	if connection.isClosed() {
+		pool.removeConnection(connection)
+		if !s.hasConnections() {
+			return false
+		}
+	}
+
+	*takeFailures++
+	if s.Config.MaxTakeFailures <= 0 || *takeFailures < s.Config.MaxTakeFailures {
+		return true
+	}
+	*takeFailures = 0
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(s.Config.GetTakeFailureBackoff()):
+	}
+	return true
+}
+
+// hasConnections returns true if a dispatchable pool has at least one connection which is not closed
+func (s *Server) hasConnections() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, pool := range s.dispatchablePools() {
+		ps := pool.Size()
+		if ps.Idle+ps.Busy+ps.LongLived > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // Dispatch connection from available pools to clients requests
 func (s *Server) dispatchConnections() {
 	for {
 		// Runs in an infinite loop and keeps receiving the value from the `server.dispatcher` channel
-		// The operator <- is "receive operator", which expression blocks until a value is available.
-		request, ok := <-s.dispatcher
-		if !ok {
-			// The value of `ok` is false if it is a zero value generated because the channel is closed an empty.
-			// In this case, that means server shutdowns.
-			break
+		// until the server shutdowns, the requests are dispatched by priority then arrival order.
+		// The dispatcher channel is never closed so that a request racing with the shutdown can't send on a closed channel.
+		request := s.nextRequest()
+		if request == nil {
+			return
 		}
 
-		// A timeout is set for each dispatch request.
-		ctx := context.Background()
-		ctx, cancel := context.WithTimeout(ctx, s.Config.GetTimeout())
-		defer cancel()
+		s.dispatchRequest(request)
+	}
+}
 
-	L:
-		for {
-			select {
-			case <-ctx.Done(): // The timeout elapses
-				break L
-			default: // Go through
+// dispatchRequest looks for a connection until the deadline of the request
+// then closes its connection channel, the request err is set if none was found.
+// It returns false if the request has been put back in the queue because a higher priority one arrived meanwhile.
+func (s *Server) dispatchRequest(request *ConnectionRequest) (dispatched bool) {
+	defer func() {
+		if dispatched {
+			close(request.connection)
+		}
+	}()
+
+	// A timeout is set for each dispatch request, it runs from the time the request was created
+	// so that the time spent waiting in the queue counts.
+	ctx := context.Background()
+	ctx, cancel := context.WithDeadline(ctx, request.deadline)
+	defer cancel()
+
+	// Pools the request can take a connection from
+	filter := s.priorityFilter(request)
+
+	// Number of consecutive connections which could not be taken
+	takeFailures := 0
+
+L:
+	for {
+		select {
+		case <-ctx.Done(): // The timeout elapses
+			request.err = errDispatchTimeout
+			break L
+		default: // Go through
+		}
+
+		// Higher priority requests might have arrived meanwhile, they are dispatched first
+		s.drainRequests()
+		if s.queue.maxPriority() > request.priority {
+			s.requeue(request)
+			return false
+		}
+
+		// Requests of a session go to the pool their key hashes to while it has an idle connection
+		if request.sessionKey != "" {
+			if connection, pool := s.sessionConnection(ctx, request.sessionKey, filter); connection != nil {
+				if connection.takeFrom(pool) {
+					request.connection <- s.preferHealthy(s.preferAffinity(connection, pool, request.host), pool)
+					break
+				}
+				if !s.takeFailed(ctx, connection, &takeFailures) {
+					request.err = errDeadConnections
+					break
+				}
+				continue
 			}
+		}
 
-			s.lock.RLock()
-			if len(s.pools) == 0 {
-				// No connection pool available
-				s.lock.RUnlock()
+		// Clients advertising a weight are chosen proportionally to it
+		selector := s.strategy.Load().selector
+		if selector == nil && s.hasWeightedPools() {
+			selector = s.weightedSelector
+		}
+
+		if selector != nil {
+			connection, pool := s.selectConnection(ctx, selector, filter)
+			if connection == nil {
+				continue
+			}
+			if connection.takeFrom(pool) {
+				request.connection <- s.preferHealthy(s.preferAffinity(connection, pool, request.host), pool)
 				break
 			}
-
-			// [1]: Select a pool which has an idle connection
-			// Build a select statement dynamically to handle an arbitrary number of pools.
-			cases := make([]reflect.SelectCase, len(s.pools)+1)
-			for i, ch := range s.pools {
-				cases[i] = reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(ch.idle)}
+			if !s.takeFailed(ctx, connection, &takeFailures) {
+				request.err = errDeadConnections
+				break
 			}
-			cases[len(cases)-1] = reflect.SelectCase{
-				Dir: reflect.SelectDefault}
+			continue
+		}
+
+		s.lock.RLock()
+		pools := s.preferPriorityPools(s.preferActivePools(filterPools(s.dispatchablePools(), filter)))
+		if len(pools) == 0 {
+			// No connection pool available
 			s.lock.RUnlock()
+			break
+		}
 
-			_, value, ok := reflect.Select(cases)
-			if !ok {
-				continue // a pool has been removed, try again
-			}
-			connection, _ := value.Interface().(*Connection)
+		// [1]: Select a pool which has an idle connection
+		// Build a select statement dynamically to handle an arbitrary number of pools.
+		cases := make([]reflect.SelectCase, len(pools)+1)
+		for i, ch := range pools {
+			cases[i] = reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(ch.idle)}
+		}
+		cases[len(cases)-1] = reflect.SelectCase{
+			Dir: reflect.SelectDefault}
+		s.lock.RUnlock()
 
-			// [2]: Verify that we can use this connection and take it.
-			if connection.Take() {
-				request.connection <- connection
-				break
-			}
+		chosen, value, ok := reflect.Select(cases)
+		if !ok {
+			continue // a pool has been removed, try again
+		}
+		connection, _ := value.Interface().(*Connection)
+
+		// [2]: Verify that we can use this connection and take it.
+		if connection.takeFrom(pools[chosen]) {
+			request.connection <- s.preferHealthy(s.preferAffinity(connection, pools[chosen], request.host), pools[chosen])
+			break
+		}
+		if !s.takeFailed(ctx, connection, &takeFailures) {
+			request.err = errDeadConnections
+			break
 		}
+	}
+	return true
+}
 
-		close(request.connection)
+// Errors returned by dispatch
+var (
+	errServerShutdown = errors.New("server is shutting down")
+	errNoConnection   = errors.New("unable to get a proxy connection")
+	// No idle connection was found before the dispatch timeout
+	errDispatchTimeout = errors.New("unable to get a proxy connection before the timeout")
+	// The dispatcher only found closed connections and removed them
+	errDeadConnections = errors.New("unable to get a proxy connection, the pools had only dead connections")
+)
+
+// dispatch asks the dispatcher for a connection of a pool accepted by the filter ( any pool if nil ) with the given priority,
+// preferably of the pool the session key hashes to and one which last served the destination host.
+// It is taken by the caller which must release or close it.
+func (s *Server) dispatch(timeout time.Duration, priority int, host string, sessionKey string, filter func(pool *Pool) bool) (connection *Connection, err error) {
+	request := NewConnectionRequest(timeout)
+	request.filter = filter
+	request.priority = priority
+	request.host = host
+	request.sessionKey = sessionKey
+	// "Dispatcher" is running in a separate thread from the server by `go s.dispatchConnections()`.
+	// It waits to receive requests to dispatch connection from available pools to clients requests.
+	// https://github.com/hgsgtk/wsp/blob/ea4902a8e11f820268e52a6245092728efeffd7f/server/server.go#L93
+	//
+	// Notify request from handler to dispatcher through Server.dispatcher channel.
+	dispatchStart := time.Now()
+	select {
+	case <-s.done:
+		// The server is shutting down, the dispatcher is gone
+		return nil, errServerShutdown
+	case s.dispatcher <- request:
 	}
+	// Dispatcher tries to find an available connection pool,
+	// and it returns the connection through Server.connection channel.
+	// https://github.com/hgsgtk/wsp/blob/ea4902a8e11f820268e52a6245092728efeffd7f/server/server.go#L189
+	//
+	// Here waiting for a result from dispatcher.
+	connection = <-request.connection
+	if connection != nil {
+		// Taking the connection might leave its pool short of idle connections
+		go connection.pool.checkMinIdle()
+	}
+	dispatchWait := time.Since(dispatchStart)
+	s.metrics.ObserveHistogram(MetricDispatchWait, nil, dispatchWait.Seconds())
+	s.observeDispatchWait(dispatchWait)
+	if connection == nil {
+		// It means that dispatcher has set `nil` which is a system error case that is
+		// not expected in the normal flow.
+		if request.err != nil {
+			return nil, request.err
+		}
+		return nil, errNoConnection
+	}
+	return connection, nil
 }
 
 func (s *Server) Request(w http.ResponseWriter, r *http.Request) {
 	// [1]: Receive requests to be proxied
+	if s.isDraining() {
+		wsp.ProxyErrorStatusf(w, http.StatusServiceUnavailable, "Server is draining")
+		return
+	}
+
+	// Reject request smuggling attempts before forwarding anything
+	if err := validateFraming(r); err != nil {
+		wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Invalid request framing : %s", err)
+		return
+	}
+
+	// Oversized bodies are refused before anything is sent to a WSP client,
+	// the ones of unknown length are cut short as they stream
+	if max := int64(s.Config.MaxRequestBodyBytes); max > 0 {
+		if r.ContentLength > max {
+			wsp.ProxyErrorStatusf(w, http.StatusRequestEntityTooLarge, "Request body larger than %d bytes", max)
+			return
+		}
+		r.Body = newBodyLimiter(r.Body, max)
+	}
+
 	// Parse destination URL
+	// Callers of a pool advertising a base URL can send only the path
+	pr := new(proxiedRequest)
 	dstURL := r.Header.Get("X-PROXY-DESTINATION")
+	if dstURL == "" && r.Header.Get(PathHeader) != "" {
+		URL, err := url.Parse(r.Header.Get(PathHeader))
+		if err != nil || URL.IsAbs() {
+			wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Unable to parse %s header", PathHeader)
+			return
+		}
+		pr.path = URL
+		pr.filter = baseURLFilter(r.Header.Get(ServiceHeader))
+		dstURL = URL.String()
+	}
 	if dstURL == "" {
-		wsp.ProxyErrorf(w, "Missing X-PROXY-DESTINATION header")
+		wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Missing X-PROXY-DESTINATION header")
 		return
 	}
 	URL, err := url.Parse(dstURL)
 	if err != nil {
-		wsp.ProxyErrorf(w, "Unable to parse X-PROXY-DESTINATION header")
+		wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Unable to parse X-PROXY-DESTINATION header")
 		return
 	}
 	r.URL = URL
 
-	log.Printf("[%s] %s", r.Method, r.URL.String())
+	// Rewrite the destination path if needed
+	if len(s.Config.PathRewrites) > 0 {
+		if path := s.rewritePath(r.URL.Path); path != r.URL.Path {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+	}
+	if pr.path != nil {
+		pr.path = r.URL
+	}
 
-	if len(s.pools) == 0 {
-		wsp.ProxyErrorf(w, "No proxy available")
+	// Sign the request on behalf of the caller, the destination of a path is only known after dispatch
+	if s.Config.RequestSigner != nil && pr.path == nil {
+		if err := s.Config.RequestSigner.Sign(r); err != nil {
+			wsp.ProxyErrorStatusf(w, http.StatusInternalServerError, "Unable to sign request : %s", err)
+			return
+		}
+	}
+
+	// Correlate the events of the request
+	pr.id = newRequestID()
+	pr.start = time.Now()
+	s.logEvent(Event{Event: EventRequestStart, RequestID: pr.id, Method: r.Method, Destination: r.URL.String()},
+		"Request start")
+
+	// Client retries and load balancer replays might send the same request again
+	w, completed, ok := s.checkDuplicate(w, r)
+	if !ok {
 		return
 	}
+	defer completed()
 
-	// [2]: Take an WebSocket connection available from pools for relaying received requests.
-	request := NewConnectionRequest(s.Config.GetTimeout())
-	// "Dispatcher" is running in a separate thread from the server by `go s.dispatchConnections()`.
-	// It waits to receive requests to dispatch connection from available pools to clients requests.
-	// https://github.com/hgsgtk/wsp/blob/ea4902a8e11f820268e52a6245092728efeffd7f/server/server.go#L93
-	//
-	// Notify request from handler to dispatcher through Server.dispatcher channel.
-	s.dispatcher <- request
-	// Dispatcher tries to find an available connection pool,
-	// and it returns the connection through Server.connection channel.
-	// https://github.com/hgsgtk/wsp/blob/ea4902a8e11f820268e52a6245092728efeffd7f/server/server.go#L189
-	//
-	// Here waiting for a result from dispatcher.
-	connection := <-request.connection
-	if connection == nil {
-		// It means that dispatcher has set `nil` which is a system error case that is
-		// not expected in the normal flow.
-		wsp.ProxyErrorf(w, "Unable to get a proxy connection")
+	// Shutdown removes the pools, requests arriving afterwards are refused rather than told no proxy is available
+	select {
+	case <-s.done:
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		wsp.ProxyErrorStatus(w, http.StatusServiceUnavailable, errServerShutdown)
+		return
+	default:
+	}
+
+	s.lock.RLock()
+	poolCount := len(s.pools)
+	s.lock.RUnlock()
+	if poolCount == 0 {
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		wsp.ProxyErrorStatusf(w, http.StatusBadGateway, "No proxy available")
+		return
+	}
+
+	// Callers can wait for a connection more or less than the default
+	if pr.dispatchTimeout, err = s.dispatchTimeout(r); err != nil {
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		wsp.ProxyErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Callers can address a specific client rather than any of them
+	if id := PoolID(r.Header.Get(PoolHeader)); id != "" {
+		pool := s.getPool(id)
+		if pool == nil {
+			s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+			wsp.ProxyErrorStatusf(w, http.StatusServiceUnavailable, "Pool %s is not connected", id)
+			return
+		}
+		// The operator override of the pool wins over the caller
+		if timeout := pool.GetDispatchTimeout(); timeout > 0 {
+			pr.dispatchTimeout = timeout
+		}
+		pr.pool = id
+		pr.filter = andFilters(pr.filter, poolFilter(id))
+	}
+
+	// A single caller can't consume all the pools capacity
+	caller := s.callerIdentity(r)
+	if !s.acquireCaller(caller) {
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		wsp.ProxyErrorStatusf(w, http.StatusTooManyRequests, "Too many requests in flight for caller %s", caller)
+		return
+	}
+	defer s.releaseCaller(caller)
+
+	// Streaming requests are limited so that short requests retain capacity
+	pr.streaming = isStreamingRequest(r)
+	if !s.admitLongLivedRequest(pr.streaming) {
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		wsp.ProxyErrorStatusf(w, http.StatusServiceUnavailable, "Too many long-lived requests")
 		return
 	}
 
+	// Shadow the request to the mirror pools alongside the primary one,
+	// streaming requests would hold the mirror connections for too long
+	if !pr.streaming {
+		if mirrored := s.mirrorRequest(r); mirrored != nil {
+			go s.relayMirror(mirrored, pr.id)
+		}
+	}
+
+	// [2]: Take an WebSocket connection available from pools for relaying received requests.
+	// Responses with a retryable status are not written to the caller
+	// and the request is sent again through another connection
+	retries := 0
+	if !pr.streaming && s.isReplayable(r) {
+		retries = s.Config.MaxStatusRetries
+	}
+	for attempt := 0; s.proxy(w, r, pr, attempt < retries); attempt++ {
+		s.logger.Info("Retrying request after a retryable status", "request_id", pr.id, "method", r.Method, "destination", r.URL.String())
+	}
+}
+
+// proxiedRequest holds the state of a request shared by its attempts
+type proxiedRequest struct {
+	id        string
+	start     time.Time
+	streaming bool
+
+	// Path to append to the base URL of the pool and filter of the pools advertising one
+	path   *url.URL
+	filter func(pool *Pool) bool
+
+	// Pool addressed with the PoolHeader, empty for any pool
+	pool PoolID
+
+	// Time to wait for a connection
+	dispatchTimeout time.Duration
+}
+
+// proxy dispatches a connection and relays the request through it.
+// With retry a response having a retryable status is not written to the caller and proxy returns true.
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, pr *proxiedRequest, retry bool) bool {
+	// The destination host of a path is only known after dispatch
+	host := r.URL.Host
+	if pr.path != nil {
+		host = ""
+	}
+	dispatchStart := time.Now()
+	connection, err := s.dispatch(pr.dispatchTimeout, s.requestPriority(r), host, s.requestSessionKey(r), pr.filter)
+	dispatchWait := time.Since(dispatchStart)
+	if err != nil {
+		if pr.streaming {
+			atomic.AddInt64(&s.longLived, -1)
+		}
+		s.metrics.IncCounter(MetricRequestErrors, s.poolLabels(nil))
+		if pr.pool != "" {
+			err = fmt.Errorf("%w from pool %s", err, pr.pool)
+		}
+		if errors.Is(err, errDispatchTimeout) {
+			atomic.AddInt64(&s.dispatchTimeouts, 1)
+		}
+		switch {
+		case errors.Is(err, errServerShutdown):
+			wsp.ProxyErrorStatus(w, http.StatusServiceUnavailable, err)
+		case s.Config.RetryAfterBase > 0:
+			// Callers are told when to come back with the status Retry-After goes with
+			w.Header().Set("Retry-After", strconv.Itoa(s.retryAfter()))
+			wsp.ProxyErrorStatus(w, http.StatusServiceUnavailable, err)
+		case errors.Is(err, errDispatchTimeout):
+			wsp.ProxyErrorStatus(w, http.StatusGatewayTimeout, err)
+		default:
+			wsp.ProxyErrorStatus(w, http.StatusBadGateway, err)
+		}
+		return false
+	}
+
+	atomic.AddInt64(&connection.pool.requests, 1)
+	proxyStart := time.Now()
+	defer func() { atomic.AddInt64(&connection.pool.requestTime, int64(time.Since(proxyStart))) }()
+	poolLabels := s.poolLabels(connection.pool)
+	s.metrics.IncCounter(MetricRequests, poolLabels)
+
+	llr := s.newLongLivedRequest(connection, pr.streaming)
+	if llr == nil {
+		connection.Release()
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+		wsp.ProxyErrorStatusf(w, http.StatusServiceUnavailable, "Too many long-lived requests for pool %s", connection.pool.id)
+		return false
+	}
+	defer llr.finish()
+
+	// The destination of a path is the base URL of the pool
+	if pr.path != nil {
+		r.URL = connection.pool.destination(pr.path)
+		if s.Config.RequestSigner != nil {
+			if err := s.Config.RequestSigner.Sign(r); err != nil {
+				connection.Release()
+				s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+				wsp.ProxyErrorStatusf(w, http.StatusInternalServerError, "Unable to sign request : %s", err)
+				return false
+			}
+		}
+	}
+
 	// [3]: Send the request to the peer through the WebSocket connection.
-	if err := connection.proxyRequest(w, r); err != nil {
-		// An error occurred throw the connection away
-		log.Println(err)
+	// Register the request so that it can be listed and canceled,
+	// a canceled request gets its connection thrown away to abort the relay
+	ctx, done := s.inFlight.add(pr.id, r.Method, r.URL.String(), connection.pool.id)
+	defer done()
+
+	// The relay through this pool might be bounded by an operator override,
+	// the timer is stopped as soon as the relay returns
+	stopTimeout := func() {}
+	if timeout := connection.pool.GetProxyTimeout(); timeout > 0 {
+		ctx, stopTimeout = context.WithTimeout(ctx, timeout)
+	}
+
+	// proxyRequest releases the connection before returning, it might already serve another request
+	// when the watcher wakes up so it only acts on the connection while it still serves this one
+	take := connection.currentTake()
+	relayed := make(chan struct{})
+	watched := make(chan struct{})
+	timedOut := false
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+		case <-r.Context().Done():
+			// The caller went away, the peer aborts the upstream request and answers quickly
+			// so the connection can be released rather than thrown away
+			if connection.sendCancel(take) {
+				select {
+				case <-relayed:
+					return
+				case <-ctx.Done():
+				case <-time.After(s.Config.GetCancelTimeout()):
+				}
+			}
+		case <-relayed:
+			return
+		}
+		if connection.closeTake(take, websocket.CloseNormalClosure, "request canceled") {
+			timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		}
+	}()
+
+	var retryable func(status int) bool
+	if retry {
+		retryable = s.isRetryableStatus
+	}
+
+	sw := newStatusWriter(w)
+	if s.Config.ExposeDispatchHeaders {
+		sw.beforeWriteHeader = func(header http.Header) {
+			setDispatchHeaders(header, dispatchWait, connection.pool.id, time.Since(proxyStart))
+		}
+	}
+	err = connection.proxyRequest(sw, r, pr.id, retryable)
+	close(relayed)
+	<-watched
+	stopTimeout()
+	success := err == nil && sw.status < http.StatusInternalServerError
+	connection.pool.recordResult(success)
+	connection.pool.recordActivity(success, sw.written)
+	if errors.Is(err, errRetryableStatus) {
+		// The connection has been released, it is still usable
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+		return true
+	}
+	if errors.Is(err, errCallerGone) {
+		// The connection has been released and nobody is left to answer
+		s.logEvent(Event{Event: EventRequestError, RequestID: pr.id, PoolID: connection.pool.id, Method: r.Method,
+			Destination: r.URL.String(), Duration: time.Since(pr.start).Seconds() * 1000, Error: err.Error()}, "%s", err)
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+		return false
+	}
+	if errors.Is(err, errUpstreamResponse) {
+		// The connection has been released, only the upstream response is at fault
+		s.logEvent(Event{Event: EventRequestError, RequestID: pr.id, PoolID: connection.pool.id, Method: r.Method,
+			Destination: r.URL.String(), Duration: time.Since(pr.start).Seconds() * 1000, Error: err.Error()}, "%s", err)
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+		wsp.ProxyErrorStatus(w, http.StatusBadGateway, err)
+		return false
+	}
+	if errors.Is(err, errRequestBodyCanceled) {
+		// The connection has been released, the caller is told why its request was cut short
+		s.logEvent(Event{Event: EventRequestError, RequestID: pr.id, PoolID: connection.pool.id, Method: r.Method,
+			Destination: r.URL.String(), Duration: time.Since(pr.start).Seconds() * 1000, Error: err.Error()}, "%s", err)
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
+		wsp.ProxyErrorStatusf(w, http.StatusRequestEntityTooLarge, "Request body larger than %d bytes", s.Config.MaxRequestBodyBytes)
+		return false
+	}
+	if err != nil {
+		// An error occurred on the connection, throw it away
+		s.logEvent(Event{Event: EventRequestError, RequestID: pr.id, PoolID: connection.pool.id, Method: r.Method,
+			Destination: r.URL.String(), Duration: time.Since(pr.start).Seconds() * 1000, Error: err.Error()}, "%s", err)
 		connection.Close()
+		s.metrics.IncCounter(MetricRequestErrors, poolLabels)
 
 		// Try to return an error to the client
 		// This might fail if response headers have already been sent
+		if timedOut {
+			wsp.ProxyErrorStatusf(w, http.StatusGatewayTimeout, "Proxy timeout for pool %s", connection.pool.id)
+			return false
+		}
+		if errors.Is(err, errResponseHeaderTooLarge) {
+			wsp.ProxyErrorStatus(w, http.StatusBadGateway, err)
+			return false
+		}
+		if errors.Is(err, errRequestBodyTooLarge) {
+			wsp.ProxyErrorStatusf(w, http.StatusRequestEntityTooLarge, "Request body larger than %d bytes", s.Config.MaxRequestBodyBytes)
+			return false
+		}
 		wsp.ProxyError(w, err)
+		return false
 	}
+
+	s.logEvent(Event{Event: EventRequestEnd, RequestID: pr.id, PoolID: connection.pool.id, Method: r.Method,
+		Destination: r.URL.String(), Status: sw.status, Duration: time.Since(pr.start).Seconds() * 1000},
+		"Request end")
+	return false
 }
 
 // Request receives the WebSocket upgrade handshake request from wsp_client.
 func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	// The whole handshake is bounded so that a peer stalling between the steps can't hold the server resources
+	deadline := s.handshakeDeadline(time.Now())
+
+	// Explain the mistake to clients not opening a websocket rather than failing the upgrade
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed, register with a websocket upgrade GET request", r.Method)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		wsp.ProxyErrorStatusf(w, http.StatusUpgradeRequired, "Missing websocket upgrade, register with a WSP client")
+		return
+	}
+
+	// Banned IPs are refused before even checking their key
+	if s.isBanned(sourceIP(r)) {
+		wsp.ProxyErrorStatusf(w, http.StatusForbidden, "Too many authentication failures")
+		return
+	}
+
 	// 1. Upgrade a received HTTP request to a WebSocket connection
-	secretKey := r.Header.Get("X-SECRET-KEY")
-	if secretKey != s.Config.SecretKey {
-		wsp.ProxyErrorf(w, "Invalid X-SECRET-KEY")
+	authenticatedID, err := s.authenticate(r)
+	if err != nil {
+		s.authFailed(r, err)
+		wsp.ProxyErrorf(w, "%s", err)
+		return
+	}
+
+	// The clients reconnect to another replica
+	if s.isDraining() {
+		wsp.ProxyErrorStatusf(w, http.StatusServiceUnavailable, "Server is draining")
 		return
 	}
 
-	ws, err := s.upgrader.Upgrade(w, r, nil)
+	// Limit the number of connections a single host can open
+	ip := sourceIP(r)
+	if !s.acquireSourceIP(ip) {
+		wsp.ProxyErrorStatusf(w, http.StatusTooManyRequests, "Too many connections from %s", ip)
+		return
+	}
+	registered := false
+	defer func() {
+		if !registered {
+			s.releaseSourceIP(ip)
+		}
+	}()
+
+	// Send a nonce the peer must sign with the secret key to prevent handshake replays
+	var responseHeader http.Header
+	var challenge string
+	if s.Config.RequireChallenge {
+		challenge, err = wsp.NewChallenge()
+		if err != nil {
+			wsp.ProxyErrorStatusf(w, http.StatusInternalServerError, "Unable to create challenge : %s", err)
+			return
+		}
+		responseHeader = http.Header{wsp.ChallengeHeader: {challenge}}
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		wsp.ProxyErrorf(w, "HTTP upgrade error : %v", err)
 		return
 	}
+	ws.SetReadDeadline(deadline)
+	ws.SetWriteDeadline(deadline)
+
+	if s.Config.RequireChallenge && !s.verifyChallenge(ws, challenge, deadline) {
+		return
+	}
 
 	// 2. Wait a greeting message from the peer and parse it
 	// The first message should contains the remote Proxy name and size
+	// An oversized greeting makes the websocket send a "message too big" close frame
+	ws.SetReadLimit(maxGreetingSize)
 	_, greeting, err := ws.ReadMessage()
 	if err != nil {
-		wsp.ProxyErrorf(w, "Unable to read greeting message : %s", err)
+		// The connection is upgraded, errors can't be written to the HTTP response anymore
+		if isTimeout(err) {
+			s.logger.Warn("Register handshake timeout", "source_ip", ip, "timeout", s.Config.GetRegisterHandshakeTimeout())
+		} else {
+			s.logger.Warn("Unable to read greeting message", "source_ip", ip, "error", err)
+		}
 		ws.Close()
 		return
 	}
+	ws.SetReadLimit(0)
 
 	// Parse the greeting message
-	split := strings.Split(string(greeting), "_")
-	id := PoolID(split[0])
-	size, err := strconv.Atoi(split[1])
+	message, err := parseGreeting(string(greeting))
 	if err != nil {
-		wsp.ProxyErrorf(w, "Unable to parse greeting message : %s", err)
-		ws.Close()
+		// The error can only be sent in the close frame
+		s.logger.Warn("Rejecting connection", "source_ip", ip, "error", err)
+		rejectHandshake(ws, wsp.CloseInvalidGreeting, err.Error())
 		return
 	}
+	id := PoolID(message.ID)
+	// The authenticated identity decides the pool rather than the client
+	if authenticatedID != "" {
+		id = authenticatedID
+	}
 
 	// 3. Register the connection into server pools.
+	// The handshake is rejected once the locks are released so that a slow peer can't hold them
+	// while the close frame is written.
+	pool, rejected := s.registerConnection(r, ws, ip, id, message)
+	if rejected != nil {
+		rejectHandshake(ws, rejected.code, rejected.reason)
+		return
+	}
+	registered = pool != nil
+}
+
+// handshakeRejection is the close code and reason a registration is refused with
+type handshakeRejection struct {
+	code   int
+	reason string
+}
+
+// registerConnection adds the connection of the peer to its pool, creating the pool if needed.
+// It returns the pool or the rejection of the connection, nil for both if the pool has been shut down meanwhile.
+func (s *Server) registerConnection(r *http.Request, ws *websocket.Conn, ip string, id PoolID, message *wsp.GreetingMessage) (*Pool, *handshakeRejection) {
+	size, weight := message.Size, message.Weight
+
+	// The connections replaced by the rollout are closed once the lock is released
+	var outdated []*Connection
+	defer func() { closeOutdated(outdated) }()
+
 	// s.lock is for exclusive control of pools operation.
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	// Connections of outdated clients are refused once the new version provides the capacity
+	version := message.Version
+	if version == "" {
+		version = unknownVersion
+	}
+	if !s.acceptsVersion(version) {
+		s.logger.Warn("Rejecting connection : outdated client version", "source_ip", ip, "pool_id", id, "version", version)
+		return nil, &handshakeRejection{wsp.CloseLimitExceeded, fmt.Sprintf("client version %s is being replaced by %s", version, s.rollout.version)}
+	}
+
 	var pool *Pool
+	created := false
 	// There is no need to create a new pool,
 	// if it is already registered in current pools.
 	for _, p := range s.pools {
@@ -300,27 +1200,133 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
+
+	// The limits are checked before creating the pool so that a refused connection leaves no pool behind
+	if pool == nil && s.Config.MaxPools > 0 && len(s.pools) >= s.Config.MaxPools {
+		s.logger.Warn("Rejecting connection : too many pools", "source_ip", ip, "pool_id", id, "max_pools", s.Config.MaxPools)
+		return nil, &handshakeRejection{wsp.CloseLimitExceeded, fmt.Sprintf("too many pools ( %d )", s.Config.MaxPools)}
+	}
+	if max := s.Config.MaxConnectionsPerPool; max > 0 {
+		if pool != nil {
+			if ps := pool.Size(); ps.Idle+ps.Busy+ps.LongLived >= max {
+				s.logger.Warn("Rejecting connection : too many connections for the pool", "source_ip", ip, "pool_id", id, "max_connections", max)
+				return nil, &handshakeRejection{wsp.CloseLimitExceeded, fmt.Sprintf("too many connections for pool %s ( %d )", id, max)}
+			}
+		}
+		if size > max {
+			size = max
+		}
+	}
+
 	if pool == nil {
 		pool = NewPool(s, id)
-		s.pools = append(s.pools, pool)
+		created = true
+		s.addPool(pool)
+		s.logEvent(Event{Event: EventPoolCreated, PoolID: id}, "Creating connection pool")
+		s.metrics.IncCounter(MetricPoolsCreated, nil)
+		s.poolHooks.add(s.Config.OnPoolRegister, id)
 	}
+
 	// update pool size
-	pool.size = size
+	pool.setSize(size)
+	s.setPoolWeight(pool, weight)
+	if header := r.Header.Get(wsp.LabelsHeader); header != "" {
+		pool.setLabels(parseLabels(header))
+	}
+	if created {
+		pool.SetStandby(pool.Labels()[StandbyLabel] == "true")
+	}
+	if header := r.Header.Get(wsp.BaseURLHeader); header != "" {
+		if baseURL, err := url.Parse(header); err == nil && baseURL.IsAbs() {
+			pool.setBaseURL(baseURL)
+		} else {
+			s.logger.Warn("Ignoring invalid base URL", "pool_id", id, "base_url", header)
+		}
+	}
 
 	// Add the WebSocket connection to the pool
-	pool.Register(ws)
+	var eligiblePools []PoolID
+	if s.Config.AllowConnectionMigration {
+		eligiblePools = parseEligiblePools(r.Header.Get(wsp.EligiblePoolsHeader))
+	}
+	// The handshake is done, idle connections are checked by pings from now on
+	ws.SetReadDeadline(time.Time{})
+	ws.SetWriteDeadline(time.Time{})
+	if registered, rejected := pool.register(ws, ip, eligiblePools, message); !registered {
+		return nil, rejected
+	}
+	s.metrics.IncCounter(MetricConnectionsRegistered, s.poolLabels(pool))
+	outdated = s.rolloutStep()
+	return pool, nil
+}
+
+// verifyChallenge waits for the peer answer to the challenge and checks it.
+// It closes the websocket and returns false if the answer is wrong or does not come in time
+// or before the handshake deadline ( zero if unbounded ).
+func (s *Server) verifyChallenge(ws *websocket.Conn, challenge string, deadline time.Time) bool {
+	challengeDeadline := time.Now().Add(s.Config.GetChallengeTimeout())
+	if !deadline.IsZero() && deadline.Before(challengeDeadline) {
+		challengeDeadline = deadline
+	}
+	ws.SetReadDeadline(challengeDeadline)
+	_, response, err := ws.ReadMessage()
+	ws.SetReadDeadline(deadline)
+
+	if err != nil || !s.verifyChallengeResponse(challenge, string(response)) {
+		s.logger.Warn("Invalid challenge response", "error", err)
+		rejectHandshake(ws, websocket.ClosePolicyViolation, "invalid challenge response")
+		return false
+	}
+
+	return true
 }
 
-func (s *Server) status(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("ok"))
+// rejectHandshake sends a close frame with the code and reason to the peer then closes the websocket
+func rejectHandshake(ws *websocket.Conn, code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeWriteTimeout))
+	ws.Close()
 }
 
 // Shutdown stop the Server
+// It is safe to call it several times, even concurrently, only the first call performs the teardown.
+// With Config.PoolShutdownTimeout it waits up to this timeout for the requests in flight to be done.
 func (s *Server) Shutdown() {
-	close(s.done)
-	close(s.dispatcher)
-	for _, pool := range s.pools {
-		pool.Shutdown()
-	}
-	s.clean()
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+
+		// The pools are removed first so that no request is dispatched to them anymore,
+		// then they are shut down in parallel
+		s.lock.Lock()
+		pools := s.pools
+		s.pools = nil
+		atomic.StoreInt32(&s.weightedPools, 0)
+		s.lock.Unlock()
+
+		var wg sync.WaitGroup
+		for _, pool := range pools {
+			wg.Add(1)
+			go func(pool *Pool) {
+				defer wg.Done()
+				s.shutdownPool(pool, websocket.CloseGoingAway, "server shutdown")
+			}(pool)
+		}
+		wg.Wait()
+		if timeout := s.Config.GetPoolShutdownTimeout(); timeout > 0 {
+			waitPoolsIdle(pools, timeout)
+		}
+		for _, pool := range pools {
+			s.logEvent(Event{Event: EventPoolRemoved, PoolID: pool.id}, "Removing connection pool")
+			s.metrics.IncCounter(MetricPoolsRemoved, nil)
+			s.poolHooks.add(s.Config.OnPoolRemove, pool.id)
+		}
+		s.poolHooks.flush()
+
+		// The listeners are closed once the pools are shut down so that the requests in flight can still be answered
+		for _, server := range []*http.Server{s.server, s.registerServer} {
+			if server != nil {
+				server.Close()
+			}
+		}
+	})
 }
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp/client"
+)
+
+// newTestServer serves the register and request endpoints of a new server and starts its dispatcher
+func newTestServer(t *testing.T, config *Config) (*Server, *httptest.Server) {
+	t.Helper()
+
+	s := NewServer(config)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.Register)
+	mux.HandleFunc("/request", s.Request)
+	ts := httptest.NewServer(mux)
+	go s.dispatchConnections()
+
+	t.Cleanup(func() {
+		s.Shutdown()
+		ts.Close()
+	})
+	return s, ts
+}
+
+// registerURL returns the websocket URL of the register endpoint of the test server
+func registerURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/register"
+}
+
+// dialTestServer opens a websocket to the register endpoint and sends the greeting
+func dialTestServer(t *testing.T, ts *httptest.Server, greeting string) *websocket.Conn {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(registerURL(ts), nil)
+	if err != nil {
+		t.Fatalf("unable to dial the test server : %s", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(greeting)); err != nil {
+		t.Fatalf("unable to write the greeting : %s", err)
+	}
+	return ws
+}
+
+// startTestClient connects a WSP client to the test server and waits for its idle connections
+func startTestClient(t *testing.T, s *Server, ts *httptest.Server, configure func(config *client.Config)) *client.Client {
+	t.Helper()
+
+	config := client.NewConfig()
+	config.Targets = []string{registerURL(ts)}
+	config.PoolIdleSize = 1
+	config.PoolMaxSize = 10
+	if configure != nil {
+		configure(config)
+	}
+
+	c := client.NewClient(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		c.Shutdown()
+	})
+
+	waitFor(t, func() bool {
+		for _, pool := range s.Pools() {
+			if pool.ID == PoolID(config.ID) && pool.Idle >= config.PoolIdleSize {
+				return true
+			}
+		}
+		return false
+	})
+	return c
+}
+
+// waitFor fails the test if the condition does not become true within a few seconds
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// closeCode returns the close code of the next message read from the websocket, 0 if it is not a close
+func closeCode(t *testing.T, ws *websocket.Conn) int {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		return closeErr.Code
+	}
+	return 0
+}
+
+// proxyTestRequest sends a request to the destination through the test server
+func proxyTestRequest(t *testing.T, ts *httptest.Server, method string, destination string, header http.Header) *http.Response {
+	t.Helper()
+
+	r, err := http.NewRequest(method, ts.URL+"/request", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	r.Header.Set("X-PROXY-DESTINATION", destination)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("unable to proxy request : %s", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRegisterAndProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+
+	resp := proxyTestRequest(t, ts, http.MethodGet, upstream.URL, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
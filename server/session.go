@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+)
+
+// Sticky sessions dispatch the requests carrying the same session key ( Config.SessionKeyHeader ) to the same pool.
+// The key is hashed with rendezvous hashing so that a pool joining or leaving only moves the sessions hashed to it,
+// the dispatcher falls back to its strategy while the preferred pool has no idle connection.
+
+// requestSessionKey returns the session key of the request from Config.SessionKeyHeader, empty if none
+func (s *Server) requestSessionKey(r *http.Request) string {
+	if s.Config.SessionKeyHeader == "" {
+		return ""
+	}
+	return r.Header.Get(s.Config.SessionKeyHeader)
+}
+
+// sessionPool returns the pool accepted by the filter which the session key hashes to, nil if there is none
+func (s *Server) sessionPool(key string, filter func(pool *Pool) bool) *Pool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var preferred *Pool
+	var best uint64
+	for _, pool := range filterPools(s.dispatchablePools(), filter) {
+		h := fnv.New64a()
+		h.Write([]byte(pool.id))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mixHash(h.Sum64()); preferred == nil || score > best {
+			preferred, best = pool, score
+		}
+	}
+	return preferred
+}
+
+// sessionConnection waits for an idle connection of the pool the session key hashes to.
+// It returns nil right away if this pool has no idle connection.
+func (s *Server) sessionConnection(ctx context.Context, key string, filter func(pool *Pool) bool) (*Connection, *Pool) {
+	pool := s.sessionPool(key, filter)
+	if pool == nil || pool.Size().Idle == 0 {
+		return nil, nil
+	}
+
+	// An idle connection always has a pending offer on the pool idle channel
+	select {
+	case connection := <-pool.idle:
+		return connection, pool
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+// mixHash is the murmur3 finalizer, FNV alone barely spreads a difference
+// between pool ids so that every key would prefer the same pool
+func mixHash(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
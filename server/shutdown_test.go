@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestShutdownClosesConnections(t *testing.T) {
+	config := NewConfig()
+	var removed []PoolID
+	var removedLock sync.Mutex
+	config.OnPoolRemove = func(id PoolID) {
+		removedLock.Lock()
+		removed = append(removed, id)
+		removedLock.Unlock()
+	}
+	s, ts := newTestServer(t, config)
+
+	var connections []*websocket.Conn
+	for _, id := range []PoolID{"a", "a", "b"} {
+		connections = append(connections, dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: string(id), Size: 1})))
+	}
+	waitFor(t, func() bool { return connectionCount(s, "a") == 2 && connectionCount(s, "b") == 1 })
+
+	s.Shutdown()
+
+	for i, ws := range connections {
+		if code := closeCode(t, ws); code != websocket.CloseGoingAway {
+			t.Errorf("connection %d : got close code %d, want %d", i, code, websocket.CloseGoingAway)
+		}
+	}
+	if pools := s.Pools(); len(pools) != 0 {
+		t.Errorf("got %d pools after shutdown, want none", len(pools))
+	}
+
+	removedLock.Lock()
+	defer removedLock.Unlock()
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	if len(removed) != 2 || removed[0] != "a" || removed[1] != "b" {
+		t.Errorf("got OnPoolRemove calls for %v, want [a b]", removed)
+	}
+}
+
+func TestShutdownWaitsForRequestsInFlight(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	config := NewConfig()
+	config.PoolShutdownTimeout = 5000
+	s, ts := newTestServer(t, config)
+	startTestClient(t, s, ts, nil)
+
+	status := make(chan int, 1)
+	go func() {
+		r, _ := http.NewRequest(http.MethodGet, ts.URL+"/request", nil)
+		r.Header.Set("X-PROXY-DESTINATION", upstream.URL)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	waitFor(t, func() bool { return len(s.InFlightRequests()) == 1 })
+	pool := s.getPool(s.Pools()[0].ID)
+
+	start := time.Now()
+	s.Shutdown()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s, want it to return once the request is done", elapsed)
+	}
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("got status %d for the request in flight, want %d", got, http.StatusOK)
+	}
+
+	// The pool drained before the timeout, its timer must not linger
+	waitFor(t, func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.shutdownTimer == nil
+	})
+}
+
+func TestShutdownConcurrentCalls(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls int
+	}{
+		{name: "single call", calls: 1},
+		{name: "concurrent calls", calls: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, ts := newTestServer(t, NewConfig())
+			ws := dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+			waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+
+			// A second Shutdown call runs in the cleanup of the test server
+			var wg sync.WaitGroup
+			for i := 0; i < test.calls; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.Shutdown()
+				}()
+			}
+			wg.Wait()
+
+			if code := closeCode(t, ws); code != websocket.CloseGoingAway {
+				t.Errorf("got close code %d, want %d", code, websocket.CloseGoingAway)
+			}
+			select {
+			case <-s.done:
+			default:
+				t.Error("the done channel is still open after shutdown")
+			}
+		})
+	}
+}
+
+func TestRequestsDuringShutdown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	s, ts := newTestServer(t, NewConfig())
+	startTestClient(t, s, ts, nil)
+
+	request := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/request", nil)
+		r.Header.Set("X-PROXY-DESTINATION", upstream.URL)
+		w := httptest.NewRecorder()
+		s.Request(w, r)
+		return w.Code
+	}
+
+	// The requests racing with the shutdown are either proxied or refused, they must never panic
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch code := request(); code {
+			case http.StatusOK, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			default:
+				t.Errorf("got status %d for a request racing with the shutdown", code)
+			}
+		}()
+	}
+	s.Shutdown()
+	wg.Wait()
+
+	if code := request(); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d after shutdown, want %d", code, http.StatusServiceUnavailable)
+	}
+}
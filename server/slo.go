@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// sloMinSamples is the number of dispatches required in the window before the SLO can be violated
+// so that a handful of slow dispatches while idle do not trigger it
+const sloMinSamples = 20
+
+// sloBucket counts the dispatches of one second
+type sloBucket struct {
+	second int64
+	total  int
+	within int // dispatches which waited less than the threshold
+}
+
+// dispatchWaitSLO computes the share of the dispatches waiting less than a threshold over a rolling window
+type dispatchWaitSLO struct {
+	threshold time.Duration
+	target    float64 // percentage of the dispatches which must wait less than threshold
+	buckets   []sloBucket
+	violated  bool
+	lock      sync.Mutex
+}
+
+// newDispatchWaitSLO creates a new dispatchWaitSLO with one second buckets covering the window
+func newDispatchWaitSLO(threshold time.Duration, target float64, window time.Duration) (slo *dispatchWaitSLO) {
+	slo = new(dispatchWaitSLO)
+	slo.threshold = threshold
+	slo.target = target
+	size := int((window + time.Second - 1) / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	slo.buckets = make([]sloBucket, size)
+	return
+}
+
+// observe records a dispatch wait, it returns the compliance, whether the SLO is violated and whether it changed
+func (slo *dispatchWaitSLO) observe(wait time.Duration, now time.Time) (compliance float64, violated bool, changed bool) {
+	slo.lock.Lock()
+	defer slo.lock.Unlock()
+
+	second := now.Unix()
+	bucket := &slo.buckets[second%int64(len(slo.buckets))]
+	if bucket.second != second {
+		*bucket = sloBucket{second: second}
+	}
+	bucket.total++
+	if wait < slo.threshold {
+		bucket.within++
+	}
+
+	compliance, total := slo.compute(second)
+	violated = total >= sloMinSamples && compliance < slo.target
+	changed = violated != slo.violated
+	slo.violated = violated
+	return compliance, violated, changed
+}
+
+// compliance returns the percentage of the dispatches of the window which waited less than the threshold
+func (slo *dispatchWaitSLO) compliance(now time.Time) float64 {
+	slo.lock.Lock()
+	defer slo.lock.Unlock()
+
+	compliance, _ := slo.compute(now.Unix())
+	return compliance
+}
+
+// compute the compliance and the number of dispatches over the window ending at second
+// This MUST be surrounded by slo.lock.Lock()
+func (slo *dispatchWaitSLO) compute(second int64) (compliance float64, total int) {
+	within := 0
+	for _, bucket := range slo.buckets {
+		if second-bucket.second < int64(len(slo.buckets)) {
+			total += bucket.total
+			within += bucket.within
+		}
+	}
+	if total == 0 {
+		return 100, 0
+	}
+	return float64(within) * 100 / float64(total), total
+}
+
+// observeDispatchWait accounts a dispatch wait in the SLO, it warns and notifies Config.OnDispatchWaitSLOViolation
+// when the SLO gets violated so that more client capacity can be added
+func (s *Server) observeDispatchWait(wait time.Duration) {
+	if s.dispatchWaitSLO == nil {
+		return
+	}
+
+	compliance, violated, changed := s.dispatchWaitSLO.observe(wait, time.Now())
+	if !changed {
+		return
+	}
+	if !violated {
+		s.logger.Info("Dispatch wait SLO met again", "compliance", compliance, "threshold", s.dispatchWaitSLO.threshold)
+		return
+	}
+
+	s.logger.Warn("Dispatch wait SLO violated", "compliance", compliance, "threshold", s.dispatchWaitSLO.threshold,
+		"target", s.Config.DispatchWaitSLOTarget)
+	s.metrics.IncCounter(MetricDispatchWaitSLOViolations, nil)
+	s.alert(AlertDispatchWaitSLO, "", "%.1f%% of the dispatches under %s, %.1f%% expected",
+		compliance, s.dispatchWaitSLO.threshold, s.Config.DispatchWaitSLOTarget)
+	if s.Config.OnDispatchWaitSLOViolation != nil {
+		go s.Config.OnDispatchWaitSLOViolation(compliance)
+	}
+}
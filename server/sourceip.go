@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// sourceIP returns the IP address of the remote peer of the request
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireSourceIP reserves a connection for the source IP.
+// It returns false if the IP already reached Config.MaxConnectionsPerSourceIP.
+func (s *Server) acquireSourceIP(ip string) bool {
+	s.sourceIPsLock.Lock()
+	defer s.sourceIPsLock.Unlock()
+
+	limit := s.Config.MaxConnectionsPerSourceIP
+	if limit > 0 && s.sourceIPs[ip] >= limit {
+		return false
+	}
+	s.sourceIPs[ip]++
+	return true
+}
+
+// releaseSourceIP releases a connection reserved by acquireSourceIP
+func (s *Server) releaseSourceIP(ip string) {
+	s.sourceIPsLock.Lock()
+	defer s.sourceIPsLock.Unlock()
+
+	s.sourceIPs[ip]--
+	if s.sourceIPs[ip] <= 0 {
+		delete(s.sourceIPs, ip)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A peer gone dark without closing its connections keeps them idle in its pool forever.
+// keepalive() is the only heartbeat : connections idle for longer than Config.PingInterval
+// ( or Config.IdleTimeout if unset ) are pinged and closed if the pong does not arrive within
+// Config.PingTimeout. Busy connections are never pinged, the peer only answers once it is done
+// with the request. The pools are checked at that pace rather than by the periodic clean,
+// so that a dead connection is reaped before it is dispatched.
+
+// watchPongs records the time of the pongs received from the peer, they are read by the read() goroutine
+func (connection *Connection) watchPongs() {
+	connection.ws.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&connection.lastPong, time.Now().UnixNano())
+		return nil
+	})
+}
+
+// keepaliveInterval returns the time after which an idle connection is pinged, 0 if keepalive is disabled
+func (s *Server) keepaliveInterval() time.Duration {
+	if s.Config.PingTimeout <= 0 {
+		return 0
+	}
+	if s.Config.PingInterval > 0 {
+		return s.Config.GetPingInterval()
+	}
+	return s.Config.GetIdleTimeout()
+}
+
+// checkStale pings the connection if it is idle for longer than the keepalive interval
+// and closes it if the previous ping has not been answered within Config.PingTimeout.
+// This MUST be surrounded by connection.lock.Lock()
+func (connection *Connection) checkStale(now time.Time) {
+	config := connection.pool.server.Config
+	interval := connection.pool.server.keepaliveInterval()
+	if connection.status != Idle || interval <= 0 {
+		return
+	}
+
+	lastPong := time.Unix(0, atomic.LoadInt64(&connection.lastPong))
+	if !connection.pingSent.IsZero() {
+		if lastPong.After(connection.pingSent) {
+			connection.pingSent = time.Time{}
+		} else if now.Sub(connection.pingSent) > config.GetPingTimeout() {
+			connection.close(websocket.CloseGoingAway, "ping timeout")
+		}
+		return
+	}
+
+	lastActivity := connection.idleSince
+	if lastPong.After(lastActivity) {
+		lastActivity = lastPong
+	}
+	if now.Sub(lastActivity) <= interval {
+		return
+	}
+
+	connection.pingSent = now
+	if err := connection.ws.WriteControl(websocket.PingMessage, nil, now.Add(closeWriteTimeout)); err != nil {
+		connection.close(websocket.CloseGoingAway, "ping failed")
+	}
+}
+
+// checkStale checks the peers of the idle connections of the pool.
+// This MUST be surrounded by pool.lock.Lock()
+func (pool *Pool) checkStale(now time.Time) {
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		connection.checkStale(now)
+		connection.lock.Unlock()
+	}
+}
+
+// keepalive checks the idle connections of every pool each keepalive interval ( or PingTimeout if shorter )
+// and removes the connections closed for want of pong until the server shuts down
+func (s *Server) keepalive() {
+	period := s.keepaliveInterval()
+	if timeout := s.Config.GetPingTimeout(); timeout < period {
+		period = timeout
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.RLock()
+		pools := append([]*Pool(nil), s.pools...)
+		s.lock.RUnlock()
+
+		now := time.Now()
+		for _, pool := range pools {
+			pool.lock.Lock()
+			pool.checkStale(now)
+			pool.Clean()
+			pool.lock.Unlock()
+		}
+	}
+}
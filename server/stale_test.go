@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestKeepalive(t *testing.T) {
+	tests := []struct {
+		name   string
+		pong   bool
+		reaped bool
+	}{
+		{name: "peer answering pings", pong: true, reaped: false},
+		{name: "peer gone dark", pong: false, reaped: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			config.PingInterval = 50
+			config.PingTimeout = 100
+			s, ts := newTestServer(t, config)
+			go s.keepalive()
+
+			ws := dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+			waitFor(t, func() bool { return connectionCount(s, "pool") == 1 })
+
+			// Reading lets the websocket answer the pings
+			if test.pong {
+				go func() {
+					for {
+						if _, _, err := ws.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			if test.reaped {
+				waitFor(t, func() bool { return connectionCount(s, "pool") == 0 })
+				return
+			}
+			time.Sleep(500 * time.Millisecond)
+			if got := connectionCount(s, "pool"); got != 1 {
+				t.Fatalf("got %d connections, want the connection answering pings to stay", got)
+			}
+		})
+	}
+}
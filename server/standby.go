@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/root-gg/wsp"
+)
+
+// StandbyLabel is the client label registering its pool as warm standby when set to "true"
+const StandbyLabel = "standby"
+
+// Warm standby pools keep their connections open but only serve requests when no active pool
+// has an idle connection, so spare capacity is ready for bursts or failover without absorbing
+// the normal traffic. The standby label is read when the pool is created, the admin API can
+// then change it.
+
+// IsStandby returns true if the pool is warm standby
+func (pool *Pool) IsStandby() bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.standby
+}
+
+// SetStandby makes the pool warm standby or active
+func (pool *Pool) SetStandby(standby bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.standby = standby
+}
+
+// preferActivePools returns the pools which are not standby if one of them has an idle connection,
+// otherwise all the pools so that the standby pools take over
+// This MUST be surrounded by s.lock.RLock()
+func (s *Server) preferActivePools(pools []*Pool) []*Pool {
+	var active []*Pool
+	standby, ready := false, false
+	for _, pool := range pools {
+		if pool.IsStandby() {
+			standby = true
+			continue
+		}
+		active = append(active, pool)
+		if !ready && pool.Size().Idle > 0 {
+			ready = true
+		}
+	}
+	if !standby || !ready {
+		return pools
+	}
+	return active
+}
+
+// adminStandby makes a pool warm standby or active ( POST ?pool=&standby=true|false )
+func (s *Server) adminStandby(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	standby, err := strconv.ParseBool(r.URL.Query().Get("standby"))
+	if err != nil {
+		wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Invalid standby : %v", err)
+		return
+	}
+
+	pool := s.getPool(PoolID(r.URL.Query().Get("pool")))
+	if pool == nil {
+		wsp.ProxyErrorStatusf(w, http.StatusNotFound, "No pool %q", r.URL.Query().Get("pool"))
+		return
+	}
+
+	pool.SetStandby(standby)
+	writeJSON(w, pool.Status())
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Status is the JSON document returned by the /status endpoint
+type Status struct {
+	PoolCount int
+	Idle      int
+	Busy      int
+	LongLived int
+
+	// Dispatch strategy in use
+	Strategy string
+
+	// Pools having idle connections and the number required to be ready
+	ReadyPools    int
+	MinReadyPools int
+
+	// Percentage of the recent dispatches meeting the dispatch wait SLO ( if enabled )
+	DispatchWaitSLOCompliance *float64 `json:",omitempty"`
+
+	// Open connections per advertised client version
+	Versions map[string]int `json:",omitempty"`
+
+	// In-flight requests per caller identity
+	Callers map[string]int `json:",omitempty"`
+
+	// Active maintenance windows and the pools they affect
+	MaintenanceWindows []string `json:",omitempty"`
+	InMaintenance      []PoolID `json:",omitempty"`
+
+	Pools []PoolStatus
+}
+
+// Status returns the current state of the Server
+func (s *Server) Status() (status *Status) {
+	return s.getStatus(false)
+}
+
+// getStatus returns the current state of the Server, with the health of every connection if verbose
+func (s *Server) getStatus(verbose bool) (status *Status) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	status = new(Status)
+	status.PoolCount = len(s.pools)
+	status.Pools = make([]PoolStatus, 0, len(s.pools))
+	for _, pool := range s.pools {
+		ps := pool.Status()
+		if verbose {
+			ps.Connections = pool.connectionsHealth()
+		}
+		status.Idle += ps.Idle
+		status.Busy += ps.Busy + ps.LongLived
+		if ps.Idle > 0 {
+			status.ReadyPools++
+		}
+		status.Pools = append(status.Pools, ps)
+	}
+	status.LongLived = int(atomic.LoadInt64(&s.longLived))
+	status.Versions = s.connectionVersions()
+	status.MinReadyPools = s.Config.MinReadyPools
+	status.Strategy = s.Strategy()
+	status.Callers = s.callersInFlight()
+	if s.dispatchWaitSLO != nil {
+		compliance := s.dispatchWaitSLO.compliance(time.Now())
+		status.DispatchWaitSLOCompliance = &compliance
+	}
+
+	now := time.Now()
+	for _, window := range s.Config.MaintenanceWindows {
+		if window.IsActive(now) {
+			status.MaintenanceWindows = append(status.MaintenanceWindows, window.Name)
+		}
+	}
+	for _, pool := range s.pools {
+		if s.inMaintenance(pool.id, now) {
+			status.InMaintenance = append(status.InMaintenance, pool.id)
+		}
+	}
+
+	return
+}
+
+// Pools returns a snapshot of the state of every connected pool
+func (s *Server) Pools() (pools []PoolStatus) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	pools = make([]PoolStatus, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool.Status())
+	}
+	return
+}
+
+// listPools lists the connected pools with their size and their idle and busy connections
+func (s *Server) listPools(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Pools())
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// The status of thousands of pools is large and highly compressible,
+	// stream it through gzip rather than buffering it
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		json.NewEncoder(gz).Encode(s.getStatus(verbose))
+		return
+	}
+
+	json.NewEncoder(w).Encode(s.getStatus(verbose))
+}
+
+// acceptsGzip returns true if the caller accepts gzip encoded responses ( and did not refuse it with q=0 )
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(encoding, ";")
+			if strings.TrimSpace(name) != "gzip" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if quality, err := strconv.ParseFloat(q, 64); err == nil && quality == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Availability is the JSON document returned by the /health endpoint
+type Availability struct {
+	PoolCount int
+	Idle      int
+	Busy      int
+
+	// Pools with idle connections and the number of them required to be ready
+	ReadyPools    int
+	MinReadyPools int
+}
+
+// health is the readiness endpoint, also served on /healthz. It fails while draining, while no WSP client
+// has a connection or until enough pools have idle connections to serve requests, and reports
+// the pool count and the idle and busy connection totals.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	availability, ready := s.availability()
+	if !ready {
+		// Not logged as load balancers probe it continuously
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(availability)
+		return
+	}
+	writeJSON(w, availability)
+}
+
+// availability returns the connections of the server and whether it is ready to serve requests.
+// It only counts the connections of the pools, the health checks probe it continuously.
+func (s *Server) availability() (availability *Availability, ready bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	availability = new(Availability)
+	availability.PoolCount = len(s.pools)
+	availability.MinReadyPools = s.Config.MinReadyPools
+
+	connected := false
+	for _, pool := range s.pools {
+		ps := pool.Size()
+		availability.Idle += ps.Idle
+		availability.Busy += ps.Busy + ps.LongLived
+		if ps.Idle > 0 {
+			availability.ReadyPools++
+		}
+		if ps.Idle+ps.Busy+ps.LongLived > 0 {
+			connected = true
+		}
+	}
+	ready = connected && availability.ReadyPools >= availability.MinReadyPools && !s.isDraining()
+	return availability, ready
+}
+
+// ready returns true if enough pools have idle connections to serve requests and the server is not draining
+func (s *Server) ready() bool {
+	_, ready := s.availability()
+	return ready
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name          string
+		connections   int
+		minReadyPools int
+		draining      bool
+		status        int
+	}{
+		{name: "no client", connections: 0, status: http.StatusServiceUnavailable},
+		{name: "client connected", connections: 1, status: http.StatusOK},
+		{name: "not enough ready pools", connections: 1, minReadyPools: 2, status: http.StatusServiceUnavailable},
+		{name: "draining", connections: 1, draining: true, status: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			config.MinReadyPools = test.minReadyPools
+			s, ts := newTestServer(t, config)
+			for i := 0; i < test.connections; i++ {
+				dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "pool", Size: 1}))
+			}
+			waitFor(t, func() bool { return connectionCount(s, "pool") == test.connections })
+			if test.draining {
+				s.BeginDrain()
+			}
+
+			w := httptest.NewRecorder()
+			s.health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+
+			availability := new(Availability)
+			if err := json.Unmarshal(w.Body.Bytes(), availability); err != nil {
+				t.Fatalf("unable to parse %q : %s", w.Body.String(), err)
+			}
+			if availability.PoolCount != test.connections || availability.MinReadyPools != test.minReadyPools {
+				t.Errorf("got %+v, want %d pools and %d required ready pools", availability, test.connections, test.minReadyPools)
+			}
+		})
+	}
+}
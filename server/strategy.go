@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/root-gg/wsp"
+)
+
+// Names of the dispatch strategies which can be set in Config.Strategy
+const (
+	// StrategyRandom picks uniformly at random among the pools having an idle connection
+	StrategyRandom = "random"
+	// StrategySuccessRate weights the random choice by the recent success rate of the pools
+	StrategySuccessRate = "success-rate"
+	// StrategyOrdered picks the first pool having an idle connection
+	StrategyOrdered = "ordered"
+	// StrategyCustom is reported when a Selector has been set with Server.SetSelector
+	StrategyCustom = "custom"
+)
+
+// Strategies lists the names of the dispatch strategies which can be set by name
+var Strategies = []string{StrategyRandom, StrategySuccessRate, StrategyOrdered}
+
+// dispatchStrategy is the strategy in use by the dispatcher, it is replaced as a whole when it changes
+type dispatchStrategy struct {
+	name     string
+	selector Selector
+}
+
+// newStrategySelector returns the Selector implementing the named strategy.
+// The default random strategy has no Selector and relies on reflect.Select.
+func newStrategySelector(strategy string) (Selector, error) {
+	switch strategy {
+	case "", StrategyRandom:
+		return nil, nil
+	case StrategyOrdered:
+		return OrderedSelector{}, nil
+	case StrategySuccessRate:
+		return NewSuccessRateSelector(rand.NewSource(time.Now().UnixNano())), nil
+	default:
+		return nil, fmt.Errorf("unknown dispatch strategy %q", strategy)
+	}
+}
+
+// SetStrategy switches the dispatcher to the named strategy, the requests dispatched afterwards use it.
+// It returns an error and keeps the current strategy if the name is unknown.
+func (s *Server) SetStrategy(name string) error {
+	selector, err := newStrategySelector(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = StrategyRandom
+	}
+	s.strategy.Store(&dispatchStrategy{name: name, selector: selector})
+	return nil
+}
+
+// Strategy returns the name of the dispatch strategy in use
+func (s *Server) Strategy() string {
+	return s.strategy.Load().name
+}
+
+// StrategyStatus is the JSON document returned by the /admin/strategy endpoint
+type StrategyStatus struct {
+	Strategy   string
+	Strategies []string
+}
+
+// adminStrategy reports the dispatch strategy in use and the available ones ( GET )
+// or switches to another one ( POST ?strategy= )
+func (s *Server) adminStrategy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := r.URL.Query().Get("strategy")
+		if name == "" {
+			wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "Missing strategy")
+			return
+		}
+		if err := s.SetStrategy(name); err != nil {
+			wsp.ProxyErrorStatusf(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		s.logger.Info("Dispatch strategy changed", "strategy", name)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		wsp.ProxyErrorStatusf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	writeJSON(w, StrategyStatus{Strategy: s.Strategy(), Strategies: Strategies})
+}
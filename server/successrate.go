@@ -0,0 +1,81 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// minSuccessRateWeight keeps degraded pools receiving some traffic so they can recover
+const minSuccessRateWeight = 0.01
+
+// recordResult updates the exponentially weighted moving average of the pool success rate.
+// The weight of a result halves every Config.SuccessRateHalfLife.
+func (pool *Pool) recordResult(success bool) {
+	value := 0.0
+	if success {
+		value = 1.0
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	now := time.Now()
+	halfLife := pool.server.Config.GetSuccessRateHalfLife()
+	alpha := 1.0
+	if halfLife > 0 && !pool.successRateUpdate.IsZero() {
+		elapsed := now.Sub(pool.successRateUpdate)
+		alpha = 1 - math.Exp(-math.Ln2*float64(elapsed)/float64(halfLife))
+	}
+	pool.successRate += alpha * (value - pool.successRate)
+	pool.successRateUpdate = now
+}
+
+// SuccessRate returns the recent success rate of the pool between 0 and 1
+func (pool *Pool) SuccessRate() float64 {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.successRate
+}
+
+// SuccessRateSelector selects a pool at random with a probability proportional to its recent success rate,
+// steering traffic away from degraded clients without cutting them off entirely.
+type SuccessRateSelector struct {
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+// NewSuccessRateSelector creates a new SuccessRateSelector
+func NewSuccessRateSelector(source rand.Source) (selector *SuccessRateSelector) {
+	selector = new(SuccessRateSelector)
+	selector.random = rand.New(source)
+	return
+}
+
+// Select returns a pool among the candidates weighted by success rate
+func (selector *SuccessRateSelector) Select(candidates []*Pool) *Pool {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, pool := range candidates {
+		weights[i] = math.Max(pool.SuccessRate(), minSuccessRateWeight)
+		total += weights[i]
+	}
+
+	selector.lock.Lock()
+	r := selector.random.Float64() * total
+	selector.lock.Unlock()
+
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,24 @@
+package server
+
+// PoolHeader is the request header addressing a specific client, only the pool having this id is dispatched from
+const PoolHeader = "X-PROXY-POOL"
+
+// poolFilter returns a filter accepting only the pool with the given id
+func poolFilter(id PoolID) func(pool *Pool) bool {
+	return func(pool *Pool) bool {
+		return pool.id == id
+	}
+}
+
+// andFilters returns a filter accepting the pools accepted by both filters, a nil filter accepts every pool
+func andFilters(a, b func(pool *Pool) bool) func(pool *Pool) bool {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(pool *Pool) bool {
+		return a(pool) && b(pool)
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Response headers reporting the proxy overhead with Config.ExposeDispatchHeaders
+const (
+	// DispatchWaitHeader is the time the request waited for an idle connection (milliseconds)
+	DispatchWaitHeader = "X-Wsp-Dispatch-Wait"
+	// PoolIDHeader is the ID of the WSP client which served the request
+	PoolIDHeader = "X-Wsp-Pool"
+	// UpstreamTimeHeader is the time between the dispatch and the response headers of the upstream (milliseconds)
+	UpstreamTimeHeader = "X-Wsp-Upstream-Time"
+)
+
+// setDispatchHeaders adds the dispatch headers to the response headers
+func setDispatchHeaders(header http.Header, dispatchWait time.Duration, pool PoolID, upstreamTime time.Duration) {
+	header.Set(DispatchWaitHeader, formatMilliseconds(dispatchWait))
+	header.Set(PoolIDHeader, string(pool))
+	header.Set(UpstreamTimeHeader, formatMilliseconds(upstreamTime))
+}
+
+// formatMilliseconds formats the duration as a number of milliseconds with a microsecond precision
+func formatMilliseconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds()*1000, 'f', 3, 64)
+}
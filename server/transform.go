@@ -0,0 +1,35 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/root-gg/wsp"
+)
+
+// RequestBodyTransform adapts the body of a request as it streams to the peer ( e.g. to convert or redact it ).
+// It may update the request headers, the Content-Length is removed as the length of the result is unknown.
+// Transforms should wrap the body rather than buffer it to bound the memory used by large bodies.
+type RequestBodyTransform func(r *http.Request, body io.Reader) io.Reader
+
+// ResponseBodyTransform adapts the body of a response as it streams to the caller.
+// It may update the response headers, the Content-Length is removed as the length of the result is unknown.
+// Transforms should wrap the body rather than buffer it to bound the memory used by large bodies.
+type ResponseBodyTransform func(r *http.Request, response *wsp.HTTPResponse, body io.Reader) io.Reader
+
+// serializeRequest serializes the request and returns the body to send to the peer
+// after applying Config.RequestBodyTransform
+func (s *Server) serializeRequest(r *http.Request) (*wsp.HTTPRequest, io.Reader) {
+	transform := s.Config.RequestBodyTransform
+	if transform == nil {
+		return wsp.SerializeHTTPRequest(r), r.Body
+	}
+
+	body := transform(r, r.Body)
+	request := wsp.SerializeHTTPRequest(r)
+	header := r.Header.Clone()
+	header.Del("Content-Length")
+	request.Header = header
+	request.ContentLength = -1
+	return request, body
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/root-gg/wsp"
+)
+
+// VersionInfo is the JSON document returned by the /version endpoint
+type VersionInfo struct {
+	Version            string
+	GitCommit          string `json:",omitempty"`
+	GoVersion          string
+	MinProtocolVersion int
+	MaxProtocolVersion int
+}
+
+// VersionInfo returns the build and protocol versions of the Server
+func (s *Server) VersionInfo() (info *VersionInfo) {
+	info = new(VersionInfo)
+	info.Version = wsp.Version
+	if s.Config.Version != "" {
+		info.Version = s.Config.Version
+	}
+	info.GitCommit = wsp.GitCommit
+	if info.GitCommit == "" {
+		// Binaries built from a git checkout embed the revision
+		if buildInfo, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range buildInfo.Settings {
+				if setting.Key == "vcs.revision" {
+					info.GitCommit = setting.Value
+				}
+			}
+		}
+	}
+	info.GoVersion = runtime.Version()
+	info.MinProtocolVersion = wsp.MinProtocolVersion
+	info.MaxProtocolVersion = wsp.MaxProtocolVersion
+	return
+}
+
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.VersionInfo())
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Alert types sent to the webhooks, embedding programs can send their own with Server.SendAlert
+const (
+	// AlertPoolDown means a pool has been removed after staying without connection
+	AlertPoolDown = "pool_down"
+	// AlertAllPoolsEmpty means no client has a connection anymore
+	AlertAllPoolsEmpty = "all_pools_empty"
+	// AlertDispatchTimeouts means at least Config.DispatchTimeoutAlertThreshold dispatches timed out between two cleans
+	AlertDispatchTimeouts = "dispatch_timeouts"
+	// AlertDispatchWaitSLO means the dispatch wait SLO got violated
+	AlertDispatchWaitSLO = "dispatch_wait_slo"
+)
+
+// Alert is a significant change of the server state sent to the webhooks
+type Alert struct {
+	Type    string
+	PoolID  PoolID `json:",omitempty"`
+	Message string
+	Time    time.Time
+
+	// Number of times the alert was raised during the batch, the Time and Message are the ones of the first
+	Count int
+}
+
+// Webhook POSTs the alerts as a JSON array to URL. The alerts are batched over BatchInterval (milliseconds)
+// and the ones of the same type and pool are sent once with their count, at most MaxBatchSize per POST.
+// Only the alerts of the listed Types are sent, all of them if empty. A POST gives up after Timeout (milliseconds).
+type Webhook struct {
+	URL           string
+	Types         []string
+	BatchInterval int
+	MaxBatchSize  int
+	Timeout       int
+}
+
+// Defaults of the Webhook settings
+const (
+	defaultWebhookBatchInterval = 10000
+	defaultWebhookMaxBatchSize  = 100
+	defaultWebhookTimeout       = 5000
+)
+
+// webhookQueueSize is the number of alerts waiting for a webhook batch before new ones are dropped
+const webhookQueueSize = 1000
+
+// Compile validates the webhook configuration
+func (webhook *Webhook) Compile() error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL")
+	}
+	if webhook.BatchInterval <= 0 {
+		webhook.BatchInterval = defaultWebhookBatchInterval
+	}
+	if webhook.MaxBatchSize <= 0 {
+		webhook.MaxBatchSize = defaultWebhookMaxBatchSize
+	}
+	if webhook.Timeout <= 0 {
+		webhook.Timeout = defaultWebhookTimeout
+	}
+	return nil
+}
+
+// Accepts returns true if the alerts of the type are sent to the webhook
+func (webhook *Webhook) Accepts(alertType string) bool {
+	if len(webhook.Types) == 0 {
+		return true
+	}
+	for _, t := range webhook.Types {
+		if t == alertType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookNotifier batches the alerts of a webhook and POSTs them from its own goroutine,
+// so that a slow or failing webhook never blocks the server
+type webhookNotifier struct {
+	webhook *Webhook
+	alerts  chan *Alert
+	client  *http.Client
+	server  *Server
+}
+
+// newWebhookNotifier creates a new webhookNotifier
+func newWebhookNotifier(server *Server, webhook *Webhook) (notifier *webhookNotifier) {
+	notifier = new(webhookNotifier)
+	notifier.webhook = webhook
+	notifier.server = server
+	notifier.alerts = make(chan *Alert, webhookQueueSize)
+	notifier.client = &http.Client{Timeout: time.Duration(webhook.Timeout) * time.Millisecond}
+	return
+}
+
+// run sends the batches of alerts until done is closed, the pending alerts are sent one last time
+func (notifier *webhookNotifier) run(done chan struct{}) {
+	ticker := time.NewTicker(time.Duration(notifier.webhook.BatchInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	var batch []*Alert
+	for {
+		select {
+		case alert := <-notifier.alerts:
+			batch = debounceAlert(batch, alert)
+		case <-ticker.C:
+			notifier.send(batch)
+			batch = nil
+		case <-done:
+			notifier.send(batch)
+			return
+		}
+	}
+}
+
+// debounceAlert adds the alert to the batch, or counts it if the batch has an alert of the same type and pool
+func debounceAlert(batch []*Alert, alert *Alert) []*Alert {
+	for _, a := range batch {
+		if a.Type == alert.Type && a.PoolID == alert.PoolID {
+			a.Count++
+			return batch
+		}
+	}
+	alert.Count = 1
+	return append(batch, alert)
+}
+
+// send POSTs the batch in chunks of at most MaxBatchSize alerts, failures are logged and the alerts dropped
+func (notifier *webhookNotifier) send(batch []*Alert) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > notifier.webhook.MaxBatchSize {
+			n = notifier.webhook.MaxBatchSize
+		}
+		if err := notifier.post(batch[:n]); err != nil {
+			notifier.server.logger.Warn("Unable to send alerts to the webhook", "alerts", n, "error", err)
+		}
+		batch = batch[n:]
+	}
+}
+
+// post sends the alerts to the webhook
+func (notifier *webhookNotifier) post(alerts []*Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := notifier.client.Post(notifier.webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL might hold a secret, don't log it
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SendAlert sends the alert to the webhooks accepting its type, it never blocks.
+// The alert is dropped if the queue of a webhook is full.
+func (s *Server) SendAlert(alert Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	for _, notifier := range s.webhooks {
+		if !notifier.webhook.Accepts(alert.Type) {
+			continue
+		}
+		a := alert
+		select {
+		case notifier.alerts <- &a:
+		default:
+			s.logger.Warn("Dropping alert, the webhook queue is full", "alert", alert.Type)
+		}
+	}
+}
+
+// alert sends an alert about the pool ( empty for the whole server ) to the webhooks
+func (s *Server) alert(alertType string, pool PoolID, format string, args ...interface{}) {
+	if len(s.webhooks) == 0 {
+		return
+	}
+	s.SendAlert(Alert{Type: alertType, PoolID: pool, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkAlerts raises the alerts depending on the state of the pools, connected tells whether any
+// client has a connection. This MUST be surrounded by s.lock.Lock()
+func (s *Server) checkAlerts(connected bool) {
+	if s.wasConnected && !connected {
+		s.alert(AlertAllPoolsEmpty, "", "No WSP client has a connection")
+	}
+	s.wasConnected = connected
+
+	timeouts := atomic.SwapInt64(&s.dispatchTimeouts, 0)
+	if threshold := s.Config.DispatchTimeoutAlertThreshold; threshold > 0 && timeouts >= int64(threshold) {
+		s.alert(AlertDispatchTimeouts, "", "%d requests got no connection before the timeout", timeouts)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultPoolWeight is the weight of the pools whose client did not advertise one
+const defaultPoolWeight = 1
+
+// Weight returns the weight advertised by the client in its greeting, 0 if none
+func (pool *Pool) Weight() int {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.weight
+}
+
+// setWeight updates the weight advertised by the client
+func (pool *Pool) setWeight(weight int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.weight = weight
+}
+
+// WeightedSelector selects a pool at random with a probability proportional to the weight advertised by its client,
+// so that clients with more capacity receive more requests. Pools without weight count as defaultPoolWeight.
+// The dispatcher uses it when no Selector is set and at least one client advertises a weight.
+type WeightedSelector struct {
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+// NewWeightedSelector creates a new WeightedSelector
+func NewWeightedSelector(source rand.Source) (selector *WeightedSelector) {
+	selector = new(WeightedSelector)
+	selector.random = rand.New(source)
+	return
+}
+
+// Select returns a pool among the candidates weighted by their advertised weight
+func (selector *WeightedSelector) Select(candidates []*Pool) *Pool {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	weights := make([]int, len(candidates))
+	total := 0
+	for i, pool := range candidates {
+		weights[i] = pool.Weight()
+		if weights[i] <= 0 {
+			weights[i] = defaultPoolWeight
+		}
+		total += weights[i]
+	}
+
+	selector.lock.Lock()
+	r := selector.random.Intn(total)
+	selector.lock.Unlock()
+
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// setPoolWeight updates the weight advertised by the client of the pool and the count of weighted pools.
+// This MUST be surrounded by s.lock.Lock()
+func (s *Server) setPoolWeight(pool *Pool, weight int) {
+	previous := pool.Weight()
+	pool.setWeight(weight)
+	if previous <= 0 && weight > 0 {
+		atomic.AddInt32(&s.weightedPools, 1)
+	} else if previous > 0 && weight <= 0 {
+		atomic.AddInt32(&s.weightedPools, -1)
+	}
+}
+
+// removeWeightedPool updates the count of weighted pools once the pool is removed from the server.
+// This MUST be surrounded by s.lock.Lock()
+func (s *Server) removeWeightedPool(pool *Pool) {
+	if pool.Weight() > 0 {
+		atomic.AddInt32(&s.weightedPools, -1)
+	}
+}
+
+// hasWeightedPools returns true if a client advertised a weight.
+// It is called on every dispatch so it only reads the count kept by setPoolWeight.
+func (s *Server) hasWeightedPools() bool {
+	return atomic.LoadInt32(&s.weightedPools) > 0
+}
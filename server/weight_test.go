@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/root-gg/wsp"
+)
+
+func TestHasWeightedPools(t *testing.T) {
+	config := NewConfig()
+	config.EmptyPoolGracePeriod = 0
+	s, ts := newTestServer(t, config)
+	if s.hasWeightedPools() {
+		t.Fatal("got weighted pools without client")
+	}
+
+	// Every connection of a weighted client greets with its weight, the pool is counted once
+	weighted := testGreeting(t, wsp.GreetingMessage{ID: "weighted", Size: 2, Weight: 3})
+	connections := []*websocket.Conn{dialTestServer(t, ts, weighted), dialTestServer(t, ts, weighted)}
+	dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "plain", Size: 1}))
+	waitFor(t, func() bool { return connectionCount(s, "weighted") == 2 && connectionCount(s, "plain") == 1 })
+	if got := atomic.LoadInt32(&s.weightedPools); got != 1 {
+		t.Fatalf("got %d weighted pools, want 1", got)
+	}
+
+	// A client greeting without weight any more is not weighted
+	connections = append(connections, dialTestServer(t, ts, testGreeting(t, wsp.GreetingMessage{ID: "weighted", Size: 3})))
+	waitFor(t, func() bool { return connectionCount(s, "weighted") == 3 })
+	if s.hasWeightedPools() {
+		t.Fatal("got weighted pools once the client stopped advertising a weight")
+	}
+
+	connections = append(connections, dialTestServer(t, ts, weighted))
+	waitFor(t, func() bool { return connectionCount(s, "weighted") == 4 })
+	if !s.hasWeightedPools() {
+		t.Fatal("got no weighted pool once the client advertised a weight again")
+	}
+
+	// The pools removed by the clean are not counted
+	for _, ws := range connections {
+		ws.Close()
+	}
+	waitFor(t, func() bool { return connectionCount(s, "weighted") == 0 })
+	s.clean()
+	if s.getPool("weighted") != nil {
+		t.Fatal("the empty pool has not been removed")
+	}
+	if s.hasWeightedPools() {
+		t.Fatal("got weighted pools once the weighted pool has been removed")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+)
+
+// statusWriter is a http.ResponseWriter recording the status code written to the caller
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// Number of body bytes written
+	written int64
+
+	// Optional hook updating the response headers before they are written
+	beforeWriteHeader func(header http.Header)
+}
+
+// newStatusWriter creates a new statusWriter
+func newStatusWriter(w http.ResponseWriter) (sw *statusWriter) {
+	sw = new(statusWriter)
+	sw.ResponseWriter = w
+	sw.status = http.StatusOK
+	return
+}
+
+// WriteHeader records the status code and writes it
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	if sw.beforeWriteHeader != nil {
+		sw.beforeWriteHeader(sw.Header())
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the body to the caller and counts the bytes written
+func (sw *statusWriter) Write(b []byte) (n int, err error) {
+	n, err = sw.ResponseWriter.Write(b)
+	sw.written += int64(n)
+	return
+}
+
+// Flush sends any buffered data to the caller if the underlying http.ResponseWriter supports it
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,23 @@
+package wsp
+
+// Version and GitCommit identify the build, they are set at build time with
+// -ldflags "-X github.com/root-gg/wsp.Version=1.2.3 -X github.com/root-gg/wsp.GitCommit=$(git rev-parse HEAD)"
+var (
+	Version   = "dev"
+	GitCommit = ""
+)
+
+// Range of the Client / Server protocol versions supported by this build.
+// 1 is the underscore delimited greeting, 2 the JSON GreetingMessage,
+// 3 adds the request bodies sent in chunks with control messages interleaved ( see HTTPRequest.ChunkedBody ),
+// 4 the response trailers sent after the response body ( see HTTPRequest.Trailers ).
+const (
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 4
+
+	// ChunkedBodyProtocolVersion is the first protocol version supporting chunked request bodies
+	ChunkedBodyProtocolVersion = 3
+
+	// TrailersProtocolVersion is the first protocol version relaying the response trailers
+	TrailersProtocolVersion = 4
+)